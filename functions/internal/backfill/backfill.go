@@ -1,9 +1,14 @@
 package backfill
 
 import (
+	"context"
 	"errors"
+	"math"
+	"strconv"
 
+	"github.com/KamWithK/exSTATic-backend/internal/config"
 	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
 	"github.com/KamWithK/exSTATic-backend/internal/user_media"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
@@ -12,81 +17,233 @@ import (
 )
 
 type BackfillArgs struct {
-	Username     string                                                   `json:"username"`
-	MediaEntries map[user_media.UserMediaKey]user_media.UserMediaEntry    `json:"media_entries"`
-	MediaStats   map[user_media.UserMediaDateKey]user_media.UserMediaStat `json:"media_stats"`
+	Username        string                                                   `json:"username"`
+	MediaEntries    map[user_media.UserMediaKey]user_media.UserMediaEntry    `json:"media_entries"`
+	MediaStats      map[user_media.UserMediaDateKey]user_media.UserMediaStat `json:"media_stats"`
+	EntryTombstones map[user_media.UserMediaKey]user_media.Tombstone         `json:"entry_tombstones"`
+	StatTombstones  map[user_media.UserMediaDateKey]user_media.Tombstone     `json:"stat_tombstones"`
 }
 
-func GetBackfill(svc *dynamodb.DynamoDB, userMediaDateKey user_media.UserMediaDateKey) (*BackfillArgs, error) {
-	queryInput := &dynamodb.QueryInput{
-		TableName:              aws.String("media"),
-		KeyConditionExpression: aws.String("pk = :pk AND last_update >= :lastUpdate"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":pk": {
-				S: aws.String(user_media.UserMediaPK(userMediaDateKey.Key)),
-			},
-			":lastUpdate": {
-				N: aws.String(user_media.ZeroPadInt64(userMediaDateKey.DateTime)),
+func NewBackfillArgs(username string) *BackfillArgs {
+	return &BackfillArgs{
+		Username:        username,
+		MediaEntries:    map[user_media.UserMediaKey]user_media.UserMediaEntry{},
+		MediaStats:      map[user_media.UserMediaDateKey]user_media.UserMediaStat{},
+		EntryTombstones: map[user_media.UserMediaKey]user_media.Tombstone{},
+		StatTombstones:  map[user_media.UserMediaDateKey]user_media.Tombstone{},
+	}
+}
+
+// Sorts a media table item into the entries, stats or tombstones
+// Later items replace earlier ones, so a deletion and a re-creation never both remain
+func (history *BackfillArgs) AddItem(ctx context.Context, item map[string]*dynamodb.AttributeValue) {
+	pk, sk := *item["pk"].S, *item["sk"].S
+	key, date, splitErr := user_media.SplitUserMediaCompositeKey(pk, sk)
+
+	if splitErr != nil {
+		log.Ctx(ctx).Error().Err(splitErr).Str("pk", pk).Str("sk", sk).Interface("item", item).Msg("Could not split keys")
+	} else if key != nil && user_media.IsTombstone(item) {
+		tombstone := user_media.Tombstone{}
+		unmarshalErr := dynamodbattribute.UnmarshalMap(item, &tombstone)
+
+		if unmarshalErr != nil {
+			log.Ctx(ctx).Error().Interface("key", key).Interface("item", item).Err(unmarshalErr).Msg("Could not unmarshal item into Tombstone")
+		} else if date == nil {
+			delete(history.MediaEntries, *key)
+			history.EntryTombstones[*key] = tombstone
+		} else {
+			dateKey := user_media.UserMediaDateKey{
+				Key:      *key,
+				DateTime: *date,
+			}
+			delete(history.MediaStats, dateKey)
+			history.StatTombstones[dateKey] = tombstone
+		}
+	} else if key != nil && date == nil {
+		mediaEntry := user_media.UserMediaEntry{}
+		unmarshalErr := dynamodbattribute.UnmarshalMap(item, &mediaEntry)
+
+		if unmarshalErr != nil {
+			log.Ctx(ctx).Error().Interface("key", key).Interface("item", item).Err(unmarshalErr).Msg("Could not unmarshal item into UserMediaEntry")
+		} else {
+			delete(history.EntryTombstones, *key)
+			history.MediaEntries[*key] = mediaEntry
+		}
+	} else if key != nil {
+		mediaStat := user_media.UserMediaStat{}
+		unmarshalErr := dynamodbattribute.UnmarshalMap(item, &mediaStat)
+
+		if unmarshalErr != nil {
+			log.Ctx(ctx).Error().Interface("key", key).Interface("item", item).Err(unmarshalErr).Msg("Could not unmarshal item into UserMediaStat")
+		} else {
+			dateKey := user_media.UserMediaDateKey{
+				Key:      *key,
+				DateTime: *date,
+			}
+			delete(history.StatTombstones, dateKey)
+			history.MediaStats[dateKey] = mediaStat
+		}
+	} else {
+		log.Ctx(ctx).Error().Str("pk", pk).Str("sk", sk).Interface("item", item).Msg("Item neither entry nor stat")
+	}
+}
+
+// Reads everything changed since the given time, in the order it changed
+func GetBackfill(ctx context.Context, svc storage.Storage, userMediaDateKey user_media.UserMediaDateKey) (*BackfillArgs, error) {
+	cfg := svc.Config()
+	query := dynamo_wrapper.NewQuery(cfg.Tables.Media).
+		Index(cfg.Indexes.LastUpdated).
+		Partition("pk", user_media.UserMediaPK(userMediaDateKey.Key)).
+		SortCompare("last_update", ">=", userMediaDateKey.DateTime)
+
+	history := NewBackfillArgs(userMediaDateKey.Key.Username)
+	queryErr := query.Each(ctx, svc, func(item map[string]*dynamodb.AttributeValue) error {
+		history.AddItem(ctx, item)
+		return nil
+	})
+	if queryErr != nil {
+		return nil, queryErr
+	}
+
+	return history, nil
+}
+
+// Narrows a backfill down to a window of days and optionally a single title
+// Dates are inclusive, a missing start or end leaves that side of the window open
+type BackfillQueryArgs struct {
+	user_media.UserMediaDateKey
+	StartDate *int64 `json:"start_date"`
+	EndDate   *int64 `json:"end_date"`
+}
+
+func QueryBackfill(ctx context.Context, svc storage.Storage, args BackfillQueryArgs) (*BackfillArgs, error) {
+	if args.Key.MediaIdentifier == "" && args.StartDate == nil && args.EndDate == nil {
+		return GetBackfill(ctx, svc, args.UserMediaDateKey)
+	}
+
+	return GetMediaBackfill(ctx, svc, args)
+}
+
+// Reads stats within a window of days, along with the title's entry when one is given
+// Stats are queried through the sort key (date then identifier), so a title's are picked out of each day's
+func GetMediaBackfill(ctx context.Context, svc storage.Storage, args BackfillQueryArgs) (*BackfillArgs, error) {
+	startDate, endDate := int64(0), int64(math.MaxInt64-1)
+	if args.StartDate != nil {
+		startDate = *args.StartDate
+	}
+	if args.EndDate != nil {
+		endDate = *args.EndDate
+	}
+
+	if startDate > endDate {
+		err := errors.New("backfill window ends before it starts")
+		log.Ctx(ctx).Info().Err(err).Int64("start_date", startDate).Int64("end_date", endDate).Send()
+		return nil, err
+	}
+
+	key := args.Key
+	history := NewBackfillArgs(key.Username)
+	tableName := svc.Config().Tables.Media
+
+	// The entry is always returned, stats only when they changed since the time given
+	if key.MediaIdentifier != "" {
+		entryKey, keyErr := dynamo_wrapper.GetCompositeKey(ctx, user_media.UserMediaPK(key), user_media.MediaInfoSK(key))
+		if keyErr != nil {
+			return nil, keyErr
+		}
+		result, getErr := svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(tableName),
+			Key:       entryKey,
+		})
+		if getErr != nil {
+			log.Ctx(ctx).Error().Err(getErr).Str("table", tableName).Interface("key", key).Msg("Dynamodb failed to get item")
+			return nil, getErr
+		}
+		if result.Item != nil {
+			history.AddItem(ctx, result.Item)
+		}
+	}
+
+	// Every stat sort key on the last day is longer than the next day's bare date, so the range is inclusive
+	query := dynamo_wrapper.NewQuery(tableName).
+		Partition("pk", user_media.UserMediaPK(key)).
+		SortBetween("sk", user_media.ZeroPadInt64(startDate), user_media.ZeroPadInt64(endDate+1))
+	if args.DateTime > 0 {
+		query.Filter(dynamo_wrapper.Expression{
+			Expression: "last_update >= :lastUpdate",
+			Values: map[string]*dynamodb.AttributeValue{
+				":lastUpdate": {N: aws.String(strconv.FormatInt(args.DateTime, 10))},
 			},
-		},
-		IndexName: aws.String("lastUpdatedIndex"),
+		})
 	}
 
-	result, queryErr := svc.Query(queryInput)
+	queryErr := query.Each(ctx, svc, func(item map[string]*dynamodb.AttributeValue) error {
+		itemKey, date, splitErr := user_media.SplitUserMediaCompositeKey(*item["pk"].S, *item["sk"].S)
+
+		if splitErr == nil && date != nil && (key.MediaIdentifier == "" || itemKey.MediaIdentifier == key.MediaIdentifier) {
+			history.AddItem(ctx, item)
+		}
+		return nil
+	})
 	if queryErr != nil {
-		log.Info().Err(queryErr).Send()
+		log.Ctx(ctx).Error().Err(queryErr).Str("table", tableName).Interface("args", args).Msg("Dynamodb query failed")
 		return nil, queryErr
 	}
 
-	mediaEntries := map[user_media.UserMediaKey]user_media.UserMediaEntry{}
-	mediaStats := map[user_media.UserMediaDateKey]user_media.UserMediaStat{}
+	return history, nil
+}
+
+// Replaces any tombstones given with those stored for the media types being uploaded
+// Clients can't be trusted to know about deletions made from other devices
+func LoadTombstones(ctx context.Context, svc storage.Storage, history *BackfillArgs) error {
+	mediaKeys := map[user_media.UserMediaKey]bool{}
+	for key := range history.MediaEntries {
+		mediaKeys[user_media.UserMediaKey{Username: history.Username, MediaType: key.MediaType}] = true
+	}
+	for key := range history.MediaStats {
+		mediaKeys[user_media.UserMediaKey{Username: history.Username, MediaType: key.Key.MediaType}] = true
+	}
 
-	for _, item := range result.Items {
-		pk, sk := *item["pk"].S, *item["sk"].S
-		key, date, splitErr := user_media.SplitUserMediaCompositeKey(pk, sk)
+	history.EntryTombstones = map[user_media.UserMediaKey]user_media.Tombstone{}
+	history.StatTombstones = map[user_media.UserMediaDateKey]user_media.Tombstone{}
 
-		if splitErr != nil {
-			log.Error().Err(splitErr).Str("pk", pk).Str("sk", sk).Interface("item", item).Msg("Could not split keys")
-		} else if key != nil && date == nil {
-			mediaEntry := user_media.UserMediaEntry{}
-			unmarshalErr := dynamodbattribute.UnmarshalMap(item, &mediaEntry)
+	tableName := svc.Config().Tables.Media
+	for mediaKey := range mediaKeys {
+		query := dynamo_wrapper.NewQuery(tableName).
+			Partition("pk", user_media.UserMediaPK(mediaKey)).
+			Filter(dynamo_wrapper.Expression{Expression: "attribute_exists(deleted_at)"})
 
-			if unmarshalErr != nil {
-				log.Error().Interface("key", key).Interface("item", item).Err(unmarshalErr).Msg("Could not unmarshal item into UserMediaEntry")
-			} else {
-				mediaEntries[*key] = mediaEntry
-			}
-		} else if key != nil {
-			mediaStat := user_media.UserMediaStat{}
-			unmarshalErr := dynamodbattribute.UnmarshalMap(item, &mediaStat)
+		queryErr := query.Each(ctx, svc, func(item map[string]*dynamodb.AttributeValue) error {
+			pk, sk := *item["pk"].S, *item["sk"].S
+			key, date, splitErr := user_media.SplitUserMediaCompositeKey(pk, sk)
+			tombstone := user_media.Tombstone{}
 
-			if unmarshalErr != nil {
-				log.Error().Interface("key", key).Interface("item", item).Err(unmarshalErr).Msg("Could not unmarshal item into UserMediaStat")
+			if splitErr != nil {
+				log.Ctx(ctx).Error().Err(splitErr).Str("pk", pk).Str("sk", sk).Interface("item", item).Msg("Could not split keys")
+			} else if unmarshalErr := dynamodbattribute.UnmarshalMap(item, &tombstone); unmarshalErr != nil {
+				log.Ctx(ctx).Error().Interface("key", key).Interface("item", item).Err(unmarshalErr).Msg("Could not unmarshal item into Tombstone")
+			} else if date == nil {
+				history.EntryTombstones[*key] = tombstone
 			} else {
-				dateKey := user_media.UserMediaDateKey{
-					Key:      *key,
-					DateTime: *date,
-				}
-				mediaStats[dateKey] = mediaStat
+				history.StatTombstones[user_media.UserMediaDateKey{Key: *key, DateTime: *date}] = tombstone
 			}
-		} else {
-			log.Error().Str("pk", pk).Str("sk", sk).Interface("item", item).Msg("Item neither entry nor stat")
+			return nil
+		})
+		if queryErr != nil {
+			log.Ctx(ctx).Error().Err(queryErr).Str("table", tableName).Interface("key", mediaKey).Msg("Dynamodb query failed")
+			return queryErr
 		}
 	}
 
-	return &BackfillArgs{
-		Username:     userMediaDateKey.Key.Username,
-		MediaEntries: mediaEntries,
-		MediaStats:   mediaStats,
-	}, nil
+	return nil
 }
 
-func PutBackfill(history BackfillArgs) (*dynamo_wrapper.BatchwriteArgs, error) {
+func PutBackfill(ctx context.Context, cfg *config.Config, history BackfillArgs) (*dynamo_wrapper.BatchwriteArgs, error) {
 	username := history.Username
 
 	if len(username) == 0 {
 		err := errors.New("invalid username")
-		log.Info().Err(err).Send()
+		log.Ctx(ctx).Info().Err(err).Send()
 
 		return nil, err
 	}
@@ -94,20 +251,24 @@ func PutBackfill(history BackfillArgs) (*dynamo_wrapper.BatchwriteArgs, error) {
 	writeRequests := []*dynamodb.WriteRequest{}
 
 	for key, userMedia := range history.MediaEntries {
-		writeRequest := dynamo_wrapper.PutRawRequest(user_media.UserMediaPK(key), user_media.MediaInfoSK(key), &userMedia)
+		writeRequest := dynamo_wrapper.PutRawRequest(ctx, user_media.UserMediaPK(key), user_media.MediaInfoSK(key), &userMedia)
 		if key.Username != username {
 			err := errors.New("username mismatch")
-			log.Info().Err(err).Send()
+			log.Ctx(ctx).Info().Err(err).Send()
+		} else if tombstone, deleted := history.EntryTombstones[key]; deleted && tombstone.Supersedes(userMedia.LastUpdate) {
+			log.Ctx(ctx).Info().Interface("key", key).Msg("Skipping media entry deleted after its last update")
 		} else if writeRequest != nil {
 			writeRequests = append(writeRequests, writeRequest)
 		}
 	}
 
 	for key, userMedia := range history.MediaStats {
-		writeRequest := dynamo_wrapper.PutRawRequest(user_media.UserMediaPK(key.Key), user_media.StatusUpdateSK(key), &userMedia)
+		writeRequest := dynamo_wrapper.PutRawRequest(ctx, user_media.UserMediaPK(key.Key), user_media.StatusUpdateSK(key), &userMedia)
 		if key.Key.Username != username {
 			err := errors.New("username mismatch")
-			log.Info().Err(err).Send()
+			log.Ctx(ctx).Info().Err(err).Send()
+		} else if tombstone, deleted := history.StatTombstones[key]; deleted && tombstone.Supersedes(userMedia.LastUpdate) {
+			log.Ctx(ctx).Info().Interface("key", key).Msg("Skipping media stat deleted after its last update")
 		} else if writeRequest != nil {
 			writeRequests = append(writeRequests, writeRequest)
 		}
@@ -115,14 +276,14 @@ func PutBackfill(history BackfillArgs) (*dynamo_wrapper.BatchwriteArgs, error) {
 
 	if len(writeRequests) == 0 {
 		err := errors.New("error no valid data")
-		log.Info().Err(err).Send()
+		log.Ctx(ctx).Info().Err(err).Send()
 
 		return nil, err
 	}
 
 	return &dynamo_wrapper.BatchwriteArgs{
 		WriteRequests: writeRequests,
-		TableName:     "media",
-		MaxBatchSize:  25,
+		TableName:     cfg.Tables.Media,
+		MaxBatchSize:  cfg.MaxBatchSize,
 	}, nil
 }
@@ -1,17 +1,17 @@
 package backfill
 
 import (
+	"context"
+	"fmt"
+	"os"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
 	"github.com/KamWithK/exSTATic-backend/internal/user_media"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/endpoints"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/jaswdr/faker"
 	"github.com/stretchr/testify/assert"
@@ -30,25 +30,19 @@ type IntermediateStatItem struct {
 	user_media.UserMediaStat
 }
 
-const EndpointURL = "http://localhost:4566/"
+var dynamoSvc storage.Storage
 
-var sess *session.Session
-var dynamoSvc *dynamodb.DynamoDB
-
-func init() {
-	sess = session.Must(session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Endpoint:    aws.String(EndpointURL),
-			Region:      aws.String(endpoints.UsEast1RegionID),
-			Credentials: credentials.NewStaticCredentials("foo", "var", ""),
-		},
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-	dynamoSvc = dynamodb.New(sess)
+func TestMain(m *testing.M) {
+	var storageErr error
+	if dynamoSvc, storageErr = storage.NewLocalStorage(); storageErr != nil {
+		fmt.Fprintln(os.Stderr, "Local storage unavailable:", storageErr)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
 }
 
 func TestNull(t *testing.T) {
-	result, err := PutBackfill(BackfillArgs{})
+	result, err := PutBackfill(context.Background(), dynamoSvc.Config(), BackfillArgs{})
 
 	assert.Nil(t, result, "No input => no writes")
 	assert.Error(t, err)
@@ -57,7 +51,7 @@ func TestNull(t *testing.T) {
 func TestNoUsername(t *testing.T) {
 	fake := faker.New()
 
-	result, err := PutBackfill(BackfillArgs{
+	result, err := PutBackfill(context.Background(), dynamoSvc.Config(), BackfillArgs{
 		Username:     "",
 		MediaEntries: user_media.RandomMediaEntries(fake, "", 3),
 	})
@@ -76,7 +70,7 @@ func TestMultipleUsernames(t *testing.T) {
 	userMediaEntries := user_media.RandomMediaEntries(fake, user1, validEntries)
 	maps.Copy(userMediaEntries, user_media.RandomMediaEntries(fake, user2, invalidEntries))
 
-	results, err := PutBackfill(BackfillArgs{
+	results, err := PutBackfill(context.Background(), dynamoSvc.Config(), BackfillArgs{
 		Username:     user1,
 		MediaEntries: userMediaEntries,
 	})
@@ -91,7 +85,7 @@ func TestWriteMediaEntries(t *testing.T) {
 
 	inputMediaEntries, producedMediaEntries := user_media.RandomMediaEntries(fake, user, 100), map[user_media.UserMediaKey]user_media.UserMediaEntry{}
 
-	results, err := PutBackfill(BackfillArgs{
+	results, err := PutBackfill(context.Background(), dynamoSvc.Config(), BackfillArgs{
 		Username:     user,
 		MediaEntries: inputMediaEntries,
 	})
@@ -130,7 +124,7 @@ func TestWriteMediaStats(t *testing.T) {
 		maps.Copy(inputMediaStats, user_media.RandomMediaStats(fake, key, 30, 0.8))
 	}
 
-	results, err := PutBackfill(BackfillArgs{
+	results, err := PutBackfill(context.Background(), dynamoSvc.Config(), BackfillArgs{
 		Username:   user,
 		MediaStats: inputMediaStats,
 	})
@@ -172,17 +166,18 @@ func TestStorageRetrieval(t *testing.T) {
 	numDays := 100
 
 	inputMediaEntries := user_media.RandomMediaEntries(fake, user, numDays)
-	batchwriterArgs, err := PutBackfill(BackfillArgs{
+	batchwriterArgs, err := PutBackfill(context.Background(), dynamoSvc.Config(), BackfillArgs{
 		Username:     user,
 		MediaEntries: inputMediaEntries,
 	})
 	assert.NoError(t, err)
 	assert.NotEmpty(t, batchwriterArgs.WriteRequests)
 
-	output := dynamo_wrapper.DistributedBatchWrites(dynamoSvc, batchwriterArgs)
-	assert.Empty(t, output.WriteRequests)
+	output, writeErr := dynamo_wrapper.DistributedBatchWrites(context.Background(), dynamoSvc, batchwriterArgs)
+	assert.NoError(t, writeErr)
+	assert.True(t, output.Complete())
 
-	storedHistory, backfillErr := GetBackfill(dynamoSvc, user_media.UserMediaDateKey{
+	storedHistory, backfillErr := GetBackfill(context.Background(), dynamoSvc, user_media.UserMediaDateKey{
 		Key: user_media.UserMediaKey{
 			Username:  user,
 			MediaType: "vn",
@@ -201,3 +196,99 @@ func TestStorageRetrieval(t *testing.T) {
 		assert.Equal(t, original, newEntries[key])
 	}
 }
+
+func TestTombstonedUploads(t *testing.T) {
+	fake := faker.New()
+	user := fake.Person().Name()
+
+	mediaEntries := user_media.RandomMediaEntries(fake, user, 10)
+	entryTombstones := map[user_media.UserMediaKey]user_media.Tombstone{}
+	deletedEntries := 0
+
+	for key, entry := range mediaEntries {
+		if deletedEntries == 4 {
+			break
+		}
+		entryTombstones[key] = user_media.Tombstone{DeletedAt: entry.LastUpdate}
+		deletedEntries++
+	}
+
+	results, err := PutBackfill(context.Background(), dynamoSvc.Config(), BackfillArgs{
+		Username:        user,
+		MediaEntries:    mediaEntries,
+		EntryTombstones: entryTombstones,
+	})
+
+	assert.NoError(t, err)
+	assert.Len(t, results.WriteRequests, len(mediaEntries)-deletedEntries, "Entries deleted after their last update aren't written")
+}
+
+func TestMediaWindowRetrieval(t *testing.T) {
+	fake := faker.New()
+	user := fake.Person().Name()
+
+	mediaEntries := user_media.RandomMediaEntries(fake, user, 3)
+	mediaStats := map[user_media.UserMediaDateKey]user_media.UserMediaStat{}
+	for key := range mediaEntries {
+		maps.Copy(mediaStats, user_media.RandomMediaStats(fake, key, 30, 1))
+	}
+
+	batchwriterArgs, err := PutBackfill(context.Background(), dynamoSvc.Config(), BackfillArgs{
+		Username:     user,
+		MediaEntries: mediaEntries,
+		MediaStats:   mediaStats,
+	})
+	assert.NoError(t, err)
+
+	output, writeErr := dynamo_wrapper.DistributedBatchWrites(context.Background(), dynamoSvc, batchwriterArgs)
+	assert.NoError(t, writeErr)
+	assert.True(t, output.Complete())
+
+	key := maps.Keys(mediaEntries)[0]
+	startDate, endDate := time.Now().AddDate(0, 0, -20).Unix(), time.Now().AddDate(0, 0, -10).Unix()
+
+	history, backfillErr := QueryBackfill(context.Background(), dynamoSvc, BackfillQueryArgs{
+		UserMediaDateKey: user_media.UserMediaDateKey{Key: key},
+		StartDate:        &startDate,
+		EndDate:          &endDate,
+	})
+	assert.NoError(t, backfillErr)
+	assert.Equal(t, map[user_media.UserMediaKey]user_media.UserMediaEntry{key: mediaEntries[key]}, history.MediaEntries)
+
+	expectedStats := map[user_media.UserMediaDateKey]user_media.UserMediaStat{}
+	for dateKey, mediaStat := range mediaStats {
+		if dateKey.Key == key && dateKey.DateTime >= startDate && dateKey.DateTime <= endDate {
+			expectedStats[dateKey] = mediaStat
+		}
+	}
+	assert.NotEmpty(t, expectedStats)
+	assert.Equal(t, expectedStats, history.MediaStats)
+
+	// Without dates every one of the title's stats is read
+	history, backfillErr = QueryBackfill(context.Background(), dynamoSvc, BackfillQueryArgs{
+		UserMediaDateKey: user_media.UserMediaDateKey{Key: key},
+	})
+	assert.NoError(t, backfillErr)
+	expectedStats = map[user_media.UserMediaDateKey]user_media.UserMediaStat{}
+	for dateKey, mediaStat := range mediaStats {
+		if dateKey.Key == key {
+			expectedStats[dateKey] = mediaStat
+		}
+	}
+	assert.Equal(t, expectedStats, history.MediaStats)
+
+	// Only stats changed since the time given are read, the entry always is
+	history, backfillErr = QueryBackfill(context.Background(), dynamoSvc, BackfillQueryArgs{
+		UserMediaDateKey: user_media.UserMediaDateKey{Key: key, DateTime: time.Now().Add(time.Hour).Unix()},
+	})
+	assert.NoError(t, backfillErr)
+	assert.Empty(t, history.MediaStats)
+	assert.Len(t, history.MediaEntries, 1)
+
+	_, backfillErr = QueryBackfill(context.Background(), dynamoSvc, BackfillQueryArgs{
+		UserMediaDateKey: user_media.UserMediaDateKey{Key: key},
+		StartDate:        &endDate,
+		EndDate:          &startDate,
+	})
+	assert.Error(t, backfillErr)
+}
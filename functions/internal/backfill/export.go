@@ -0,0 +1,451 @@
+package backfill
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/settings"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/KamWithK/exSTATic-backend/internal/user_media"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+var ErrUnknownFormat = errors.New("unknown export format")
+
+// Links to uploaded exports stop working after this long, the bucket removing the exports themselves a day later
+const ExportLinkLifetime = 15 * time.Minute
+
+var exportContentTypes = map[string]string{
+	FormatCSV:    "text/csv; charset=utf-8",
+	FormatNDJSON: "application/x-ndjson",
+}
+
+var exportHeader = []string{"date", "media_type", "media_identifier", "display_name", "series", "time_read", "chars_read", "lines_read"}
+
+// Every media type is exported when none are given
+type ExportArgs struct {
+	Username   string   `json:"username" binding:"required"`
+	MediaTypes []string `json:"media_types"`
+	Format     string   `json:"format" binding:"required"`
+}
+
+// A single line of an export
+// Media entries without any stats are exported with a nil date
+type ExportRow struct {
+	Date            *int64 `json:"date"`
+	MediaType       string `json:"media_type"`
+	MediaIdentifier string `json:"media_identifier"`
+	DisplayName     string `json:"display_name"`
+	Series          string `json:"series"`
+	TimeRead        int64  `json:"time_read"`
+	CharsRead       int64  `json:"chars_read"`
+	LinesRead       int64  `json:"lines_read"`
+}
+
+// Where an uploaded export can be downloaded from until the link expires
+type ExportLink struct {
+	URL       string `json:"url"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type RowWriter interface {
+	Write(row ExportRow) error
+	Flush() error
+}
+
+type csvRowWriter struct {
+	writer        *csv.Writer
+	headerWritten bool
+}
+
+type ndjsonRowWriter struct {
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func ValidateExportArgs(ctx context.Context, args ExportArgs) error {
+	if len(args.Username) == 0 {
+		err := errors.New("invalid username")
+		log.Ctx(ctx).Info().Err(err).Send()
+		return err
+	}
+
+	if args.Format != FormatCSV && args.Format != FormatNDJSON {
+		log.Ctx(ctx).Info().Err(ErrUnknownFormat).Str("format", args.Format).Send()
+		return ErrUnknownFormat
+	}
+
+	return nil
+}
+
+func NewRowWriter(format string, writer io.Writer) (RowWriter, error) {
+	switch format {
+	case FormatCSV:
+		return &csvRowWriter{writer: csv.NewWriter(writer)}, nil
+	case FormatNDJSON:
+		bufferedWriter := bufio.NewWriter(writer)
+		return &ndjsonRowWriter{writer: bufferedWriter, encoder: json.NewEncoder(bufferedWriter)}, nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+func (csvWriter *csvRowWriter) Write(row ExportRow) error {
+	if !csvWriter.headerWritten {
+		if err := csvWriter.writer.Write(exportHeader); err != nil {
+			return err
+		}
+		csvWriter.headerWritten = true
+	}
+
+	date := ""
+	if row.Date != nil {
+		date = strconv.FormatInt(*row.Date, 10)
+	}
+
+	return csvWriter.writer.Write([]string{
+		date,
+		row.MediaType,
+		row.MediaIdentifier,
+		row.DisplayName,
+		row.Series,
+		strconv.FormatInt(row.TimeRead, 10),
+		strconv.FormatInt(row.CharsRead, 10),
+		strconv.FormatInt(row.LinesRead, 10),
+	})
+}
+
+func (csvWriter *csvRowWriter) Flush() error {
+	// Empty exports still get a header so they can be imported again
+	if !csvWriter.headerWritten {
+		if err := csvWriter.writer.Write(exportHeader); err != nil {
+			return err
+		}
+		csvWriter.headerWritten = true
+	}
+
+	csvWriter.writer.Flush()
+	return csvWriter.writer.Error()
+}
+
+func (ndjsonWriter *ndjsonRowWriter) Write(row ExportRow) error {
+	return ndjsonWriter.encoder.Encode(row)
+}
+
+func (ndjsonWriter *ndjsonRowWriter) Flush() error {
+	return ndjsonWriter.writer.Flush()
+}
+
+func queryUserMedia(ctx context.Context, svc storage.Storage, key user_media.UserMediaKey, callback func(key user_media.UserMediaKey, date *int64, item map[string]*dynamodb.AttributeValue) error) error {
+	query := dynamo_wrapper.NewQuery(svc.Config().Tables.Media).Partition("pk", user_media.UserMediaPK(key))
+
+	return query.Each(ctx, svc, func(item map[string]*dynamodb.AttributeValue) error {
+		pk, sk := *item["pk"].S, *item["sk"].S
+		itemKey, date, splitErr := user_media.SplitUserMediaCompositeKey(pk, sk)
+
+		if splitErr != nil {
+			log.Ctx(ctx).Error().Err(splitErr).Str("pk", pk).Str("sk", sk).Interface("item", item).Msg("Could not split keys")
+			return nil
+		} else if user_media.IsTombstone(item) {
+			return nil
+		}
+
+		return callback(*itemKey, date, item)
+	})
+}
+
+// Streams every media entry and stat of a user to the writer, across every media type unless told which
+// Stats are written as each page is read, only the entries of one media type being held in memory at a time
+func ExportHistory(ctx context.Context, svc storage.Storage, args ExportArgs, writer io.Writer) error {
+	if validationErr := ValidateExportArgs(ctx, args); validationErr != nil {
+		return validationErr
+	}
+
+	rowWriter, writerErr := NewRowWriter(args.Format, writer)
+	if writerErr != nil {
+		return writerErr
+	}
+
+	mediaTypes := args.MediaTypes
+	if len(mediaTypes) == 0 {
+		mediaTypes = settings.MediaTypes
+	}
+
+	for _, mediaType := range mediaTypes {
+		key := user_media.UserMediaKey{
+			Username:  args.Username,
+			MediaType: mediaType,
+		}
+
+		// Stats usually sort before their entry, whose names are then looked up directly
+		mediaEntries := map[string]user_media.UserMediaEntry{}
+		lookedUp := map[string]bool{}
+		exportedEntries := map[string]bool{}
+		queryErr := queryUserMedia(ctx, svc, key, func(key user_media.UserMediaKey, date *int64, item map[string]*dynamodb.AttributeValue) error {
+			if date == nil {
+				mediaEntry := user_media.UserMediaEntry{}
+				if unmarshalErr := dynamodbattribute.UnmarshalMap(item, &mediaEntry); unmarshalErr != nil {
+					log.Ctx(ctx).Error().Interface("key", key).Interface("item", item).Err(unmarshalErr).Msg("Could not unmarshal item into UserMediaEntry")
+					return nil
+				}
+				mediaEntries[key.MediaIdentifier] = mediaEntry
+				return nil
+			}
+
+			mediaStat := user_media.UserMediaStat{}
+			if unmarshalErr := dynamodbattribute.UnmarshalMap(item, &mediaStat); unmarshalErr != nil {
+				log.Ctx(ctx).Error().Interface("key", key).Interface("item", item).Err(unmarshalErr).Msg("Could not unmarshal item into UserMediaStat")
+				return nil
+			}
+
+			if _, found := mediaEntries[key.MediaIdentifier]; !found && !lookedUp[key.MediaIdentifier] {
+				lookedUp[key.MediaIdentifier] = true
+				mediaEntry, getErr := user_media.GetMediaInfo(ctx, svc, key)
+				if getErr == nil {
+					mediaEntries[key.MediaIdentifier] = *mediaEntry
+				} else if !errors.Is(getErr, user_media.ErrMediaNotFound) {
+					return getErr
+				}
+			}
+
+			mediaEntry := mediaEntries[key.MediaIdentifier]
+			exportedEntries[key.MediaIdentifier] = true
+
+			return rowWriter.Write(ExportRow{
+				Date:            date,
+				MediaType:       key.MediaType,
+				MediaIdentifier: key.MediaIdentifier,
+				DisplayName:     mediaEntry.DisplayName,
+				Series:          mediaEntry.Series,
+				TimeRead:        mediaStat.Stats.TimeRead,
+				CharsRead:       mediaStat.Stats.CharsRead,
+				LinesRead:       mediaStat.Stats.LinesRead,
+			})
+		})
+		if queryErr != nil {
+			return queryErr
+		}
+
+		// Media which was never read still needs to be exported
+		identifiers := []string{}
+		for identifier := range mediaEntries {
+			if !exportedEntries[identifier] {
+				identifiers = append(identifiers, identifier)
+			}
+		}
+		sort.Strings(identifiers)
+
+		for _, identifier := range identifiers {
+			mediaEntry := mediaEntries[identifier]
+
+			rowErr := rowWriter.Write(ExportRow{
+				MediaType:       mediaType,
+				MediaIdentifier: identifier,
+				DisplayName:     mediaEntry.DisplayName,
+				Series:          mediaEntry.Series,
+			})
+			if rowErr != nil {
+				return rowErr
+			}
+		}
+	}
+
+	return rowWriter.Flush()
+}
+
+// Streams the export into the bucket as it's read, so neither memory nor response size limits how much can be exported
+// The link returned downloads it as a file named after its format
+func UploadExport(ctx context.Context, svc storage.Storage, s3Svc s3iface.S3API, bucket string, args ExportArgs) (*ExportLink, error) {
+	if validationErr := ValidateExportArgs(ctx, args); validationErr != nil {
+		return nil, validationErr
+	}
+
+	timeNow := time.Now()
+	objectKey := fmt.Sprintf("%s/%d.%s", args.Username, timeNow.UnixNano(), args.Format)
+
+	reader, writer := io.Pipe()
+	exported := make(chan error, 1)
+	go func() {
+		exportErr := ExportHistory(ctx, svc, args, writer)
+		writer.CloseWithError(exportErr)
+		exported <- exportErr
+	}()
+
+	_, uploadErr := s3manager.NewUploaderWithClient(s3Svc).UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:             aws.String(bucket),
+		Key:                aws.String(objectKey),
+		Body:               reader,
+		ContentType:        aws.String(exportContentTypes[args.Format]),
+		ContentDisposition: aws.String(fmt.Sprintf("attachment; filename=\"exstatic_history.%s\"", args.Format)),
+	})
+	// Stops the export writing when the upload gave up part way
+	reader.CloseWithError(uploadErr)
+
+	// Failures reading the history surface through the upload too, so are reported first as the cause
+	if exportErr := <-exported; exportErr != nil {
+		return nil, exportErr
+	}
+	if uploadErr != nil {
+		log.Ctx(ctx).Error().Err(uploadErr).Str("bucket", bucket).Str("object", objectKey).Msg("Could not upload export")
+		return nil, uploadErr
+	}
+
+	request, _ := s3Svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objectKey),
+	})
+	link, presignErr := request.Presign(ExportLinkLifetime)
+	if presignErr != nil {
+		log.Ctx(ctx).Error().Err(presignErr).Str("bucket", bucket).Str("object", objectKey).Msg("Could not presign export link")
+		return nil, presignErr
+	}
+
+	log.Ctx(ctx).Info().Str("bucket", bucket).Str("object", objectKey).Msg("Uploaded export")
+	return &ExportLink{URL: link, ExpiresAt: timeNow.Add(ExportLinkLifetime).Unix()}, nil
+}
+
+func readCSVRows(reader io.Reader, callback func(row ExportRow) error) error {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = len(exportHeader)
+
+	header, headerErr := csvReader.Read()
+	if headerErr != nil {
+		return headerErr
+	}
+	for i := range exportHeader {
+		if header[i] != exportHeader[i] {
+			return errors.New("invalid csv header")
+		}
+	}
+
+	for {
+		record, readErr := csvReader.Read()
+		if readErr == io.EOF {
+			return nil
+		} else if readErr != nil {
+			return readErr
+		}
+
+		row := ExportRow{
+			MediaType:       record[1],
+			MediaIdentifier: record[2],
+			DisplayName:     record[3],
+			Series:          record[4],
+		}
+
+		if record[0] != "" {
+			date, parseErr := strconv.ParseInt(record[0], 10, 64)
+			if parseErr != nil {
+				return parseErr
+			}
+			row.Date = &date
+		}
+
+		numbers := []*int64{&row.TimeRead, &row.CharsRead, &row.LinesRead}
+		for i, number := range numbers {
+			value, parseErr := strconv.ParseInt(record[5+i], 10, 64)
+			if parseErr != nil {
+				return parseErr
+			}
+			*number = value
+		}
+
+		if callbackErr := callback(row); callbackErr != nil {
+			return callbackErr
+		}
+	}
+}
+
+func readNDJSONRows(reader io.Reader, callback func(row ExportRow) error) error {
+	decoder := json.NewDecoder(reader)
+
+	for {
+		row := ExportRow{}
+		if decodeErr := decoder.Decode(&row); decodeErr == io.EOF {
+			return nil
+		} else if decodeErr != nil {
+			return decodeErr
+		}
+
+		if callbackErr := callback(row); callbackErr != nil {
+			return callbackErr
+		}
+	}
+}
+
+// Converts an export back into backfill arguments, which can then be written with PutBackfill
+func ImportHistory(ctx context.Context, username string, format string, reader io.Reader, lastUpdate int64) (*BackfillArgs, error) {
+	history := BackfillArgs{
+		Username:     username,
+		MediaEntries: map[user_media.UserMediaKey]user_media.UserMediaEntry{},
+		MediaStats:   map[user_media.UserMediaDateKey]user_media.UserMediaStat{},
+	}
+
+	addRow := func(row ExportRow) error {
+		key := user_media.UserMediaKey{
+			Username:        username,
+			MediaType:       row.MediaType,
+			MediaIdentifier: row.MediaIdentifier,
+		}
+
+		history.MediaEntries[key] = user_media.UserMediaEntry{
+			DisplayName: row.DisplayName,
+			Series:      row.Series,
+			LastUpdate:  lastUpdate,
+		}
+
+		if row.Date != nil {
+			dateKey := user_media.UserMediaDateKey{
+				Key:      key,
+				DateTime: *row.Date,
+			}
+			history.MediaStats[dateKey] = user_media.UserMediaStat{
+				Stats: user_media.MediaStat{
+					TimeRead:  row.TimeRead,
+					CharsRead: row.CharsRead,
+					LinesRead: row.LinesRead,
+				},
+				LastUpdate: lastUpdate,
+			}
+		}
+
+		return nil
+	}
+
+	var readErr error
+	switch format {
+	case FormatCSV:
+		readErr = readCSVRows(reader, addRow)
+	case FormatNDJSON:
+		readErr = readNDJSONRows(reader, addRow)
+	default:
+		readErr = ErrUnknownFormat
+	}
+
+	if readErr != nil {
+		log.Ctx(ctx).Info().Err(readErr).Str("format", format).Msg("Could not read export")
+		return nil, readErr
+	}
+
+	return &history, nil
+}
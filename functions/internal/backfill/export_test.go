@@ -0,0 +1,123 @@
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/user_media"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jaswdr/faker"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/maps"
+)
+
+func randomHistory(fake faker.Faker, user string) BackfillArgs {
+	mediaEntries := user_media.RandomMediaEntries(fake, user, 20)
+	mediaStats := map[user_media.UserMediaDateKey]user_media.UserMediaStat{}
+
+	for key := range mediaEntries {
+		maps.Copy(mediaStats, user_media.RandomMediaStats(fake, key, 30, 0.5))
+	}
+
+	return BackfillArgs{
+		Username:     user,
+		MediaEntries: mediaEntries,
+		MediaStats:   mediaStats,
+	}
+}
+
+// Writes the history then exports every media type back out in the given format
+func exportHistory(t *testing.T, format string, history BackfillArgs) *bytes.Buffer {
+	batchwriterArgs, err := PutBackfill(context.Background(), dynamoSvc.Config(), history)
+	assert.NoError(t, err)
+
+	output, writeErr := dynamo_wrapper.DistributedBatchWrites(context.Background(), dynamoSvc, batchwriterArgs)
+	assert.NoError(t, writeErr)
+	assert.True(t, output.Complete())
+
+	buffer := &bytes.Buffer{}
+	assert.NoError(t, ExportHistory(context.Background(), dynamoSvc, ExportArgs{
+		Username: history.Username,
+		Format:   format,
+	}, buffer))
+	return buffer
+}
+
+// Captures what's uploaded instead of sending it anywhere
+func capturingS3(uploaded *bytes.Buffer, input **http.Request) *s3.S3 {
+	s3Svc := s3.New(session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})))
+	s3Svc.Handlers.Send.Clear()
+	s3Svc.Handlers.Send.PushBack(func(r *request.Request) {
+		*input = r.HTTPRequest
+		if _, copyErr := io.Copy(uploaded, r.HTTPRequest.Body); copyErr != nil {
+			r.Error = copyErr
+		}
+		r.HTTPResponse = &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(&bytes.Buffer{})}
+	})
+	return s3Svc
+}
+
+func TestUnknownFormat(t *testing.T) {
+	_, writerErr := NewRowWriter("xml", &bytes.Buffer{})
+	assert.ErrorIs(t, writerErr, ErrUnknownFormat)
+
+	_, importErr := ImportHistory(context.Background(), "username", "xml", &bytes.Buffer{}, 0)
+	assert.ErrorIs(t, importErr, ErrUnknownFormat)
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	fake := faker.New()
+
+	for _, format := range []string{FormatCSV, FormatNDJSON} {
+		// The whole history is compared, so it can't share a user with another test
+		user := fake.Person().Name() + " " + fake.UUID().V4()
+		history := randomHistory(fake, user)
+
+		imported, err := ImportHistory(context.Background(), user, format, exportHistory(t, format, history), 0)
+		assert.NoError(t, err)
+		assert.Equal(t, history.MediaEntries, imported.MediaEntries, format)
+		assert.Equal(t, history.MediaStats, imported.MediaStats, format)
+
+		results, putErr := PutBackfill(context.Background(), dynamoSvc.Config(), *imported)
+		assert.NoError(t, putErr)
+		assert.Len(t, results.WriteRequests, len(history.MediaEntries)+len(history.MediaStats))
+	}
+}
+
+func TestUploadExport(t *testing.T) {
+	fake := faker.New()
+	user := fake.Person().Name() + " " + fake.UUID().V4()
+	history := randomHistory(fake, user)
+	exported := exportHistory(t, FormatCSV, history)
+
+	uploaded, input := &bytes.Buffer{}, (*http.Request)(nil)
+	link, uploadErr := UploadExport(context.Background(), dynamoSvc, capturingS3(uploaded, &input), "exports", ExportArgs{
+		Username:   user,
+		MediaTypes: []string{"vn"},
+		Format:     FormatCSV,
+	})
+	assert.NoError(t, uploadErr)
+	assert.Equal(t, exported.String(), uploaded.String())
+	assert.Equal(t, "text/csv; charset=utf-8", input.Header.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="exstatic_history.csv"`, input.Header.Get("Content-Disposition"))
+
+	// The link reads back the object which was uploaded
+	assert.Contains(t, link.URL, input.URL.EscapedPath())
+	assert.Contains(t, link.URL, "X-Amz-Signature")
+	assert.Greater(t, link.ExpiresAt, time.Now().Unix())
+
+	_, formatErr := UploadExport(context.Background(), dynamoSvc, capturingS3(uploaded, &input), "exports", ExportArgs{Username: user, Format: "xml"})
+	assert.ErrorIs(t, formatErr, ErrUnknownFormat)
+}
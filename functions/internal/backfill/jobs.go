@@ -0,0 +1,221 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/KamWithK/exSTATic-backend/internal/device_sync"
+	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
+)
+
+type JobState string
+
+const (
+	JobPending  JobState = "pending"
+	JobWriting  JobState = "writing"
+	JobRetrying JobState = "retrying"
+	JobDone     JobState = "done"
+	JobFailed   JobState = "failed"
+)
+
+const MaxJobAttempts = 10
+const JobRetention = 7 * 24 * time.Hour
+
+var ErrJobNotFound = fmt.Errorf("backfill job %w", dynamo_wrapper.ErrNotFound)
+
+type BackfillJobKey struct {
+	Username string `json:"username" binding:"required"`
+	JobID    string `json:"job_id" binding:"required"`
+}
+
+type BackfillJob struct {
+	Key              BackfillJobKey `json:"key" binding:"required"`
+	State            JobState       `json:"state"`
+	TotalItems       int            `json:"total_items"`
+	WrittenItems     int            `json:"written_items"`
+	UnprocessedItems int            `json:"unprocessed_items"`
+	FailedItems      int            `json:"failed_items"`
+	Attempts         int            `json:"attempts"`
+	Error            string         `json:"error"`
+	CreatedAt        int64          `json:"created_at"`
+	LastUpdate       int64          `json:"last_update"`
+	ExpiresAt        int64          `json:"expires_at"`
+}
+
+// State passed between iterations of the backfill state machine
+type BackfillJobArgs struct {
+	JobKey     BackfillJobKey                 `json:"job_key" binding:"required"`
+	Batchwrite *dynamo_wrapper.BatchwriteArgs `json:"batchwrite"`
+	Done       bool                           `json:"done"`
+}
+
+func jobsRepository(ctx context.Context, svc storage.Storage) *dynamo_wrapper.Repository[BackfillJobKey, BackfillJob] {
+	return dynamo_wrapper.NewRepository[BackfillJobKey, BackfillJob](svc, svc.Config().Tables.Jobs, dynamo_wrapper.MarshalKey[BackfillJobKey])
+}
+
+func GetJob(ctx context.Context, svc storage.Storage, key BackfillJobKey) (*BackfillJob, error) {
+	job, getErr := jobsRepository(ctx, svc).Get(ctx, key)
+	if errors.Is(getErr, dynamo_wrapper.ErrNotFound) {
+		return nil, ErrJobNotFound
+	} else if getErr != nil {
+		return nil, getErr
+	}
+	job.Key = key
+
+	return job, nil
+}
+
+// Jobs are always written whole since counters can legitimately drop back to zero
+func putJob(ctx context.Context, svc storage.Storage, job *BackfillJob) error {
+	job.LastUpdate = time.Now().Unix()
+
+	return jobsRepository(ctx, svc).Put(ctx, job.Key, *job)
+}
+
+// Records a new job and prepares the first round of writes
+// Invalid uploads are still recorded (as failed) so clients polling the job learn why
+func StartBackfillJob(ctx context.Context, svc storage.Storage, jobID string, history BackfillArgs) (*BackfillJobArgs, error) {
+	timeNow := time.Now()
+	job := BackfillJob{
+		Key: BackfillJobKey{
+			Username: history.Username,
+			JobID:    jobID,
+		},
+		State:     JobPending,
+		CreatedAt: timeNow.Unix(),
+		ExpiresAt: timeNow.Add(JobRetention).Unix(),
+	}
+
+	if len(jobID) == 0 {
+		err := errors.New("invalid job id")
+		log.Ctx(ctx).Info().Err(err).Send()
+		return nil, err
+	}
+
+	if tombstoneErr := LoadTombstones(ctx, svc, &history); tombstoneErr != nil {
+		return nil, tombstoneErr
+	}
+
+	batchwriteArgs, backfillErr := PutBackfill(ctx, svc.Config(), history)
+	if backfillErr != nil {
+		job.State = JobFailed
+		job.Error = backfillErr.Error()
+
+		if len(history.Username) > 0 {
+			if putErr := putJob(ctx, svc, &job); putErr != nil {
+				return nil, putErr
+			}
+		}
+
+		return nil, backfillErr
+	}
+
+	job.TotalItems = len(batchwriteArgs.WriteRequests)
+	job.UnprocessedItems = job.TotalItems
+	if putErr := putJob(ctx, svc, &job); putErr != nil {
+		return nil, putErr
+	}
+
+	return &BackfillJobArgs{
+		JobKey:     job.Key,
+		Batchwrite: batchwriteArgs,
+	}, nil
+}
+
+// Performs one round of batch writes for a job, recording progress as it goes
+// Writing stops in time for the context's deadline, with the remaining writes returned
+// Done is set once nothing is left or the job has failed
+func WriteBackfillJob(ctx context.Context, svc storage.Storage, args BackfillJobArgs) (*BackfillJobArgs, error) {
+	job, getErr := GetJob(ctx, svc, args.JobKey)
+	if getErr != nil {
+		return nil, getErr
+	}
+
+	if job.State == JobDone || job.State == JobFailed || args.Batchwrite == nil {
+		return &BackfillJobArgs{JobKey: args.JobKey, Done: true}, nil
+	}
+
+	job.Attempts++
+	if job.Attempts == 1 {
+		job.State = JobWriting
+	} else {
+		job.State = JobRetrying
+	}
+	if putErr := putJob(ctx, svc, job); putErr != nil {
+		return nil, putErr
+	}
+
+	// Aborted writes fail the step so it's retried, rather than using up the job's attempts
+	result, writeErr := dynamo_wrapper.DistributedBatchWrites(ctx, svc, args.Batchwrite)
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	written := result.Succeeded
+	remainingWrites := result.UnprocessedWrites()
+
+	// Items devices can't hear about yet are written again next round rather than counted as done
+	if recordErr := recordWrittenItems(ctx, svc, args.JobKey.Username, written); recordErr != nil {
+		log.Ctx(ctx).Info().Err(recordErr).Interface("job_key", args.JobKey).Int("written", len(written)).Msg("Written items will be retried")
+		remainingWrites = append(remainingWrites, written...)
+		written = nil
+	}
+	remaining := len(remainingWrites)
+
+	// Poison items are set aside rather than holding up the rest of the job
+	if deadLetterErr := dynamo_wrapper.PutDeadLetters(ctx, svc, result); deadLetterErr != nil {
+		return nil, deadLetterErr
+	}
+
+	job.WrittenItems += len(written)
+	job.FailedItems += len(result.Failed)
+	job.UnprocessedItems = remaining
+
+	nextArgs := BackfillJobArgs{
+		JobKey: args.JobKey,
+		Batchwrite: &dynamo_wrapper.BatchwriteArgs{
+			TableName:     args.Batchwrite.TableName,
+			WriteRequests: remainingWrites,
+			MaxBatchSize:  args.Batchwrite.MaxBatchSize,
+			Concurrency:   args.Batchwrite.Concurrency,
+		},
+	}
+
+	if remaining == 0 {
+		job.State = JobDone
+		if job.FailedItems > 0 {
+			job.Error = strconv.Itoa(job.FailedItems) + " items could not be written"
+		}
+		nextArgs.Batchwrite = nil
+		nextArgs.Done = true
+	} else if job.Attempts >= MaxJobAttempts {
+		job.State = JobFailed
+		job.Error = "unprocessed items remain after maximum attempts"
+		nextArgs.Done = true
+	}
+
+	if putErr := putJob(ctx, svc, job); putErr != nil {
+		return nil, putErr
+	}
+
+	log.Ctx(ctx).Info().Interface("job", job).Msg("Backfill job progressed")
+
+	return &nextArgs, nil
+}
+
+// Adds everything which made it into the media table to the user's change log
+// Recording a change twice is harmless, so items are simply written and recorded again after a failure
+func recordWrittenItems(ctx context.Context, svc storage.Storage, username string, written []*dynamodb.WriteRequest) error {
+	writtenKeys := []map[string]*dynamodb.AttributeValue{}
+	for _, writeRequest := range written {
+		item := writeRequest.PutRequest.Item
+		writtenKeys = append(writtenKeys, map[string]*dynamodb.AttributeValue{"pk": item["pk"], "sk": item["sk"]})
+	}
+
+	return device_sync.RecordChanges(ctx, svc, username, writtenKeys)
+}
@@ -0,0 +1,56 @@
+package backfill
+
+import (
+	"context"
+	"testing"
+
+	"github.com/KamWithK/exSTATic-backend/internal/user_media"
+	"github.com/jaswdr/faker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvalidJob(t *testing.T) {
+	fake := faker.New()
+	user := fake.Person().Name()
+	jobID := fake.UUID().V4()
+
+	jobArgs, err := StartBackfillJob(context.Background(), dynamoSvc, jobID, BackfillArgs{Username: user})
+	assert.Nil(t, jobArgs)
+	assert.Error(t, err)
+
+	job, getErr := GetJob(context.Background(), dynamoSvc, BackfillJobKey{Username: user, JobID: jobID})
+	assert.NoError(t, getErr)
+	assert.Equal(t, JobFailed, job.State)
+}
+
+func TestJobProgress(t *testing.T) {
+	fake := faker.New()
+	user := fake.Person().Name()
+	jobID := fake.UUID().V4()
+	// Random identifiers can collide, so count what was actually generated
+	mediaEntries := user_media.RandomMediaEntries(fake, user, 60)
+	numEntries := len(mediaEntries)
+
+	jobArgs, err := StartBackfillJob(context.Background(), dynamoSvc, jobID, BackfillArgs{
+		Username:     user,
+		MediaEntries: mediaEntries,
+	})
+	assert.NoError(t, err)
+	assert.False(t, jobArgs.Done)
+
+	job, getErr := GetJob(context.Background(), dynamoSvc, jobArgs.JobKey)
+	assert.NoError(t, getErr)
+	assert.Equal(t, JobPending, job.State)
+	assert.Equal(t, numEntries, job.TotalItems)
+
+	for !jobArgs.Done {
+		jobArgs, err = WriteBackfillJob(context.Background(), dynamoSvc, *jobArgs)
+		assert.NoError(t, err)
+	}
+
+	job, getErr = GetJob(context.Background(), dynamoSvc, jobArgs.JobKey)
+	assert.NoError(t, getErr)
+	assert.Equal(t, JobDone, job.State)
+	assert.Equal(t, numEntries, job.WrittenItems)
+	assert.Zero(t, job.UnprocessedItems)
+}
@@ -0,0 +1,62 @@
+package backfill
+
+import (
+	"context"
+	"time"
+
+	"github.com/KamWithK/exSTATic-backend/internal/device_sync"
+	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/KamWithK/exSTATic-backend/internal/user_media"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+type SyncArgs struct {
+	Key       device_sync.DeviceKey `json:"key" binding:"required"`
+	Watermark int64                 `json:"watermark"`
+}
+
+// Everything changed since the device's watermark, to be applied before storing the new watermark
+// More is set when the changes were cut short and the device should sync again straight away
+type SyncResult struct {
+	Changes   *BackfillArgs `json:"changes"`
+	Watermark int64         `json:"watermark"`
+	More      bool          `json:"more"`
+}
+
+func GetSync(ctx context.Context, svc storage.Storage, args SyncArgs) (*SyncResult, error) {
+	changeRecords, device, syncErr := device_sync.SyncDevice(ctx, svc, args.Key, args.Watermark)
+	if syncErr != nil {
+		return nil, syncErr
+	}
+
+	// Changes are applied in order so only the latest state of each item remains
+	changes := NewBackfillArgs(args.Key.Username)
+	for _, changeRecord := range changeRecords {
+		item := changeRecord.Item
+		if item == nil {
+			expired, tombstoneErr := expiredTombstone(changeRecord)
+			if tombstoneErr != nil {
+				return nil, tombstoneErr
+			}
+			item = expired
+		}
+		changes.AddItem(ctx, item)
+	}
+
+	return &SyncResult{
+		Changes:   changes,
+		Watermark: device.Watermark,
+		More:      device.Watermark-args.Watermark == device_sync.MaxChangesPerSync,
+	}, nil
+}
+
+// Items are only ever missing once their tombstone has expired, so they're still sent to the device as deleted
+func expiredTombstone(changeRecord device_sync.ChangeRecord) (map[string]*dynamodb.AttributeValue, error) {
+	tombstone, marshalErr := dynamodbattribute.MarshalMap(user_media.NewTombstone(time.Unix(changeRecord.CreatedAt, 0)))
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+	return dynamo_wrapper.CombineAttributes(changeRecord.Key, tombstone), nil
+}
@@ -0,0 +1,156 @@
+package backfill
+
+import (
+	"context"
+	"testing"
+
+	"github.com/KamWithK/exSTATic-backend/internal/device_sync"
+	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/KamWithK/exSTATic-backend/internal/user_media"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/jaswdr/faker"
+	"github.com/stretchr/testify/assert"
+)
+
+// Fails the first transactions, which is where every change is recorded
+type failingTransactions struct {
+	storage.Storage
+	failures int
+}
+
+func (failing *failingTransactions) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	if failing.failures > 0 {
+		failing.failures--
+		return nil, awserr.New(dynamodb.ErrCodeInternalServerError, "internal server error", nil)
+	}
+	return failing.Storage.TransactWriteItemsWithContext(ctx, input, opts...)
+}
+
+func TestDeviceSync(t *testing.T) {
+	fake := faker.New()
+	user := fake.Person().Name()
+	deviceKey := device_sync.DeviceKey{Username: user, DeviceID: fake.UUID().V4()}
+
+	device, registerErr := device_sync.RegisterDevice(context.Background(), dynamoSvc, deviceKey)
+	assert.NoError(t, registerErr)
+
+	key := user_media.RandomVNKey(fake, user)
+	putErr := user_media.PutMediaInfo(context.Background(), dynamoSvc, key, user_media.UserMediaEntry{DisplayName: "name"}, 1)
+	assert.NoError(t, putErr)
+
+	result, syncErr := GetSync(context.Background(), dynamoSvc, SyncArgs{Key: deviceKey, Watermark: device.Watermark})
+	assert.NoError(t, syncErr)
+	assert.Equal(t, device.Watermark+1, result.Watermark)
+	assert.Equal(t, "name", result.Changes.MediaEntries[key].DisplayName)
+
+	deleteErr := user_media.DeleteMediaInfo(context.Background(), dynamoSvc, key)
+	assert.NoError(t, deleteErr)
+
+	result, syncErr = GetSync(context.Background(), dynamoSvc, SyncArgs{Key: deviceKey, Watermark: result.Watermark})
+	assert.NoError(t, syncErr)
+	assert.NotContains(t, result.Changes.MediaEntries, key)
+	assert.Contains(t, result.Changes.EntryTombstones, key)
+
+	result, syncErr = GetSync(context.Background(), dynamoSvc, SyncArgs{Key: deviceKey, Watermark: result.Watermark})
+	assert.NoError(t, syncErr)
+	assert.Empty(t, result.Changes.MediaEntries)
+	assert.Empty(t, result.Changes.EntryTombstones)
+
+	_, syncErr = GetSync(context.Background(), dynamoSvc, SyncArgs{Key: deviceKey, Watermark: result.Watermark + 1})
+	assert.ErrorIs(t, syncErr, device_sync.ErrInvalidWatermark)
+}
+
+func TestExpiredTombstoneSync(t *testing.T) {
+	fake := faker.New()
+	user := fake.Person().Name()
+	deviceKey := device_sync.DeviceKey{Username: user, DeviceID: fake.UUID().V4()}
+
+	device, registerErr := device_sync.RegisterDevice(context.Background(), dynamoSvc, deviceKey)
+	assert.NoError(t, registerErr)
+
+	key := user_media.RandomVNKey(fake, user)
+	putErr := user_media.PutMediaInfo(context.Background(), dynamoSvc, key, user_media.UserMediaEntry{DisplayName: "name"}, 1)
+	assert.NoError(t, putErr)
+	deleteErr := user_media.DeleteMediaInfo(context.Background(), dynamoSvc, key)
+	assert.NoError(t, deleteErr)
+
+	// Dynamodb's TTL removes the tombstone while its changes are still kept
+	tableKey, keyErr := dynamo_wrapper.GetCompositeKey(context.Background(), user_media.UserMediaPK(key), user_media.MediaInfoSK(key))
+	assert.NoError(t, keyErr)
+	_, expireErr := dynamoSvc.DeleteItemWithContext(context.Background(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(dynamoSvc.Config().Tables.Media),
+		Key:       tableKey,
+	})
+	assert.NoError(t, expireErr)
+
+	result, syncErr := GetSync(context.Background(), dynamoSvc, SyncArgs{Key: deviceKey, Watermark: device.Watermark})
+	assert.NoError(t, syncErr)
+	assert.NotContains(t, result.Changes.MediaEntries, key)
+	assert.Contains(t, result.Changes.EntryTombstones, key)
+}
+
+func TestFailedChangeRecord(t *testing.T) {
+	fake := faker.New()
+	user := fake.Person().Name()
+	deviceKey := device_sync.DeviceKey{Username: user, DeviceID: fake.UUID().V4()}
+	svc := &failingTransactions{Storage: dynamoSvc, failures: 1}
+
+	device, registerErr := device_sync.RegisterDevice(context.Background(), svc, deviceKey)
+	assert.NoError(t, registerErr)
+
+	// The entry is only written along with its change
+	key := user_media.RandomVNKey(fake, user)
+	putErr := user_media.PutMediaInfo(context.Background(), svc, key, user_media.UserMediaEntry{DisplayName: "name"}, 1)
+	assert.Error(t, putErr)
+
+	_, getErr := user_media.GetMediaInfo(context.Background(), svc, key)
+	assert.ErrorIs(t, getErr, user_media.ErrMediaNotFound)
+
+	result, syncErr := GetSync(context.Background(), svc, SyncArgs{Key: deviceKey, Watermark: device.Watermark})
+	assert.NoError(t, syncErr)
+	assert.Equal(t, device.Watermark, result.Watermark)
+	assert.Empty(t, result.Changes.MediaEntries)
+}
+
+func TestJobRetriesUnrecordedItems(t *testing.T) {
+	fake := faker.New()
+	user := fake.Person().Name()
+	deviceKey := device_sync.DeviceKey{Username: user, DeviceID: fake.UUID().V4()}
+	svc := &failingTransactions{Storage: dynamoSvc}
+
+	device, registerErr := device_sync.RegisterDevice(context.Background(), svc, deviceKey)
+	assert.NoError(t, registerErr)
+
+	jobArgs, startErr := StartBackfillJob(context.Background(), svc, fake.UUID().V4(), BackfillArgs{
+		Username:     user,
+		MediaEntries: user_media.RandomMediaEntries(fake, user, 20),
+	})
+	assert.NoError(t, startErr)
+	// Random identifiers can collide, and earlier tests may have deleted some, so count what is actually written
+	numItems := len(jobArgs.Batchwrite.WriteRequests)
+
+	// Items are written but their changes can't be recorded, so they're left for the next round
+	svc.failures = 1
+	jobArgs, writeErr := WriteBackfillJob(context.Background(), svc, *jobArgs)
+	assert.NoError(t, writeErr)
+	assert.False(t, jobArgs.Done)
+	assert.Len(t, jobArgs.Batchwrite.WriteRequests, numItems)
+
+	job, getErr := GetJob(context.Background(), svc, jobArgs.JobKey)
+	assert.NoError(t, getErr)
+	assert.Zero(t, job.WrittenItems)
+	assert.Equal(t, numItems, job.UnprocessedItems)
+
+	for !jobArgs.Done {
+		jobArgs, writeErr = WriteBackfillJob(context.Background(), svc, *jobArgs)
+		assert.NoError(t, writeErr)
+	}
+
+	result, syncErr := GetSync(context.Background(), svc, SyncArgs{Key: deviceKey, Watermark: device.Watermark})
+	assert.NoError(t, syncErr)
+	assert.Len(t, result.Changes.MediaEntries, numItems)
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Dynamodb won't take more than this many writes in one batch
+const maxBatchWriteSize = 25
+
+// The default profile blurs after a minute and settings stop at an hour, so its AFK time has to fit between them
+const (
+	minDefaultMaxAFKTime = 60
+	maxDefaultMaxAFKTime = 3600
+)
+
+type TableNames struct {
+	Settings        string
+	SettingsHistory string
+	Media           string
+	Leaderboard     string
+	Jobs            string
+	Sync            string
+	DeadLetters     string
+}
+
+// Local secondary indexes, which are named per table so never take the prefix
+type IndexNames struct {
+	LastUpdated string
+	TimeRead    string
+	CharsRead   string
+}
+
+// Where data lives and how it's handled, so stages and test runs can each keep to their own tables
+type Config struct {
+	// Empty leaves the SDK to resolve them as usual
+	Endpoint string
+	Region   string
+
+	// Already part of every default name in Tables
+	TablePrefix string
+	Tables      TableNames
+	Indexes     IndexNames
+
+	// Where exports are uploaded to be downloaded from, only the export function needs one
+	ExportBucket string
+
+	MaxBatchSize int
+	MaxAFKTime   int16
+}
+
+// Names matching the data stack, used whenever the environment doesn't say otherwise
+func Defaults() *Config {
+	return &Config{
+		Tables: TableNames{
+			Settings:        "settings",
+			SettingsHistory: "settings_history",
+			Media:           "media",
+			Leaderboard:     "leaderboard",
+			Jobs:            "jobs",
+			Sync:            "sync",
+			DeadLetters:     "dead_letters",
+		},
+		Indexes: IndexNames{
+			LastUpdated: "lastUpdatedIndex",
+			TimeRead:    "timeReadIndex",
+			CharsRead:   "charsReadIndex",
+		},
+		MaxBatchSize: maxBatchWriteSize,
+		MaxAFKTime:   120,
+	}
+}
+
+func setString(lookup func(string) (string, bool), name string, field *string) {
+	if value, ok := lookup(name); ok && value != "" {
+		*field = value
+	}
+}
+
+func setInt(lookup func(string) (string, bool), name string, bitSize int, field func(int64)) error {
+	value, ok := lookup(name)
+	if !ok || value == "" {
+		return nil
+	}
+
+	parsed, parseErr := strconv.ParseInt(value, 10, bitSize)
+	if parseErr != nil {
+		return fmt.Errorf("%s must be a whole number: %w", name, parseErr)
+	}
+	field(parsed)
+	return nil
+}
+
+// Overrides the defaults with whichever variables lookup finds
+func load(lookup func(string) (string, bool)) (*Config, error) {
+	config := Defaults()
+
+	// LOCALSTACK_ENDPOINT came first, so is still honoured
+	setString(lookup, "LOCALSTACK_ENDPOINT", &config.Endpoint)
+	setString(lookup, "DYNAMODB_ENDPOINT", &config.Endpoint)
+	setString(lookup, "AWS_REGION", &config.Region)
+	setString(lookup, "TABLE_PREFIX", &config.TablePrefix)
+
+	tables := []struct {
+		variable string
+		field    *string
+	}{
+		{"SETTINGS_TABLE", &config.Tables.Settings},
+		{"SETTINGS_HISTORY_TABLE", &config.Tables.SettingsHistory},
+		{"MEDIA_TABLE", &config.Tables.Media},
+		{"LEADERBOARD_TABLE", &config.Tables.Leaderboard},
+		{"JOBS_TABLE", &config.Tables.Jobs},
+		{"SYNC_TABLE", &config.Tables.Sync},
+		{"DEAD_LETTERS_TABLE", &config.Tables.DeadLetters},
+	}
+	// Only the default names take the prefix, so overrides name their table exactly
+	for _, table := range tables {
+		*table.field = config.TablePrefix + *table.field
+		setString(lookup, table.variable, table.field)
+	}
+
+	setString(lookup, "LAST_UPDATED_INDEX", &config.Indexes.LastUpdated)
+	setString(lookup, "TIME_READ_INDEX", &config.Indexes.TimeRead)
+	setString(lookup, "CHARS_READ_INDEX", &config.Indexes.CharsRead)
+	setString(lookup, "EXPORT_BUCKET", &config.ExportBucket)
+
+	if intErr := setInt(lookup, "MAX_BATCH_SIZE", 0, func(value int64) { config.MaxBatchSize = int(value) }); intErr != nil {
+		return nil, intErr
+	}
+	if config.MaxBatchSize < 1 || config.MaxBatchSize > maxBatchWriteSize {
+		return nil, fmt.Errorf("MAX_BATCH_SIZE must be between 1 and %d", maxBatchWriteSize)
+	}
+
+	if intErr := setInt(lookup, "DEFAULT_MAX_AFK_TIME", 16, func(value int64) { config.MaxAFKTime = int16(value) }); intErr != nil {
+		return nil, intErr
+	}
+	if config.MaxAFKTime < minDefaultMaxAFKTime || config.MaxAFKTime > maxDefaultMaxAFKTime {
+		return nil, fmt.Errorf("DEFAULT_MAX_AFK_TIME must be between %d and %d", minDefaultMaxAFKTime, maxDefaultMaxAFKTime)
+	}
+
+	return config, nil
+}
+
+// Reads the configuration from environment variables
+func Load() (*Config, error) {
+	return load(os.LookupEnv)
+}
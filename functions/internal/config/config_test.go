@@ -0,0 +1,48 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func lookupFrom(variables map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := variables[name]
+		return value, ok
+	}
+}
+
+func TestLoad(t *testing.T) {
+	config, loadErr := load(lookupFrom(map[string]string{}))
+	assert.NoError(t, loadErr)
+	assert.Equal(t, Defaults(), config)
+
+	config, loadErr = load(lookupFrom(map[string]string{
+		"TABLE_PREFIX":         "test_",
+		"MEDIA_TABLE":          "stats",
+		"LAST_UPDATED_INDEX":   "updatedIndex",
+		"LOCALSTACK_ENDPOINT":  "http://localhost:4566/",
+		"MAX_BATCH_SIZE":       "10",
+		"DEFAULT_MAX_AFK_TIME": "300",
+	}))
+	assert.NoError(t, loadErr)
+	assert.Equal(t, "stats", config.Tables.Media)
+	assert.Equal(t, "test_settings", config.Tables.Settings)
+	assert.Equal(t, "updatedIndex", config.Indexes.LastUpdated)
+	assert.Equal(t, "http://localhost:4566/", config.Endpoint)
+	assert.Equal(t, 10, config.MaxBatchSize)
+	assert.Equal(t, int16(300), config.MaxAFKTime)
+
+	for _, variables := range []map[string]string{
+		{"MAX_BATCH_SIZE": "26"},
+		{"MAX_BATCH_SIZE": "many"},
+		{"DEFAULT_MAX_AFK_TIME": "0"},
+		{"DEFAULT_MAX_AFK_TIME": "59"},
+		{"DEFAULT_MAX_AFK_TIME": "3601"},
+		{"DEFAULT_MAX_AFK_TIME": "40000"},
+	} {
+		_, loadErr = load(lookupFrom(variables))
+		assert.Error(t, loadErr, variables)
+	}
+}
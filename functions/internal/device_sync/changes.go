@@ -0,0 +1,252 @@
+package device_sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/rs/zerolog/log"
+)
+
+// How long changes are kept for, devices which haven't synced for longer need a full backfill
+const ChangeRetention = 30 * 24 * time.Hour
+
+const MaxChangesPerSync = 1000
+
+// One write of every transaction goes to bumping the sequence
+const MaxChangesPerTransaction = dynamo_wrapper.AWSMaxTransactionSize - 1
+
+// Items written alongside their changes take two writes each
+const MaxItemsPerCommit = MaxChangesPerTransaction / 2
+
+// Commits racing for the same sequence are retried this many times before giving up
+const MaxCommitAttempts = 5
+
+const sequenceSK = "sequence"
+const changePrefix = "change#"
+
+// The latest state of a media table item, stamped with the order it was changed in
+type ChangeRecord struct {
+	Sequence  int64                               `json:"sequence"`
+	Key       map[string]*dynamodb.AttributeValue `json:"key"`
+	Item      map[string]*dynamodb.AttributeValue `json:"item"`
+	CreatedAt int64                               `json:"created_at"`
+	ExpiresAt int64                               `json:"expires_at"`
+}
+
+// Only the key of the item is kept, since counters added to within the same transaction can't be known until it commits
+type changeItem struct {
+	Username  string                              `dynamodbav:"username"`
+	SK        string                              `dynamodbav:"sk"`
+	Sequence  int64                               `dynamodbav:"sequence"`
+	ItemKey   map[string]*dynamodb.AttributeValue `dynamodbav:"item_key"`
+	CreatedAt int64                               `dynamodbav:"created_at"`
+	ExpiresAt int64                               `dynamodbav:"expires_at"`
+}
+
+func changeSK(sequence int64) string {
+	return changePrefix + fmt.Sprintf("%0*d", strconv.IntSize/4, sequence)
+}
+
+func sequenceKey(username string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"username": {S: aws.String(username)},
+		"sk":       {S: aws.String(sequenceSK)},
+	}
+}
+
+// The latest sequence handed out for a user, zero when nothing has changed yet
+func CurrentSequence(ctx context.Context, svc storage.Storage, username string) (int64, error) {
+	tableName := svc.Config().Tables.Sync
+	result, getErr := svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            sequenceKey(username),
+		ConsistentRead: aws.Bool(true),
+	})
+	if getErr != nil {
+		log.Ctx(ctx).Error().Err(getErr).Str("table", tableName).Str("username", username).Msg("Dynamodb failed to get item")
+		return 0, getErr
+	}
+
+	sequence, exists := result.Item["sequence"]
+	if !exists || sequence.N == nil {
+		return 0, nil
+	}
+
+	return strconv.ParseInt(*sequence.N, 10, 64)
+}
+
+// Moves the sequence on from the one read and records a change for each key after it
+// The sequence only moves if nobody else has moved it since, so changes are never given the same number
+func appendChanges(transaction *dynamo_wrapper.Transaction, tableName string, username string, currentSequence int64, keys []map[string]*dynamodb.AttributeValue) {
+	timeNow := time.Now()
+
+	transaction.UpdateExpression(tableName, sequenceKey(username), dynamo_wrapper.Expression{
+		Expression: "SET #sequence = :sequence",
+		Names:      map[string]*string{"#sequence": aws.String("sequence")},
+		Values: map[string]*dynamodb.AttributeValue{
+			":sequence": {N: aws.String(strconv.FormatInt(currentSequence+int64(len(keys)), 10))},
+		},
+	}).When(dynamo_wrapper.Expression{
+		Expression: "attribute_not_exists(#sequence) OR #sequence = :current",
+		Values: map[string]*dynamodb.AttributeValue{
+			":current": {N: aws.String(strconv.FormatInt(currentSequence, 10))},
+		},
+	})
+
+	for i, key := range keys {
+		sequence := currentSequence + int64(i) + 1
+		transaction.Put(tableName, map[string]*dynamodb.AttributeValue{
+			"username": {S: aws.String(username)},
+			"sk":       {S: aws.String(changeSK(sequence))},
+		}, changeItem{
+			Username:  username,
+			SK:        changeSK(sequence),
+			Sequence:  sequence,
+			ItemKey:   key,
+			CreatedAt: timeNow.Unix(),
+			ExpiresAt: timeNow.Add(ChangeRetention).Unix(),
+		})
+	}
+}
+
+// Whether the commit lost a race for the sequence (or any of its items) and can simply be tried again
+func sequenceRaced(tableName string, err error) bool {
+	if errors.Is(err, dynamo_wrapper.ErrTransactionConflict) {
+		return true
+	}
+
+	var cancelledErr *dynamo_wrapper.TransactionCancelledError
+	if !errors.As(err, &cancelledErr) {
+		return false
+	}
+	for _, reason := range cancelledErr.Reasons {
+		if reason.TableName == tableName && errors.Is(reason.Err(), dynamo_wrapper.ErrConditionFailed) && reason.Key["sk"] != nil && aws.StringValue(reason.Key["sk"].S) == sequenceSK {
+			return true
+		}
+	}
+	return false
+}
+
+// Commits the writes built along with a change for each key they touch, so devices learn of every write that succeeds and none that fail
+// The writes are built again for each attempt, since another writer taking the next sequence means starting over
+func CommitWithChanges(ctx context.Context, svc storage.Storage, username string, keys []map[string]*dynamodb.AttributeValue, build func(transaction *dynamo_wrapper.Transaction)) error {
+	var commitErr error
+	for attempt := 0; attempt < MaxCommitAttempts; attempt++ {
+		currentSequence, sequenceErr := CurrentSequence(ctx, svc, username)
+		if sequenceErr != nil {
+			return sequenceErr
+		}
+
+		transaction := dynamo_wrapper.NewTransaction()
+		build(transaction)
+		appendChanges(transaction, svc.Config().Tables.Sync, username, currentSequence, keys)
+
+		commitErr = transaction.Commit(ctx, svc)
+		if commitErr == nil || !sequenceRaced(svc.Config().Tables.Sync, commitErr) {
+			return commitErr
+		}
+	}
+
+	log.Ctx(ctx).Error().Err(commitErr).Str("username", username).Int("attempts", MaxCommitAttempts).Msg("Could not record changes")
+	return commitErr
+}
+
+// Appends changes for items which were already written to the user's change log
+// Fails without recording anything past the first failed block of changes, so the writes should be made again
+func RecordChanges(ctx context.Context, svc storage.Storage, username string, keys []map[string]*dynamodb.AttributeValue) error {
+	for start := 0; start < len(keys); start += MaxChangesPerTransaction {
+		end := start + MaxChangesPerTransaction
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		if commitErr := CommitWithChanges(ctx, svc, username, keys[start:end], func(*dynamo_wrapper.Transaction) {}); commitErr != nil {
+			return commitErr
+		}
+	}
+
+	return nil
+}
+
+// Reads changes after the watermark in sequence order along with the latest state of each item, and the watermark covering them
+// Sequences are only ever moved on in the same transaction as their changes are written, so there are never gaps to wait on
+func ReadChanges(ctx context.Context, svc storage.Storage, username string, watermark int64) ([]ChangeRecord, int64, error) {
+	changes := []ChangeRecord{}
+	nextWatermark := watermark
+
+	tableName := svc.Config().Tables.Sync
+	query := dynamo_wrapper.NewQuery(tableName).
+		Partition("username", username).
+		SortBetween("sk", changeSK(watermark+1), changeSK(watermark+MaxChangesPerSync)).
+		ConsistentRead()
+
+	queryErr := query.Each(ctx, svc, func(item map[string]*dynamodb.AttributeValue) error {
+		change := changeItem{}
+		if unmarshalErr := dynamodbattribute.UnmarshalMap(item, &change); unmarshalErr != nil {
+			log.Ctx(ctx).Error().Err(unmarshalErr).Interface("item", item).Msg("Could not unmarshal change record")
+			return unmarshalErr
+		}
+
+		changes = append(changes, ChangeRecord{
+			Sequence:  change.Sequence,
+			Key:       change.ItemKey,
+			CreatedAt: change.CreatedAt,
+			ExpiresAt: change.ExpiresAt,
+		})
+		nextWatermark = change.Sequence
+		return nil
+	})
+	if queryErr != nil {
+		log.Ctx(ctx).Error().Err(queryErr).Str("table", tableName).Str("username", username).Msg("Dynamodb query failed")
+		return nil, watermark, queryErr
+	}
+
+	if loadErr := loadChangedItems(ctx, svc, changes); loadErr != nil {
+		return nil, watermark, loadErr
+	}
+
+	return changes, nextWatermark, nil
+}
+
+// Fills in the latest state of each changed item, read consistently so nothing committed before the change was read is missed
+// Items which no longer exist (tombstones past their retention) are left empty
+func loadChangedItems(ctx context.Context, svc storage.Storage, changes []ChangeRecord) error {
+	keys := []map[string]*dynamodb.AttributeValue{}
+	for _, change := range changes {
+		keys = append(keys, change.Key)
+	}
+
+	tableName := svc.Config().Tables.Media
+	result, getErr := dynamo_wrapper.ConsistentBatchGetItems(ctx, svc, tableName, keys)
+	if getErr != nil {
+		return getErr
+	}
+	if !result.Complete() {
+		err := errors.New("could not read every changed item")
+		log.Ctx(ctx).Error().Err(err).Str("table", tableName).Int("unprocessed", len(result.Unprocessed)).Send()
+		return err
+	}
+
+	items := map[string]map[string]*dynamodb.AttributeValue{}
+	for _, found := range result.Items {
+		items[itemID(found.Key)] = found.Item
+	}
+	for i := range changes {
+		changes[i].Item = items[itemID(changes[i].Key)]
+	}
+
+	return nil
+}
+
+// Media table keys are always a pk and sk
+func itemID(key map[string]*dynamodb.AttributeValue) string {
+	return *key["pk"].S + "\x00" + *key["sk"].S
+}
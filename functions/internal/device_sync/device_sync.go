@@ -0,0 +1,138 @@
+package device_sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
+)
+
+const devicePrefix = "device#"
+
+var ErrDeviceNotFound = fmt.Errorf("registered device %w", dynamo_wrapper.ErrNotFound)
+var ErrInvalidWatermark = errors.New("watermark was never issued to this device")
+var ErrResyncRequired = errors.New("changes since the last sync have expired, full backfill required")
+
+type DeviceKey struct {
+	Username string `json:"username" binding:"required"`
+	DeviceID string `json:"device_id" binding:"required"`
+}
+
+// Watermarks are sequence numbers issued by the server, so client clocks never come into play
+type Device struct {
+	Key       DeviceKey `json:"key" binding:"required"`
+	Watermark int64     `json:"watermark"`
+	LastSync  int64     `json:"last_sync"`
+}
+
+type deviceItem struct {
+	Username  string `dynamodbav:"username"`
+	SK        string `dynamodbav:"sk"`
+	Watermark int64  `dynamodbav:"watermark"`
+	LastSync  int64  `dynamodbav:"last_sync"`
+}
+
+// Devices are read consistently so watermarks are never stale
+func devicesRepository(ctx context.Context, svc storage.Storage) *dynamo_wrapper.Repository[DeviceKey, deviceItem] {
+	repository := dynamo_wrapper.NewRepository[DeviceKey, deviceItem](svc, svc.Config().Tables.Sync, func(key DeviceKey) (map[string]*dynamodb.AttributeValue, error) {
+		return map[string]*dynamodb.AttributeValue{
+			"username": {S: aws.String(key.Username)},
+			"sk":       {S: aws.String(devicePrefix + key.DeviceID)},
+		}, nil
+	})
+	repository.ConsistentRead = true
+	return repository
+}
+
+func putDevice(ctx context.Context, svc storage.Storage, device Device) error {
+	return devicesRepository(ctx, svc).Put(ctx, device.Key, deviceItem{
+		Username:  device.Key.Username,
+		SK:        devicePrefix + device.Key.DeviceID,
+		Watermark: device.Watermark,
+		LastSync:  device.LastSync,
+	})
+}
+
+func GetDevice(ctx context.Context, svc storage.Storage, key DeviceKey) (*Device, error) {
+	item, getErr := devicesRepository(ctx, svc).Get(ctx, key)
+	if errors.Is(getErr, dynamo_wrapper.ErrNotFound) {
+		return nil, ErrDeviceNotFound
+	} else if getErr != nil {
+		return nil, getErr
+	}
+
+	return &Device{
+		Key:       key,
+		Watermark: item.Watermark,
+		LastSync:  item.LastSync,
+	}, nil
+}
+
+// Registers (or re-registers) a device starting from the current point in the change log
+// The device should follow up with a full backfill, anything changed since is then sent on its first sync
+func RegisterDevice(ctx context.Context, svc storage.Storage, key DeviceKey) (*Device, error) {
+	if len(key.Username) == 0 || len(key.DeviceID) == 0 {
+		err := errors.New("invalid device key")
+		log.Ctx(ctx).Info().Err(err).Interface("key", key).Send()
+		return nil, err
+	}
+
+	sequence, sequenceErr := CurrentSequence(ctx, svc, key.Username)
+	if sequenceErr != nil {
+		return nil, sequenceErr
+	}
+
+	device := Device{
+		Key:       key,
+		Watermark: sequence,
+		LastSync:  time.Now().Unix(),
+	}
+	if putErr := putDevice(ctx, svc, device); putErr != nil {
+		return nil, putErr
+	}
+
+	return &device, nil
+}
+
+// Reads the changes a device hasn't seen yet
+// The watermark given is the last one the device applied, so a lost response is simply requested again
+func SyncDevice(ctx context.Context, svc storage.Storage, key DeviceKey, watermark int64) ([]ChangeRecord, *Device, error) {
+	device, getErr := GetDevice(ctx, svc, key)
+	if getErr != nil {
+		return nil, nil, getErr
+	}
+
+	if watermark < 0 || watermark > device.Watermark {
+		log.Ctx(ctx).Info().Err(ErrInvalidWatermark).Interface("device", device).Int64("watermark", watermark).Send()
+		return nil, nil, ErrInvalidWatermark
+	}
+
+	timeNow := time.Now()
+	if timeNow.Sub(time.Unix(device.LastSync, 0)) > ChangeRetention {
+		log.Ctx(ctx).Info().Err(ErrResyncRequired).Interface("device", device).Send()
+		return nil, nil, ErrResyncRequired
+	}
+
+	changes, nextWatermark, readErr := ReadChanges(ctx, svc, key.Username, watermark)
+	if readErr != nil {
+		return nil, nil, readErr
+	}
+
+	// A device re-syncing from an older watermark never moves its issued watermark backwards
+	if nextWatermark > device.Watermark {
+		device.Watermark = nextWatermark
+	}
+	device.LastSync = timeNow.Unix()
+	if putErr := putDevice(ctx, svc, *device); putErr != nil {
+		return nil, nil, putErr
+	}
+
+	device.Watermark = nextWatermark
+	return changes, device, nil
+}
@@ -0,0 +1,69 @@
+package dynamo_wrapper
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
+)
+
+// How long poison writes are kept around for inspection before dynamodb's TTL removes them
+const DeadLetterRetention = 14 * 24 * time.Hour
+
+func deadLetterItem(failure FailedWrite, tableName string, id string, failedAt time.Time) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{
+		"table_name": {S: aws.String(tableName)},
+		"id":         {S: aws.String(id)},
+		"kind":       {S: aws.String(string(failure.Kind))},
+		"error":      {S: aws.String(failure.Error)},
+		"failed_at":  {N: aws.String(strconv.FormatInt(failedAt.Unix(), 10))},
+		"expires_at": {N: aws.String(strconv.FormatInt(failedAt.Add(DeadLetterRetention).Unix(), 10))},
+	}
+
+	if failure.WriteRequest.PutRequest != nil {
+		item["item"] = &dynamodb.AttributeValue{M: failure.WriteRequest.PutRequest.Item}
+	}
+	if failure.WriteRequest.DeleteRequest != nil {
+		item["key"] = &dynamodb.AttributeValue{M: failure.WriteRequest.DeleteRequest.Key}
+	}
+
+	return item
+}
+
+// Sets aside writes which can never succeed so they stop being retried
+func PutDeadLetters(ctx context.Context, svc storage.Storage, result *BatchWriteResult) error {
+	if len(result.Failed) == 0 {
+		return nil
+	}
+
+	failedAt := time.Now()
+	writeRequests := []*dynamodb.WriteRequest{}
+	for i, failure := range result.Failed {
+		id := strconv.FormatInt(failedAt.UnixNano(), 10) + "#" + strconv.Itoa(i)
+
+		writeRequests = append(writeRequests, &dynamodb.WriteRequest{
+			PutRequest: &dynamodb.PutRequest{Item: deadLetterItem(failure, result.TableName, id, failedAt)},
+		})
+	}
+
+	// Written in the time kept in reserve after the writes which failed, so no further margin is left
+	cfg := svc.Config()
+	deadLetterResult := newBatchWriteResult(cfg.Tables.DeadLetters)
+	for start := 0; start < len(writeRequests); start += cfg.MaxBatchSize {
+		end := min(start+cfg.MaxBatchSize, len(writeRequests))
+		deadLetterResult.merge(BatchWrite(ctx, svc, cfg.Tables.DeadLetters, writeRequests[start:end]))
+	}
+	if !deadLetterResult.Complete() {
+		err := errors.New("could not store every dead letter")
+		log.Ctx(ctx).Error().Err(err).Str("table_name", result.TableName).Interface("failed", result.Failed).Send()
+		return err
+	}
+
+	log.Ctx(ctx).Info().Str("table_name", result.TableName).Int("dead_letters", len(result.Failed)).Msg("Failed writes sent to dead letters")
+	return nil
+}
@@ -0,0 +1,194 @@
+package dynamo_wrapper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/rs/zerolog/log"
+)
+
+const AWSMaxBatchGetSize = 100
+
+var errKeysLeftUnprocessed = errors.New("keys left unprocessed by dynamodb")
+
+type BatchGetItem[T any] struct {
+	Key  map[string]*dynamodb.AttributeValue
+	Item T
+}
+
+// What was found for every key requested, in the order the keys were given
+// Unprocessed keys can be requested again while missing keys aren't in the table
+type BatchGetResult[T any] struct {
+	TableName   string
+	Items       []BatchGetItem[T]
+	Missing     []map[string]*dynamodb.AttributeValue
+	Unprocessed []map[string]*dynamodb.AttributeValue
+}
+
+// Whether every key was looked up, regardless of whether it was found
+func (result *BatchGetResult[T]) Complete() bool {
+	return len(result.Unprocessed) == 0
+}
+
+// Identifies a key by the values of its attributes, since dynamodb returns items in any order
+func keyID(key map[string]*dynamodb.AttributeValue, names []string) string {
+	values := make([]*dynamodb.AttributeValue, len(names))
+	for i, name := range names {
+		values[i] = key[name]
+	}
+
+	encoded, _ := json.Marshal(values)
+	return string(encoded)
+}
+
+func keyNames(key map[string]*dynamodb.AttributeValue) []string {
+	names := []string{}
+	for name := range key {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Reads a single chunk of keys, retrying unprocessed keys and throttling errors with backoff until the context ends
+func batchGetChunk(ctx context.Context, svc storage.Storage, tableName string, keys []map[string]*dynamodb.AttributeValue, consistentRead bool) ([]map[string]*dynamodb.AttributeValue, []map[string]*dynamodb.AttributeValue, error) {
+	items := []map[string]*dynamodb.AttributeValue{}
+
+	for attempt := 0; len(keys) > 0; attempt++ {
+		if ctx.Err() != nil {
+			break
+		}
+		if attempt > 0 && (attempt >= MaxBatchAttempts || !waitForRetry(ctx, retryDelay(attempt))) {
+			log.Ctx(ctx).Info().Str("table_name", tableName).Int("attempts", attempt).Int("unprocessed", len(keys)).Msg("Dynamodb batch get gave up retrying")
+			break
+		}
+
+		output, err := svc.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]*dynamodb.KeysAndAttributes{
+				tableName: {Keys: keys, ConsistentRead: aws.Bool(consistentRead)},
+			},
+		})
+		if err != nil {
+			if ctx.Err() == nil && !classifyError(err).Retryable() {
+				log.Ctx(ctx).Error().Err(err).Str("table_name", tableName).Interface("keys", keys).Msg("Dynamodb batch get failed")
+				return nil, nil, err
+			}
+
+			log.Ctx(ctx).Info().Err(err).Str("table_name", tableName).Int("keys", len(keys)).Msg("Dynamodb batch get will be retried")
+			continue
+		}
+
+		items = append(items, output.Responses[tableName]...)
+		if unprocessed, exists := output.UnprocessedKeys[tableName]; exists && unprocessed != nil {
+			keys = unprocessed.Keys
+		} else {
+			keys = nil
+		}
+	}
+
+	return items, keys, nil
+}
+
+// Looks up every key in chunks, reporting which keys were found, missing or left unprocessed
+// Duplicate keys are only looked up once
+func BatchGetItems(ctx context.Context, svc storage.Storage, tableName string, keys []map[string]*dynamodb.AttributeValue) (*BatchGetResult[map[string]*dynamodb.AttributeValue], error) {
+	return batchGetItems(ctx, svc, tableName, keys, false)
+}
+
+// Looks up every key like BatchGetItems, but sees every write which succeeded before the call
+func ConsistentBatchGetItems(ctx context.Context, svc storage.Storage, tableName string, keys []map[string]*dynamodb.AttributeValue) (*BatchGetResult[map[string]*dynamodb.AttributeValue], error) {
+	return batchGetItems(ctx, svc, tableName, keys, true)
+}
+
+func batchGetItems(ctx context.Context, svc storage.Storage, tableName string, keys []map[string]*dynamodb.AttributeValue, consistentRead bool) (*BatchGetResult[map[string]*dynamodb.AttributeValue], error) {
+	result := &BatchGetResult[map[string]*dynamodb.AttributeValue]{
+		TableName:   tableName,
+		Items:       []BatchGetItem[map[string]*dynamodb.AttributeValue]{},
+		Missing:     []map[string]*dynamodb.AttributeValue{},
+		Unprocessed: []map[string]*dynamodb.AttributeValue{},
+	}
+	if len(keys) == 0 {
+		return result, nil
+	}
+
+	// Every key of a table has the same attributes
+	names := keyNames(keys[0])
+
+	uniqueKeys := []map[string]*dynamodb.AttributeValue{}
+	requested := map[string]bool{}
+	for _, key := range keys {
+		id := keyID(key, names)
+		if !requested[id] {
+			requested[id] = true
+			uniqueKeys = append(uniqueKeys, key)
+		}
+	}
+
+	found := map[string]map[string]*dynamodb.AttributeValue{}
+	unprocessed := map[string]bool{}
+	for start := 0; start < len(uniqueKeys); start += AWSMaxBatchGetSize {
+		end := min(start+AWSMaxBatchGetSize, len(uniqueKeys))
+
+		items, unprocessedKeys, getErr := batchGetChunk(ctx, svc, tableName, uniqueKeys[start:end], consistentRead)
+		if getErr != nil {
+			return nil, getErr
+		}
+
+		for _, item := range items {
+			found[keyID(item, names)] = item
+		}
+		for _, key := range unprocessedKeys {
+			unprocessed[keyID(key, names)] = true
+		}
+	}
+
+	for _, key := range uniqueKeys {
+		id := keyID(key, names)
+
+		if item, exists := found[id]; exists {
+			result.Items = append(result.Items, BatchGetItem[map[string]*dynamodb.AttributeValue]{Key: key, Item: item})
+		} else if unprocessed[id] {
+			result.Unprocessed = append(result.Unprocessed, key)
+		} else {
+			result.Missing = append(result.Missing, key)
+		}
+	}
+
+	if !result.Complete() {
+		log.Ctx(ctx).Info().Err(errKeysLeftUnprocessed).Str("table_name", tableName).Int("unprocessed", len(result.Unprocessed)).Send()
+	}
+
+	return result, nil
+}
+
+// Looks up every key like BatchGetItems, unmarshalling the items found
+func BatchGet[T any](ctx context.Context, svc storage.Storage, tableName string, keys []map[string]*dynamodb.AttributeValue) (*BatchGetResult[T], error) {
+	rawResult, getErr := BatchGetItems(ctx, svc, tableName, keys)
+	if getErr != nil {
+		return nil, getErr
+	}
+
+	result := &BatchGetResult[T]{
+		TableName:   tableName,
+		Items:       []BatchGetItem[T]{},
+		Missing:     rawResult.Missing,
+		Unprocessed: rawResult.Unprocessed,
+	}
+	for _, rawItem := range rawResult.Items {
+		var item T
+		if unmarshalErr := dynamodbattribute.UnmarshalMap(rawItem.Item, &item); unmarshalErr != nil {
+			log.Ctx(ctx).Error().Err(unmarshalErr).Str("table_name", tableName).Interface("item", rawItem.Item).Msg("Could not unmarshal dynamodb item")
+			return nil, unmarshalErr
+		}
+
+		result.Items = append(result.Items, BatchGetItem[T]{Key: rawItem.Key, Item: item})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,114 @@
+package dynamo_wrapper
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+// Leaves the last key of each request unprocessed on the first calls with more than one key
+type unprocessedKeysStorage struct {
+	storage.Storage
+	mutex       sync.Mutex
+	unprocessed int
+	calls       int
+}
+
+func (partial *unprocessedKeysStorage) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	partial.mutex.Lock()
+	partial.calls++
+	skip := partial.unprocessed > 0
+	for _, keysAndAttributes := range input.RequestItems {
+		skip = skip && len(keysAndAttributes.Keys) > 1
+	}
+	if skip {
+		partial.unprocessed--
+	}
+	partial.mutex.Unlock()
+
+	if !skip {
+		return partial.Storage.BatchGetItemWithContext(ctx, input, opts...)
+	}
+
+	unprocessedKeys := map[string]*dynamodb.KeysAndAttributes{}
+	for tableName, keysAndAttributes := range input.RequestItems {
+		last := len(keysAndAttributes.Keys) - 1
+		unprocessedKeys[tableName] = &dynamodb.KeysAndAttributes{Keys: keysAndAttributes.Keys[last:]}
+		input.RequestItems[tableName] = &dynamodb.KeysAndAttributes{Keys: keysAndAttributes.Keys[:last]}
+	}
+
+	output, err := partial.Storage.BatchGetItemWithContext(ctx, input, opts...)
+	if err != nil {
+		return nil, err
+	}
+	output.UnprocessedKeys = unprocessedKeys
+	return output, nil
+}
+
+type mediaItem struct {
+	PK string `json:"pk"`
+	SK string `json:"sk"`
+}
+
+func mediaKey(sk string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"pk": {S: aws.String("vn#username")},
+		"sk": {S: aws.String(sk)},
+	}
+}
+
+func TestBatchGet(t *testing.T) {
+	memory := storage.NewMemoryStorage(config.Defaults())
+	result, writeErr := DistributedBatchWrites(context.Background(), memory, &BatchwriteArgs{
+		TableName:     "media",
+		WriteRequests: randomWrites(150),
+		MaxBatchSize:  AWSMaxBatchSize,
+	})
+	assert.NoError(t, writeErr)
+	assert.True(t, result.Complete())
+
+	// Every other key is missing, with a duplicate thrown in
+	keys := []map[string]*dynamodb.AttributeValue{}
+	for i := 0; i < 300; i += 2 {
+		keys = append(keys, mediaKey(strconv.Itoa(i)))
+	}
+	keys = append(keys, mediaKey("0"))
+
+	partial := &unprocessedKeysStorage{Storage: memory, unprocessed: 2}
+	output, getErr := BatchGet[mediaItem](context.Background(), partial, "media", keys)
+
+	assert.NoError(t, getErr)
+	assert.True(t, output.Complete())
+	assert.Len(t, output.Items, 75)
+	assert.Len(t, output.Missing, 75)
+
+	// Both chunks had a key left over to retry
+	assert.Equal(t, 4, partial.calls)
+
+	for i, item := range output.Items {
+		assert.Equal(t, strconv.Itoa(i*2), item.Item.SK)
+		assert.Equal(t, *item.Key["sk"].S, item.Item.SK)
+	}
+}
+
+func TestCancelledBatchGet(t *testing.T) {
+	memory := storage.NewMemoryStorage(config.Defaults())
+	keys := []map[string]*dynamodb.AttributeValue{mediaKey("a"), mediaKey("b")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	output, getErr := BatchGetItems(ctx, memory, "media", keys)
+
+	assert.NoError(t, getErr)
+	assert.False(t, output.Complete())
+	assert.ElementsMatch(t, keys, output.Unprocessed)
+}
@@ -1,63 +1,322 @@
 package dynamo_wrapper
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
 	"sync"
+	"time"
 
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-func BatchWrite(svc *dynamodb.DynamoDB, tableName string, items []*dynamodb.WriteRequest) []*dynamodb.WriteRequest {
-	unprocessedWrites := []*dynamodb.WriteRequest{}
+const DefaultBatchConcurrency = 8
+const MaxBatchAttempts = 8
+
+// Backoff between attempts grows exponentially up to the maximum, with full jitter
+const BaseRetryDelay = 50 * time.Millisecond
+const MaxRetryDelay = 5 * time.Second
+
+// Time kept in reserve before a deadline so unprocessed writes can still be handed back
+const DeadlineMargin = time.Second
+
+type WriteFailureKind string
+
+const (
+	// Retryable, the write may well succeed next time
+	WriteUnprocessed WriteFailureKind = "unprocessed"
+	WriteThrottled   WriteFailureKind = "throttled"
+	WriteTransient   WriteFailureKind = "transient"
+
+	// Permanent, retrying the same write can never succeed
+	WriteInvalid  WriteFailureKind = "invalid"
+	WriteRejected WriteFailureKind = "rejected"
+
+	// Nothing was wrong with the write, the table or credentials were (missing, expired or not allowed)
+	// The whole call fails and the write is handed back for the caller to retry once that's fixed
+	WriteAborted WriteFailureKind = "aborted"
+)
+
+var errLeftUnprocessed = errors.New("left unprocessed by dynamodb")
+var errBatchTooLarge = errors.New("exceeds the maximum batch size")
+
+type FailedWrite struct {
+	WriteRequest *dynamodb.WriteRequest `json:"write_request"`
+	Kind         WriteFailureKind       `json:"kind"`
+	Error        string                 `json:"error"`
+}
+
+// What became of every write attempted, unprocessed writes can be retried while failed ones never will succeed
+type BatchWriteResult struct {
+	TableName   string                   `json:"table_name"`
+	Succeeded   []*dynamodb.WriteRequest `json:"succeeded"`
+	Unprocessed []FailedWrite            `json:"unprocessed"`
+	Failed      []FailedWrite            `json:"failed"`
+	// Why writing was aborted, if it was
+	err error
+}
+
+func newBatchWriteResult(tableName string) *BatchWriteResult {
+	return &BatchWriteResult{
+		TableName:   tableName,
+		Succeeded:   []*dynamodb.WriteRequest{},
+		Unprocessed: []FailedWrite{},
+		Failed:      []FailedWrite{},
+	}
+}
+
+func (result *BatchWriteResult) add(items []*dynamodb.WriteRequest, kind WriteFailureKind, err error) {
+	for _, item := range items {
+		failure := FailedWrite{WriteRequest: item, Kind: kind, Error: err.Error()}
+
+		if kind.Retryable() || kind == WriteAborted {
+			result.Unprocessed = append(result.Unprocessed, failure)
+		} else {
+			result.Failed = append(result.Failed, failure)
+		}
+	}
+}
+
+func (result *BatchWriteResult) merge(other *BatchWriteResult) {
+	result.Succeeded = append(result.Succeeded, other.Succeeded...)
+	result.Unprocessed = append(result.Unprocessed, other.Unprocessed...)
+	result.Failed = append(result.Failed, other.Failed...)
+	if result.err == nil {
+		result.err = other.err
+	}
+}
+
+// Why writing was aborted, nil unless a call failed for reasons which had nothing to do with the items
+func (result *BatchWriteResult) Err() error {
+	return result.err
+}
+
+// Whether every write made it into the table
+func (result *BatchWriteResult) Complete() bool {
+	return len(result.Unprocessed) == 0 && len(result.Failed) == 0
+}
+
+// The writes worth attempting again
+func (result *BatchWriteResult) UnprocessedWrites() []*dynamodb.WriteRequest {
+	writeRequests := []*dynamodb.WriteRequest{}
+	for _, failure := range result.Unprocessed {
+		writeRequests = append(writeRequests, failure.WriteRequest)
+	}
+	return writeRequests
+}
+
+func (kind WriteFailureKind) Retryable() bool {
+	return kind == WriteUnprocessed || kind == WriteThrottled || kind == WriteTransient
+}
+
+// Only errors about the items themselves are permanent, anything else is the caller's to deal with
+func classifyError(err error) WriteFailureKind {
+	var awsErr awserr.Error
+	isAWSErr := errors.As(err, &awsErr)
+	var requestFailure awserr.RequestFailure
+	serverFailed := errors.As(err, &requestFailure) && requestFailure.StatusCode() >= 500
+
+	switch {
+	case request.IsErrorThrottle(err):
+		return WriteThrottled
+	// The SDK counts these as retryable, but they only go away once the credentials are refreshed
+	case request.IsErrorExpiredCreds(err):
+		return WriteAborted
+	case request.IsErrorRetryable(err) || serverFailed:
+		return WriteTransient
+	case isAWSErr && awsErr.Code() == "ValidationException":
+		return WriteInvalid
+	case isAWSErr && awsErr.Code() == dynamodb.ErrCodeItemCollectionSizeLimitExceededException:
+		return WriteRejected
+	default:
+		return WriteAborted
+	}
+}
+
+func retryDelay(attempt int) time.Duration {
+	delay := MaxRetryDelay
+	if attempt < 16 {
+		delay = min(MaxRetryDelay, BaseRetryDelay<<attempt)
+	}
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+// Waits out a retry delay, giving up early if the context would end before it's over
+func waitForRetry(ctx context.Context, delay time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+		return false
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Identifies a write request by value, since unprocessed items come back as new objects
+func writeRequestID(writeRequest *dynamodb.WriteRequest) string {
+	encoded, _ := json.Marshal(writeRequest)
+	return string(encoded)
+}
+
+func logBatchError(ctx context.Context, err error, tableName string, items []*dynamodb.WriteRequest) {
+	itemsArray := zerolog.Arr()
+
+	for _, item := range items {
+		if item.PutRequest != nil {
+			itemsArray.Interface(item.PutRequest.Item)
+		} else if item.DeleteRequest != nil {
+			itemsArray.Interface(item.DeleteRequest.Key)
+		}
+	}
+
+	log.Ctx(ctx).Error().Err(err).Str("table_name", tableName).Array("items", itemsArray).Msg("Dynamodb batch write failed")
+}
+
+// Writes a single batch, retrying unprocessed items and throttling errors with backoff until the context ends
+// Batches rejected as invalid are split up until the items at fault are found
+func BatchWrite(ctx context.Context, svc storage.Storage, tableName string, items []*dynamodb.WriteRequest) *BatchWriteResult {
+	result := newBatchWriteResult(tableName)
 
 	if len(items) > AWSMaxBatchSize {
-		unprocessedWrites = append(unprocessedWrites, items[AWSMaxBatchSize:]...)
+		result.add(items[AWSMaxBatchSize:], WriteUnprocessed, errBatchTooLarge)
+		items = items[:AWSMaxBatchSize]
 	}
 
-	output, err := svc.BatchWriteItem(&dynamodb.BatchWriteItemInput{
-		RequestItems: map[string][]*dynamodb.WriteRequest{
-			tableName: items[:min(AWSMaxBatchSize, len(items))],
-		},
-	})
-	unprocessedWrites = append(unprocessedWrites, output.UnprocessedItems[tableName]...)
+	var lastErr error = errLeftUnprocessed
+	lastKind := WriteUnprocessed
+
+	for attempt := 0; len(items) > 0; attempt++ {
+		if ctx.Err() != nil {
+			lastErr, lastKind = ctx.Err(), WriteUnprocessed
+			break
+		}
+		if attempt > 0 && (attempt >= MaxBatchAttempts || !waitForRetry(ctx, retryDelay(attempt))) {
+			log.Ctx(ctx).Info().Str("table_name", tableName).Int("attempts", attempt).Int("unprocessed", len(items)).Msg("Dynamodb batch write gave up retrying")
+			break
+		}
+
+		output, err := svc.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{
+				tableName: items,
+			},
+		})
+
+		if err != nil {
+			lastErr, lastKind = err, classifyError(err)
+
+			// Cancelled writes weren't at fault, so they're left for whoever retries next
+			if ctx.Err() != nil {
+				lastKind = WriteUnprocessed
+			}
 
-	if err != nil {
-		itemsArray := zerolog.Arr()
+			if lastKind.Retryable() {
+				logBatchError(ctx, err, tableName, items)
+				continue
+			}
 
+			if lastKind == WriteAborted {
+				logBatchError(ctx, err, tableName, items)
+				result.add(items, lastKind, err)
+				result.err = err
+				return result
+			}
+
+			if lastKind == WriteInvalid && len(items) > 1 {
+				half := len(items) / 2
+				result.merge(BatchWrite(ctx, svc, tableName, items[:half]))
+				result.merge(BatchWrite(ctx, svc, tableName, items[half:]))
+				return result
+			}
+
+			logBatchError(ctx, err, tableName, items)
+			result.add(items, lastKind, err)
+			return result
+		}
+
+		unprocessedIDs := map[string]bool{}
+		for _, item := range output.UnprocessedItems[tableName] {
+			unprocessedIDs[writeRequestID(item)] = true
+		}
+
+		remaining := []*dynamodb.WriteRequest{}
 		for _, item := range items {
-			itemsArray.Interface(item.PutRequest.Item)
+			if unprocessedIDs[writeRequestID(item)] {
+				remaining = append(remaining, item)
+			} else {
+				result.Succeeded = append(result.Succeeded, item)
+			}
 		}
 
-		log.Error().Err(err).Str("table_name", tableName).Array("items", itemsArray).Msg("Dynamodb batch write failed")
-	} else {
-		log.Info().Str("table_name", tableName).Msg("Dynamodb batch write succeeded")
+		items, lastErr, lastKind = remaining, errLeftUnprocessed, WriteUnprocessed
+		if len(items) == 0 {
+			log.Ctx(ctx).Info().Str("table_name", tableName).Msg("Dynamodb batch write succeeded")
+		}
 	}
 
-	return unprocessedWrites
+	result.add(items, lastKind, lastErr)
+	return result
 }
 
-func DistributedBatchWrites(svc *dynamodb.DynamoDB, batchwriteArgs *BatchwriteArgs) *BatchwriteArgs {
+// Writes batches over a bounded pool of workers, stopping in time for the context's deadline
+// Only writes which truly couldn't be written are reported as unprocessed
+// Fails once any call is aborted, with whatever wasn't written left unprocessed
+func DistributedBatchWrites(ctx context.Context, svc storage.Storage, batchwriteArgs *BatchwriteArgs) (*BatchWriteResult, error) {
 	if batchwriteArgs.MaxBatchSize < 1 || batchwriteArgs.MaxBatchSize > AWSMaxBatchSize {
-		log.Info().Str("table_name", batchwriteArgs.TableName).Int("max_batch_size", batchwriteArgs.MaxBatchSize).Msg("Batch writes attempted with invalid max batch size")
-		batchwriteArgs.MaxBatchSize = AWSMaxBatchSize
+		log.Ctx(ctx).Info().Str("table_name", batchwriteArgs.TableName).Int("max_batch_size", batchwriteArgs.MaxBatchSize).Msg("Batch writes attempted with invalid max batch size")
+		batchwriteArgs.MaxBatchSize = svc.Config().MaxBatchSize
+	}
+	if batchwriteArgs.Concurrency < 1 {
+		batchwriteArgs.Concurrency = DefaultBatchConcurrency
+	}
+
+	// Writing stops short of the deadline, leaving time to hand back what's left
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-DeadlineMargin))
+		defer cancel()
 	}
 
+	// Batches still to go are abandoned once one is aborted, since they would fail the same way
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
+
 	var waitGroup sync.WaitGroup
-	channel := make(chan []*dynamodb.WriteRequest)
+	batches := make(chan []*dynamodb.WriteRequest)
+	channel := make(chan *BatchWriteResult)
 
-	// Process each batch in separate threads
-	for start := 0; start < len(batchwriteArgs.WriteRequests); start += batchwriteArgs.MaxBatchSize {
+	// Workers take batches until there are none left
+	for worker := 0; worker < batchwriteArgs.Concurrency; worker++ {
 		waitGroup.Add(1)
 
-		go func(start int) {
+		go func() {
 			defer waitGroup.Done()
 
-			end := min(start+batchwriteArgs.MaxBatchSize, len(batchwriteArgs.WriteRequests))
-			channel <- BatchWrite(svc, batchwriteArgs.TableName, batchwriteArgs.WriteRequests[start:end])
-		}(start)
+			for batch := range batches {
+				channel <- BatchWrite(ctx, svc, batchwriteArgs.TableName, batch)
+			}
+		}()
 	}
 
+	go func() {
+		for start := 0; start < len(batchwriteArgs.WriteRequests); start += batchwriteArgs.MaxBatchSize {
+			end := min(start+batchwriteArgs.MaxBatchSize, len(batchwriteArgs.WriteRequests))
+			batches <- batchwriteArgs.WriteRequests[start:end]
+		}
+		close(batches)
+	}()
+
 	// Waiting thread to close the channel
 	// Once all batches have been tried
 	go func() {
@@ -65,15 +324,14 @@ func DistributedBatchWrites(svc *dynamodb.DynamoDB, batchwriteArgs *BatchwriteAr
 		close(channel)
 	}()
 
-	// Read from the channel concatenating unprocessed writes
-	unprocessedWrites := []*dynamodb.WriteRequest{}
-	for unprocessedWriteBatch := range channel {
-		unprocessedWrites = append(unprocessedWrites, unprocessedWriteBatch...)
+	// Read from the channel combining the results of every batch
+	result := newBatchWriteResult(batchwriteArgs.TableName)
+	for batchResult := range channel {
+		if batchResult.Err() != nil {
+			abort()
+		}
+		result.merge(batchResult)
 	}
 
-	return &BatchwriteArgs{
-		TableName:     batchwriteArgs.TableName,
-		WriteRequests: unprocessedWrites,
-		MaxBatchSize:  batchwriteArgs.MaxBatchSize,
-	}
+	return result, result.Err()
 }
@@ -0,0 +1,225 @@
+package dynamo_wrapper
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+// Throttles or leaves items unprocessed on the first calls, tracking how many run at once
+type flakyStorage struct {
+	storage.Storage
+	mutex       sync.Mutex
+	throttles   int
+	unprocessed int
+	running     int
+	maxRunning  int
+}
+
+func (flaky *flakyStorage) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	flaky.mutex.Lock()
+	flaky.running++
+	flaky.maxRunning = max(flaky.maxRunning, flaky.running)
+	throttle := flaky.throttles > 0
+	if throttle {
+		flaky.throttles--
+	}
+	skip := flaky.unprocessed > 0
+	if skip {
+		flaky.unprocessed--
+	}
+	flaky.mutex.Unlock()
+
+	defer func() {
+		flaky.mutex.Lock()
+		flaky.running--
+		flaky.mutex.Unlock()
+	}()
+	time.Sleep(time.Millisecond)
+
+	if throttle {
+		return nil, awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil)
+	}
+
+	if skip {
+		// Write all but the last item of each table
+		unprocessedItems := map[string][]*dynamodb.WriteRequest{}
+		for tableName, writeRequests := range input.RequestItems {
+			last := len(writeRequests) - 1
+			unprocessedItems[tableName] = writeRequests[last:]
+			input.RequestItems[tableName] = writeRequests[:last]
+		}
+
+		output, err := flaky.Storage.BatchWriteItemWithContext(ctx, input, opts...)
+		if err != nil {
+			return nil, err
+		}
+		output.UnprocessedItems = unprocessedItems
+		return output, nil
+	}
+
+	return flaky.Storage.BatchWriteItemWithContext(ctx, input, opts...)
+}
+
+// Fails every batch write with the same error
+type failingStorage struct {
+	storage.Storage
+	err error
+}
+
+func (failing *failingStorage) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	return nil, failing.err
+}
+
+func randomWrites(count int) []*dynamodb.WriteRequest {
+	writeRequests := []*dynamodb.WriteRequest{}
+	for i := 0; i < count; i++ {
+		writeRequests = append(writeRequests, &dynamodb.WriteRequest{
+			PutRequest: &dynamodb.PutRequest{Item: map[string]*dynamodb.AttributeValue{
+				"pk": {S: aws.String("vn#username")},
+				"sk": {S: aws.String(strconv.Itoa(i))},
+			}},
+		})
+	}
+	return writeRequests
+}
+
+func TestRetriedBatchWrites(t *testing.T) {
+	flaky := &flakyStorage{Storage: storage.NewMemoryStorage(config.Defaults()), throttles: 3, unprocessed: 3}
+
+	output, writeErr := DistributedBatchWrites(context.Background(), flaky, &BatchwriteArgs{
+		TableName:     "media",
+		WriteRequests: randomWrites(200),
+		MaxBatchSize:  AWSMaxBatchSize,
+		Concurrency:   2,
+	})
+	assert.NoError(t, writeErr)
+
+	assert.True(t, output.Complete())
+	assert.LessOrEqual(t, flaky.maxRunning, 2)
+}
+
+func TestBatchWriteDeadline(t *testing.T) {
+	flaky := &flakyStorage{Storage: storage.NewMemoryStorage(config.Defaults()), throttles: 1000}
+	writeRequests := randomWrites(60)
+
+	ctx, cancel := context.WithTimeout(context.Background(), DeadlineMargin+100*time.Millisecond)
+	defer cancel()
+
+	output, writeErr := DistributedBatchWrites(ctx, flaky, &BatchwriteArgs{
+		TableName:     "media",
+		WriteRequests: writeRequests,
+		MaxBatchSize:  AWSMaxBatchSize,
+	})
+	assert.NoError(t, writeErr)
+
+	assert.ElementsMatch(t, writeRequests, output.UnprocessedWrites())
+	assert.Empty(t, output.Failed)
+}
+
+func TestCancelledBatchWrites(t *testing.T) {
+	memory := storage.NewMemoryStorage(config.Defaults())
+	writeRequests := randomWrites(60)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	output, writeErr := DistributedBatchWrites(ctx, memory, &BatchwriteArgs{
+		TableName:     "media",
+		WriteRequests: writeRequests,
+		MaxBatchSize:  AWSMaxBatchSize,
+	})
+	assert.NoError(t, writeErr)
+
+	assert.Empty(t, output.Succeeded)
+	assert.ElementsMatch(t, writeRequests, output.UnprocessedWrites())
+}
+
+func TestPoisonWrites(t *testing.T) {
+	memory := storage.NewMemoryStorage(config.Defaults())
+	writeRequests := randomWrites(60)
+
+	// Items missing their sort key are rejected, failing every batch they're in
+	poisoned := []*dynamodb.WriteRequest{writeRequests[3], writeRequests[41]}
+	for _, writeRequest := range poisoned {
+		delete(writeRequest.PutRequest.Item, "sk")
+	}
+
+	output, writeErr := DistributedBatchWrites(context.Background(), memory, &BatchwriteArgs{
+		TableName:     "media",
+		WriteRequests: writeRequests,
+		MaxBatchSize:  AWSMaxBatchSize,
+	})
+	assert.NoError(t, writeErr)
+
+	assert.Len(t, output.Succeeded, len(writeRequests)-len(poisoned))
+	assert.Empty(t, output.Unprocessed)
+	assert.Len(t, output.Failed, len(poisoned))
+	for _, failure := range output.Failed {
+		assert.Contains(t, poisoned, failure.WriteRequest)
+		assert.Equal(t, WriteInvalid, failure.Kind)
+		assert.False(t, failure.Kind.Retryable())
+	}
+
+	assert.NoError(t, PutDeadLetters(context.Background(), memory, output))
+
+	deadLetters, queryErr := memory.QueryWithContext(context.Background(), &dynamodb.QueryInput{
+		TableName:              aws.String("dead_letters"),
+		KeyConditionExpression: aws.String("table_name = :table_name"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":table_name": {S: aws.String("media")},
+		},
+	})
+	assert.NoError(t, queryErr)
+	assert.Len(t, deadLetters.Items, len(poisoned))
+}
+
+func TestClassifyError(t *testing.T) {
+	kinds := map[string]WriteFailureKind{
+		dynamodb.ErrCodeProvisionedThroughputExceededException:   WriteThrottled,
+		dynamodb.ErrCodeInternalServerError:                      WriteTransient,
+		"ValidationException":                                    WriteInvalid,
+		dynamodb.ErrCodeItemCollectionSizeLimitExceededException: WriteRejected,
+		"AccessDeniedException":                                  WriteAborted,
+		dynamodb.ErrCodeResourceNotFoundException:                WriteAborted,
+		"ExpiredTokenException":                                  WriteAborted,
+		"UnrecognizedClientException":                            WriteAborted,
+	}
+
+	for code, kind := range kinds {
+		statusCode := 400
+		if code == dynamodb.ErrCodeInternalServerError {
+			statusCode = 500
+		}
+		assert.Equal(t, kind, classifyError(awserr.NewRequestFailure(awserr.New(code, "error", nil), statusCode, "")), code)
+	}
+}
+
+func TestAbortedBatchWrites(t *testing.T) {
+	for _, code := range []string{"AccessDeniedException", dynamodb.ErrCodeResourceNotFoundException, "ExpiredTokenException"} {
+		failing := &failingStorage{Storage: storage.NewMemoryStorage(config.Defaults()), err: awserr.New(code, "error", nil)}
+		writeRequests := randomWrites(60)
+
+		output, writeErr := DistributedBatchWrites(context.Background(), failing, &BatchwriteArgs{
+			TableName:     "media",
+			WriteRequests: writeRequests,
+			MaxBatchSize:  10,
+		})
+
+		// Nothing is set aside as a dead letter, the caller retries everything once the table or credentials are fixed
+		assert.ErrorIs(t, writeErr, failing.err, code)
+		assert.Empty(t, output.Succeeded, code)
+		assert.Empty(t, output.Failed, code)
+		assert.ElementsMatch(t, writeRequests, output.UnprocessedWrites(), code)
+	}
+}
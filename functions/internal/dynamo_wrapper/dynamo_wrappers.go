@@ -1,9 +1,12 @@
 package dynamo_wrapper
 
 import (
+	"context"
 	"reflect"
-	"strings"
 
+	// Loggers taken from contexts fall back to the global logger
+	_ "github.com/KamWithK/exSTATic-backend/internal/logging"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
@@ -21,9 +24,10 @@ type BatchwriteArgs struct {
 	TableName     string                   `json:"table_name"`
 	WriteRequests []*dynamodb.WriteRequest `json:"write_requests"`
 	MaxBatchSize  int                      `json:"max_batch_size" default:"25"`
+	Concurrency   int                      `json:"concurrency" default:"8"`
 }
 
-func GetCompositeKey(pk interface{}, sk interface{}) (map[string]*dynamodb.AttributeValue, error) {
+func GetCompositeKey(ctx context.Context, pk interface{}, sk interface{}) (map[string]*dynamodb.AttributeValue, error) {
 	var compositeKey = CompositeKey{
 		PK: pk,
 		SK: sk,
@@ -31,13 +35,29 @@ func GetCompositeKey(pk interface{}, sk interface{}) (map[string]*dynamodb.Attri
 
 	tableKey, keyErr := dynamodbattribute.MarshalMap(compositeKey)
 	if keyErr != nil {
-		log.Error().Err(keyErr).Interface("pk", pk).Interface("sk", sk).Msg("Could not marshal dynamodb key")
+		log.Ctx(ctx).Error().Err(keyErr).Interface("pk", pk).Interface("sk", sk).Msg("Could not marshal dynamodb key")
 		return nil, keyErr
 	}
 
 	return tableKey, nil
 }
 
+func CombineAttributes(firstAttributes map[string]*dynamodb.AttributeValue, secondAttributes map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	combinedAttributes := map[string]*dynamodb.AttributeValue{}
+
+	for k, v := range firstAttributes {
+		combinedAttributes[k] = v
+	}
+	for k, v := range secondAttributes {
+		combinedAttributes[k] = v
+	}
+
+	return combinedAttributes
+}
+
+// Appends a SET action for the attribute unless its value is nil
+//
+// Deprecated: CreateUpdateExpressionAttributes builds whole update expressions from dynamo struct tags instead
 func RemoveNullAttributes(updateExpression *string, expressionAttributeNames map[string]*string, expressionAttributeValues map[string]*dynamodb.AttributeValue, attributeName, jsonAttributeName string, value interface{}) {
 	if value != nil {
 		if len(expressionAttributeNames) > 0 {
@@ -50,88 +70,79 @@ func RemoveNullAttributes(updateExpression *string, expressionAttributeNames map
 	}
 }
 
-func CreateUpdateExpressionAttributes(optionArgs interface{}) (string, map[string]*string, map[string]*dynamodb.AttributeValue) {
-	updateExpression := "SET"
-	expressionAttributeNames := map[string]*string{}
-	expressionAttributeValues := map[string]*dynamodb.AttributeValue{}
-
-	valueOfOptionArgs := reflect.ValueOf(optionArgs)
-	typeOfOptionArgs := valueOfOptionArgs.Type()
-
-	for i := 0; i < valueOfOptionArgs.NumField(); i++ {
-		field := valueOfOptionArgs.Field(i)
-		fieldType := typeOfOptionArgs.Field(i)
-
-		if field.Kind() != reflect.Invalid && !field.IsZero() {
-			jsonTag := strings.Split(fieldType.Tag.Get("json"), ",")[0]
-			RemoveNullAttributes(&updateExpression, expressionAttributeNames, expressionAttributeValues, fieldType.Name, jsonTag, field.Interface())
-		}
+// Writes the fields of the table data following their dynamo tags and removes the given attributes
+func CreateUpdateExpressionAttributes(tableData interface{}, removeAttributes ...string) (string, map[string]*string, map[string]*dynamodb.AttributeValue, error) {
+	builder := newUpdateBuilder()
+	if fieldsErr := builder.addFields(reflect.ValueOf(tableData), nil, nil); fieldsErr != nil {
+		return "", nil, nil, fieldsErr
 	}
+	builder.removeAttributes(removeAttributes)
 
-	return updateExpression, expressionAttributeNames, expressionAttributeValues
-}
-
-func CombineAttributes(firstAttributes map[string]*dynamodb.AttributeValue, secondAttributes map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
-	combinedAttributes := map[string]*dynamodb.AttributeValue{}
-
-	for k, v := range firstAttributes {
-		combinedAttributes[k] = v
+	// Dynamodb rejects empty placeholder maps, which happens when only removing attributes
+	names, values := builder.names, builder.values
+	if len(names) == 0 {
+		names = nil
 	}
-	for k, v := range secondAttributes {
-		combinedAttributes[k] = v
+	if len(values) == 0 {
+		values = nil
 	}
 
-	return combinedAttributes
+	return builder.expression(), names, values, nil
 }
 
-func UpdateItem(svc *dynamodb.DynamoDB, tableName string, tableKey map[string]*dynamodb.AttributeValue, tableData interface{}) (*dynamodb.UpdateItemOutput, error) {
+func UpdateItem(ctx context.Context, svc storage.Storage, tableName string, tableKey map[string]*dynamodb.AttributeValue, tableData interface{}, removeAttributes ...string) (*dynamodb.UpdateItemOutput, error) {
 	// Get dynamodb query information
-	updateExpression, expressionAttributeNames, expressionAttributeValues := CreateUpdateExpressionAttributes(tableData)
+	updateExpression, expressionAttributeNames, expressionAttributeValues, expressionErr := CreateUpdateExpressionAttributes(tableData, removeAttributes...)
+	if expressionErr != nil {
+		log.Ctx(ctx).Error().Err(expressionErr).Str("table_name", tableName).Interface("item", tableData).Msg("Could not build update expression")
+		return nil, expressionErr
+	}
 
 	// Put item
-	updateItem, updateErr := svc.UpdateItem(&dynamodb.UpdateItemInput{
+	updateItem, updateErr := svc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
 		TableName:                 aws.String(tableName),
 		Key:                       tableKey,
 		UpdateExpression:          aws.String(updateExpression),
 		ExpressionAttributeNames:  expressionAttributeNames,
 		ExpressionAttributeValues: expressionAttributeValues,
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
 	})
 	if updateErr != nil {
-		log.Error().Err(updateErr).Str("table_name", tableName).Interface("table_key", tableKey).Interface("item", tableData).Msg("Dynamodb update item errored")
+		log.Ctx(ctx).Error().Err(updateErr).Str("table_name", tableName).Interface("table_key", tableKey).Interface("item", tableData).Msg("Dynamodb update item errored")
 		return nil, updateErr
 	}
 
 	return updateItem, nil
 }
 
-func PutItem(svc *dynamodb.DynamoDB, tableName string, tableKey map[string]*dynamodb.AttributeValue, itemData interface{}) (*dynamodb.PutItemOutput, error) {
+func PutItem(ctx context.Context, svc storage.Storage, tableName string, tableKey map[string]*dynamodb.AttributeValue, itemData interface{}) (*dynamodb.PutItemOutput, error) {
 	// Convert item data to DynamoDB attribute values
 	itemAttributes, err := dynamodbattribute.MarshalMap(itemData)
 	if err != nil {
-		log.Error().Err(err).Interface("item", itemData).Msg("Could not marshal dynamodb item")
+		log.Ctx(ctx).Error().Err(err).Interface("item", itemData).Msg("Could not marshal dynamodb item")
 		return nil, err
 	}
 
 	delete(itemAttributes, "key")
 
 	// Put the item
-	putItem, putErr := svc.PutItem(&dynamodb.PutItemInput{
+	putItem, putErr := svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
 		TableName: aws.String(tableName),
 		Item:      CombineAttributes(tableKey, itemAttributes),
 	})
 	if putErr != nil {
-		log.Error().Err(putErr).Str("table_name", tableName).Interface("table_key", tableKey).Interface("item", itemData).Msg("Dynamodb put item errored")
+		log.Ctx(ctx).Error().Err(putErr).Str("table_name", tableName).Interface("table_key", tableKey).Interface("item", itemData).Msg("Dynamodb put item errored")
 		return nil, putErr
 	}
 
 	return putItem, nil
 }
 
-func PutItemRequest(tableKey map[string]*dynamodb.AttributeValue, itemData interface{}) (*dynamodb.WriteRequest, error) {
+func PutItemRequest(ctx context.Context, tableKey map[string]*dynamodb.AttributeValue, itemData interface{}) (*dynamodb.WriteRequest, error) {
 	// Convert item data to DynamoDB attribute values
 	itemAttributes, err := dynamodbattribute.MarshalMap(itemData)
 	if err != nil {
-		log.Error().Err(err).Interface("item", itemData).Msg("Could not marshal dynamodb item")
+		log.Ctx(ctx).Error().Err(err).Interface("item", itemData).Msg("Could not marshal dynamodb item")
 		return nil, err
 	}
 
@@ -145,13 +156,13 @@ func PutItemRequest(tableKey map[string]*dynamodb.AttributeValue, itemData inter
 	}, nil
 }
 
-func PutRawRequest(pk string, sk string, itemData interface{}) *dynamodb.WriteRequest {
-	tableKey, keyErr := GetCompositeKey(pk, sk)
+func PutRawRequest(ctx context.Context, pk string, sk string, itemData interface{}) *dynamodb.WriteRequest {
+	tableKey, keyErr := GetCompositeKey(ctx, pk, sk)
 	if keyErr != nil {
 		return nil
 	}
 
-	writeRequest, writeErr := PutItemRequest(tableKey, itemData)
+	writeRequest, writeErr := PutItemRequest(ctx, tableKey, itemData)
 
 	if writeErr != nil {
 		return nil
@@ -8,3 +8,10 @@ func min[T constraints.Ordered](a, b T) T {
 	}
 	return b
 }
+
+func max[T constraints.Ordered](a, b T) T {
+	if a > b {
+		return a
+	}
+	return b
+}
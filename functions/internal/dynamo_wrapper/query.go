@@ -0,0 +1,277 @@
+package dynamo_wrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/rs/zerolog/log"
+)
+
+// Returned from an Each callback to stop reading without an error
+var ErrStopIteration = errors.New("stop iteration")
+
+var sortComparators = map[string]bool{"=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// Builds up a query one condition at a time, reading every page of results when run
+type Query struct {
+	tableName      string
+	indexName      *string
+	partition      string
+	sortKey        string
+	filters        []string
+	projection     []string
+	names          map[string]*string
+	values         map[string]*dynamodb.AttributeValue
+	scanForward    bool
+	consistentRead bool
+	limit          int
+	pageSize       int64
+	err            error
+}
+
+func NewQuery(tableName string) *Query {
+	return &Query{
+		tableName:   tableName,
+		names:       map[string]*string{},
+		values:      map[string]*dynamodb.AttributeValue{},
+		scanForward: true,
+	}
+}
+
+func (query *Query) fail(err error) *Query {
+	if query.err == nil {
+		query.err = err
+	}
+	return query
+}
+
+func (query *Query) value(placeholder string, value interface{}) string {
+	attributeValue, marshalErr := dynamodbattribute.Marshal(value)
+	if marshalErr != nil {
+		query.fail(marshalErr)
+	}
+	query.values[placeholder] = attributeValue
+	return placeholder
+}
+
+func (query *Query) name(placeholder string, attribute string) string {
+	query.names[placeholder] = aws.String(attribute)
+	return placeholder
+}
+
+// Reads from a secondary index rather than the table itself
+func (query *Query) Index(indexName string) *Query {
+	query.indexName = aws.String(indexName)
+	return query
+}
+
+// Every query needs the partition key to equal a single value
+func (query *Query) Partition(attribute string, value interface{}) *Query {
+	query.partition = query.name("#partition", attribute) + " = " + query.value(":partition", value)
+	return query
+}
+
+func (query *Query) setSortKey(condition string) *Query {
+	if query.sortKey != "" {
+		return query.fail(errors.New("query already has a sort key condition"))
+	}
+	query.sortKey = condition
+	return query
+}
+
+// Compares the sort key using =, <, <=, > or >=
+func (query *Query) SortCompare(attribute string, comparator string, value interface{}) *Query {
+	if !sortComparators[comparator] {
+		return query.fail(fmt.Errorf("unknown sort key comparator %q", comparator))
+	}
+	return query.setSortKey(query.name("#sort", attribute) + " " + comparator + " " + query.value(":sort", value))
+}
+
+func (query *Query) SortBeginsWith(attribute string, prefix string) *Query {
+	return query.setSortKey("begins_with(" + query.name("#sort", attribute) + ", " + query.value(":sort", prefix) + ")")
+}
+
+// Both ends of the range are inclusive
+func (query *Query) SortBetween(attribute string, start interface{}, end interface{}) *Query {
+	return query.setSortKey(query.name("#sort", attribute) + " BETWEEN " + query.value(":sort_start", start) + " AND " + query.value(":sort_end", end))
+}
+
+// Drops items not meeting the condition after they're read, filters given one after another must all hold
+func (query *Query) Filter(condition Expression) *Query {
+	names, values, mergeErr := mergePlaceholders(query.names, query.values, condition)
+	if mergeErr != nil {
+		return query.fail(mergeErr)
+	}
+
+	query.names, query.values = names, values
+	query.filters = append(query.filters, "("+condition.Expression+")")
+	return query
+}
+
+// Only reads the given attributes of each item
+func (query *Query) Project(attributes ...string) *Query {
+	for _, attribute := range attributes {
+		query.projection = append(query.projection, query.name(fmt.Sprintf("#projection%d", len(query.projection)), attribute))
+	}
+	return query
+}
+
+// Reads items in descending sort key order
+func (query *Query) Reverse() *Query {
+	query.scanForward = false
+	return query
+}
+
+func (query *Query) ConsistentRead() *Query {
+	query.consistentRead = true
+	return query
+}
+
+// Stops once this many items have been read, after filtering
+func (query *Query) Limit(limit int) *Query {
+	query.limit = limit
+	return query
+}
+
+// How many items dynamodb evaluates per request, before filtering
+func (query *Query) PageSize(pageSize int64) *Query {
+	query.pageSize = pageSize
+	return query
+}
+
+func (query *Query) Input() (*dynamodb.QueryInput, error) {
+	if query.err != nil {
+		return nil, query.err
+	}
+	if query.partition == "" {
+		return nil, errors.New("query has no partition key condition")
+	}
+
+	keyCondition := query.partition
+	if query.sortKey != "" {
+		keyCondition += " AND " + query.sortKey
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(query.tableName),
+		IndexName:                query.indexName,
+		KeyConditionExpression:   aws.String(keyCondition),
+		ExpressionAttributeNames: query.names,
+		ScanIndexForward:         aws.Bool(query.scanForward),
+		ConsistentRead:           aws.Bool(query.consistentRead),
+	}
+	if len(query.values) > 0 {
+		input.ExpressionAttributeValues = query.values
+	}
+	if len(query.filters) > 0 {
+		input.FilterExpression = aws.String(strings.Join(query.filters, " AND "))
+	}
+	if len(query.projection) > 0 {
+		input.ProjectionExpression = aws.String(strings.Join(query.projection, ", "))
+	}
+	if query.pageSize > 0 {
+		input.Limit = aws.Int64(query.pageSize)
+	}
+
+	return input, nil
+}
+
+// Steps through the results of a query, requesting the next page only once the last is used up
+//
+//	iterator := query.Iterate(ctx, svc)
+//	for iterator.Next() {
+//		item := iterator.Item()
+//	}
+//	err := iterator.Err()
+type QueryIterator struct {
+	ctx      context.Context
+	svc      storage.Storage
+	input    *dynamodb.QueryInput
+	limit    int
+	page     []map[string]*dynamodb.AttributeValue
+	index    int
+	read     int
+	lastPage bool
+	item     map[string]*dynamodb.AttributeValue
+	err      error
+}
+
+func (query *Query) Iterate(ctx context.Context, svc storage.Storage) *QueryIterator {
+	input, inputErr := query.Input()
+	return &QueryIterator{
+		ctx:      ctx,
+		svc:      svc,
+		input:    input,
+		limit:    query.limit,
+		lastPage: inputErr != nil,
+		err:      inputErr,
+	}
+}
+
+func (iterator *QueryIterator) Next() bool {
+	if iterator.err != nil || (iterator.limit > 0 && iterator.read >= iterator.limit) {
+		return false
+	}
+
+	// Pages can come back empty when everything on them was filtered out
+	for iterator.index >= len(iterator.page) {
+		if iterator.lastPage {
+			return false
+		}
+
+		output, queryErr := iterator.svc.QueryWithContext(iterator.ctx, iterator.input)
+		if queryErr != nil {
+			log.Ctx(iterator.ctx).Error().Err(queryErr).Str("table", *iterator.input.TableName).Str("key_condition", *iterator.input.KeyConditionExpression).Msg("Dynamodb query failed")
+			iterator.err = queryErr
+			return false
+		}
+
+		iterator.page, iterator.index = output.Items, 0
+		iterator.lastPage = len(output.LastEvaluatedKey) == 0
+		iterator.input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+
+	iterator.item = iterator.page[iterator.index]
+	iterator.index++
+	iterator.read++
+	return true
+}
+
+func (iterator *QueryIterator) Item() map[string]*dynamodb.AttributeValue {
+	return iterator.item
+}
+
+func (iterator *QueryIterator) Err() error {
+	return iterator.err
+}
+
+// Calls back with every item read until the results run out, the callback errors or returns ErrStopIteration
+func (query *Query) Each(ctx context.Context, svc storage.Storage, callback func(item map[string]*dynamodb.AttributeValue) error) error {
+	iterator := query.Iterate(ctx, svc)
+	for iterator.Next() {
+		if callbackErr := callback(iterator.Item()); errors.Is(callbackErr, ErrStopIteration) {
+			return nil
+		} else if callbackErr != nil {
+			return callbackErr
+		}
+	}
+	return iterator.Err()
+}
+
+func (query *Query) All(ctx context.Context, svc storage.Storage) ([]map[string]*dynamodb.AttributeValue, error) {
+	items := []map[string]*dynamodb.AttributeValue{}
+	eachErr := query.Each(ctx, svc, func(item map[string]*dynamodb.AttributeValue) error {
+		items = append(items, item)
+		return nil
+	})
+	if eachErr != nil {
+		return nil, eachErr
+	}
+	return items, nil
+}
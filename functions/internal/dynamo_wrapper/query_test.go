@@ -0,0 +1,113 @@
+package dynamo_wrapper
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+// Puts media items with sort keys sk0 up to sk9, odd ones are marked as hidden
+func putQueryItems(t *testing.T, svc storage.Storage) {
+	for index := 0; index < 10; index++ {
+		_, putErr := PutItem(context.Background(), svc, "media", mediaKey(fmt.Sprintf("sk%d", index)), map[string]interface{}{
+			"hidden":      index%2 == 1,
+			"last_update": index,
+		})
+		assert.NoError(t, putErr)
+	}
+}
+
+func sortKeys(items []map[string]*dynamodb.AttributeValue) []string {
+	keys := []string{}
+	for _, item := range items {
+		keys = append(keys, *item["sk"].S)
+	}
+	return keys
+}
+
+func TestQuery(t *testing.T) {
+	memory := storage.NewMemoryStorage(config.Defaults())
+	putQueryItems(t, memory)
+
+	// Every page is read, however small they are
+	items, queryErr := NewQuery("media").Partition("pk", "vn#username").PageSize(3).All(context.Background(), memory)
+	assert.NoError(t, queryErr)
+	assert.Len(t, items, 10)
+
+	items, queryErr = NewQuery("media").
+		Partition("pk", "vn#username").
+		SortBetween("sk", "sk2", "sk7").
+		Filter(Expression{
+			Expression: "#hidden = :hidden",
+			Names:      map[string]*string{"#hidden": aws.String("hidden")},
+			Values:     map[string]*dynamodb.AttributeValue{":hidden": {BOOL: aws.Bool(false)}},
+		}).
+		Project("sk").
+		Reverse().
+		PageSize(2).
+		All(context.Background(), memory)
+	assert.NoError(t, queryErr)
+	assert.Equal(t, []string{"sk6", "sk4", "sk2"}, sortKeys(items))
+	assert.Nil(t, items[0]["hidden"])
+
+	// Limits count items left after filtering
+	items, queryErr = NewQuery("media").
+		Partition("pk", "vn#username").
+		SortBeginsWith("sk", "sk").
+		Filter(Expression{Expression: "attribute_exists(last_update)"}).
+		Limit(4).
+		PageSize(3).
+		All(context.Background(), memory)
+	assert.NoError(t, queryErr)
+	assert.Equal(t, []string{"sk0", "sk1", "sk2", "sk3"}, sortKeys(items))
+
+	items, queryErr = NewQuery("media").Index("lastUpdatedIndex").Partition("pk", "vn#username").SortCompare("last_update", ">", 7).All(context.Background(), memory)
+	assert.NoError(t, queryErr)
+	assert.Equal(t, []string{"sk8", "sk9"}, sortKeys(items))
+}
+
+func TestQueryIterator(t *testing.T) {
+	memory := storage.NewMemoryStorage(config.Defaults())
+	putQueryItems(t, memory)
+
+	read := []string{}
+	eachErr := NewQuery("media").Partition("pk", "vn#username").PageSize(4).Each(context.Background(), memory, func(item map[string]*dynamodb.AttributeValue) error {
+		read = append(read, *item["sk"].S)
+		if len(read) == 3 {
+			return ErrStopIteration
+		}
+		return nil
+	})
+	assert.NoError(t, eachErr)
+	assert.Equal(t, []string{"sk0", "sk1", "sk2"}, read)
+
+	iterator := NewQuery("media").Partition("pk", "vn#missing").Iterate(context.Background(), memory)
+	assert.False(t, iterator.Next())
+	assert.NoError(t, iterator.Err())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, queryErr := NewQuery("media").Partition("pk", "vn#username").All(ctx, memory)
+	assert.Error(t, queryErr)
+}
+
+func TestInvalidQuery(t *testing.T) {
+	_, inputErr := NewQuery("media").Partition("pk", "vn#username").SortCompare("sk", "<>", "sk").Input()
+	assert.Error(t, inputErr)
+
+	_, inputErr = NewQuery("media").Partition("pk", "vn#username").SortBeginsWith("sk", "a").SortBeginsWith("sk", "b").Input()
+	assert.Error(t, inputErr)
+
+	_, inputErr = NewQuery("media").SortBeginsWith("sk", "a").Input()
+	assert.Error(t, inputErr)
+
+	iterator := NewQuery("media").Iterate(context.Background(), storage.NewMemoryStorage(config.Defaults()))
+	assert.False(t, iterator.Next())
+	assert.Error(t, iterator.Err())
+}
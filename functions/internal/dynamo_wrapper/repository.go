@@ -0,0 +1,172 @@
+package dynamo_wrapper
+
+import (
+	"context"
+	"errors"
+
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/rs/zerolog/log"
+)
+
+// Returned whenever an item isn't in a table, domain packages wrap it with what was missing
+var ErrNotFound = errors.New("not found")
+
+// Typed access to a single table, turning keys of type K into table keys and items into values of type V
+type Repository[K any, V any] struct {
+	svc       storage.Storage
+	tableName string
+	tableKey  func(key K) (map[string]*dynamodb.AttributeValue, error)
+
+	// Reads see every write which finished before them
+	ConsistentRead bool
+	// Items treated as though they aren't there, such as tombstones
+	Hidden func(item map[string]*dynamodb.AttributeValue) bool
+	// Brings items stored in an older shape up to date before they're unmarshalled
+	Upgrade func(ctx context.Context, item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error)
+}
+
+func NewRepository[K any, V any](svc storage.Storage, tableName string, tableKey func(key K) (map[string]*dynamodb.AttributeValue, error)) *Repository[K, V] {
+	return &Repository[K, V]{
+		svc:       svc,
+		tableName: tableName,
+		tableKey:  tableKey,
+	}
+}
+
+// For keys whose fields are exactly the key attributes of the table
+func MarshalKey[K any](key K) (map[string]*dynamodb.AttributeValue, error) {
+	return dynamodbattribute.MarshalMap(key)
+}
+
+func (repository *Repository[K, V]) TableKey(ctx context.Context, key K) (map[string]*dynamodb.AttributeValue, error) {
+	tableKey, keyErr := repository.tableKey(key)
+	if keyErr != nil {
+		log.Ctx(ctx).Error().Err(keyErr).Str("table", repository.tableName).Interface("key", key).Msg("Could not marshal dynamodb key")
+		return nil, keyErr
+	}
+	return tableKey, nil
+}
+
+func (repository *Repository[K, V]) found(item map[string]*dynamodb.AttributeValue) bool {
+	return len(item) > 0 && (repository.Hidden == nil || !repository.Hidden(item))
+}
+
+func (repository *Repository[K, V]) unmarshal(ctx context.Context, item map[string]*dynamodb.AttributeValue) (*V, error) {
+	if repository.Upgrade != nil {
+		upgradedItem, upgradeErr := repository.Upgrade(ctx, item)
+		if upgradeErr != nil {
+			return nil, upgradeErr
+		}
+		item = upgradedItem
+	}
+
+	var value V
+	if unmarshalErr := dynamodbattribute.UnmarshalMap(item, &value); unmarshalErr != nil {
+		log.Ctx(ctx).Error().Err(unmarshalErr).Str("table", repository.tableName).Interface("item", item).Msg("Could not unmarshal dynamodb item")
+		return nil, unmarshalErr
+	}
+	return &value, nil
+}
+
+// Fails with ErrNotFound when the item isn't there or is hidden
+func (repository *Repository[K, V]) Get(ctx context.Context, key K) (*V, error) {
+	tableKey, keyErr := repository.TableKey(ctx, key)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	result, getErr := repository.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(repository.tableName),
+		Key:            tableKey,
+		ConsistentRead: aws.Bool(repository.ConsistentRead),
+	})
+	if getErr != nil {
+		log.Ctx(ctx).Error().Err(getErr).Str("table", repository.tableName).Interface("key", key).Msg("Dynamodb failed to get item")
+		return nil, getErr
+	}
+
+	if !repository.found(result.Item) {
+		log.Ctx(ctx).Info().Str("table", repository.tableName).Interface("key", key).Msg("Item not in table")
+		return nil, ErrNotFound
+	}
+
+	return repository.unmarshal(ctx, result.Item)
+}
+
+// Replaces the whole item
+func (repository *Repository[K, V]) Put(ctx context.Context, key K, value V) error {
+	tableKey, keyErr := repository.TableKey(ctx, key)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	_, putErr := PutItem(ctx, repository.svc, repository.tableName, tableKey, value)
+	return putErr
+}
+
+// Writes the fields of the value following their dynamo tags, returning every attribute of the updated item
+func (repository *Repository[K, V]) Update(ctx context.Context, key K, value V, removeAttributes ...string) (map[string]*dynamodb.AttributeValue, error) {
+	tableKey, keyErr := repository.TableKey(ctx, key)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	updateOutput, updateErr := UpdateItem(ctx, repository.svc, repository.tableName, tableKey, value, removeAttributes...)
+	if updateErr != nil {
+		return nil, updateErr
+	}
+	return updateOutput.Attributes, nil
+}
+
+func (repository *Repository[K, V]) Delete(ctx context.Context, key K) error {
+	tableKey, keyErr := repository.TableKey(ctx, key)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	_, deleteErr := repository.svc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(repository.tableName),
+		Key:       tableKey,
+	})
+	if deleteErr != nil {
+		log.Ctx(ctx).Error().Err(deleteErr).Str("table", repository.tableName).Interface("key", key).Msg("Dynamodb failed to delete item")
+		return deleteErr
+	}
+
+	return nil
+}
+
+// Starts a query against the table, reading consistently if the repository does
+func (repository *Repository[K, V]) NewQuery() *Query {
+	query := NewQuery(repository.tableName)
+	if repository.ConsistentRead {
+		query.ConsistentRead()
+	}
+	return query
+}
+
+// Reads every visible item the query matches, up to its limit
+func (repository *Repository[K, V]) Query(ctx context.Context, query *Query) ([]V, error) {
+	values := []V{}
+
+	eachErr := query.Each(ctx, repository.svc, func(item map[string]*dynamodb.AttributeValue) error {
+		if !repository.found(item) {
+			return nil
+		}
+
+		value, unmarshalErr := repository.unmarshal(ctx, item)
+		if unmarshalErr != nil {
+			return unmarshalErr
+		}
+		values = append(values, *value)
+		return nil
+	})
+	if eachErr != nil {
+		return nil, eachErr
+	}
+
+	return values, nil
+}
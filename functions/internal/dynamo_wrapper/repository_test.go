@@ -0,0 +1,55 @@
+package dynamo_wrapper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+type repositoryKey struct {
+	Username string `json:"username"`
+	JobID    string `json:"job_id"`
+}
+
+type repositoryItem struct {
+	State   string `json:"state"`
+	Deleted bool   `json:"deleted"`
+}
+
+func TestRepository(t *testing.T) {
+	repository := NewRepository[repositoryKey, repositoryItem](storage.NewMemoryStorage(config.Defaults()), "jobs", MarshalKey[repositoryKey])
+	repository.Hidden = func(item map[string]*dynamodb.AttributeValue) bool {
+		return item["deleted"] != nil && *item["deleted"].BOOL
+	}
+	key := repositoryKey{Username: "username", JobID: "first"}
+
+	_, getErr := repository.Get(context.Background(), key)
+	assert.ErrorIs(t, getErr, ErrNotFound)
+
+	assert.NoError(t, repository.Put(context.Background(), key, repositoryItem{State: "pending"}))
+	attributes, updateErr := repository.Update(context.Background(), key, repositoryItem{State: "done"})
+	assert.NoError(t, updateErr)
+	assert.Equal(t, "done", *attributes["state"].S)
+
+	item, getErr := repository.Get(context.Background(), key)
+	assert.NoError(t, getErr)
+	assert.Equal(t, "done", item.State)
+
+	// Hidden items are left out as though they weren't there
+	hiddenKey := repositoryKey{Username: "username", JobID: "second"}
+	assert.NoError(t, repository.Put(context.Background(), hiddenKey, repositoryItem{State: "done", Deleted: true}))
+	_, getErr = repository.Get(context.Background(), hiddenKey)
+	assert.ErrorIs(t, getErr, ErrNotFound)
+
+	items, queryErr := repository.Query(context.Background(), repository.NewQuery().Partition("username", "username"))
+	assert.NoError(t, queryErr)
+	assert.Equal(t, []repositoryItem{{State: "done"}}, items)
+
+	assert.NoError(t, repository.Delete(context.Background(), key))
+	_, getErr = repository.Get(context.Background(), key)
+	assert.ErrorIs(t, getErr, ErrNotFound)
+}
@@ -0,0 +1,365 @@
+package dynamo_wrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/rs/zerolog/log"
+)
+
+const AWSMaxTransactionSize = 100
+
+var ErrEmptyTransaction = errors.New("transaction has no writes")
+var ErrTransactionTooLarge = errors.New("transaction has too many writes")
+
+// Why dynamodb cancelled a transaction, checked with errors.Is against a TransactionCancelledError
+var (
+	ErrConditionFailed        = errors.New("transaction condition failed")
+	ErrTransactionConflict    = errors.New("transaction conflicted with another request")
+	ErrTransactionThrottled   = errors.New("transaction was throttled")
+	ErrTransactionInvalid     = errors.New("transaction write was invalid")
+	ErrItemCollectionTooLarge = errors.New("item collection size limit exceeded")
+)
+
+var cancellationCodeErrors = map[string]error{
+	"ConditionalCheckFailed":          ErrConditionFailed,
+	"TransactionConflict":             ErrTransactionConflict,
+	"ProvisionedThroughputExceeded":   ErrTransactionThrottled,
+	"ThrottlingError":                 ErrTransactionThrottled,
+	"ValidationError":                 ErrTransactionInvalid,
+	"ItemCollectionSizeLimitExceeded": ErrItemCollectionTooLarge,
+}
+
+// A raw expression along with the placeholders it refers to
+type Expression struct {
+	Expression string
+	Names      map[string]*string
+	Values     map[string]*dynamodb.AttributeValue
+}
+
+// Why a single write of a transaction was cancelled
+type CancellationReason struct {
+	Index     int
+	TableName string
+	Key       map[string]*dynamodb.AttributeValue
+	Code      string
+	Message   string
+	// The item as it was, when asked for on a failed condition
+	Item map[string]*dynamodb.AttributeValue
+}
+
+func (reason CancellationReason) Err() error {
+	if err, exists := cancellationCodeErrors[reason.Code]; exists {
+		return err
+	}
+	return errors.New(strings.ToLower(reason.Code))
+}
+
+// Returned when dynamodb cancels a transaction, holding the reason for every write at fault
+type TransactionCancelledError struct {
+	Reasons []CancellationReason
+}
+
+func (err *TransactionCancelledError) Error() string {
+	reasons := []string{}
+	for _, reason := range err.Reasons {
+		reasons = append(reasons, fmt.Sprintf("%s on %s write %d", reason.Code, reason.TableName, reason.Index))
+	}
+	return "transaction cancelled: " + strings.Join(reasons, ", ")
+}
+
+func (err *TransactionCancelledError) Is(target error) bool {
+	for _, reason := range err.Reasons {
+		if reason.Err() == target {
+			return true
+		}
+	}
+	return false
+}
+
+type transactionOperation int
+
+const (
+	transactionPut transactionOperation = iota
+	transactionUpdate
+	transactionDelete
+	transactionConditionCheck
+)
+
+type transactionWrite struct {
+	operation transactionOperation
+	tableName string
+	tableKey  map[string]*dynamodb.AttributeValue
+	item      map[string]*dynamodb.AttributeValue
+	update    Expression
+	condition *Expression
+}
+
+// Collects writes across tables which succeed or fail together
+type Transaction struct {
+	writes []transactionWrite
+	err    error
+}
+
+func NewTransaction() *Transaction {
+	return &Transaction{}
+}
+
+func (transaction *Transaction) fail(err error) *Transaction {
+	if transaction.err == nil {
+		transaction.err = err
+	}
+	return transaction
+}
+
+// Adds the placeholders of an expression to those already in use, failing on any clash
+func mergePlaceholders(names map[string]*string, values map[string]*dynamodb.AttributeValue, expression Expression) (map[string]*string, map[string]*dynamodb.AttributeValue, error) {
+	if len(expression.Names) > 0 && names == nil {
+		names = map[string]*string{}
+	}
+	for placeholder, name := range expression.Names {
+		if existing, exists := names[placeholder]; exists && *existing != *name {
+			return nil, nil, fmt.Errorf("placeholder %s is already in use", placeholder)
+		}
+		names[placeholder] = name
+	}
+
+	if len(expression.Values) > 0 && values == nil {
+		values = map[string]*dynamodb.AttributeValue{}
+	}
+	for placeholder, value := range expression.Values {
+		if _, exists := values[placeholder]; exists {
+			return nil, nil, fmt.Errorf("placeholder %s is already in use", placeholder)
+		}
+		values[placeholder] = value
+	}
+
+	return names, values, nil
+}
+
+func (write transactionWrite) transactItem() (*dynamodb.TransactWriteItem, error) {
+	names, values, mergeErr := mergePlaceholders(nil, nil, write.update)
+	if mergeErr != nil {
+		return nil, mergeErr
+	}
+
+	var conditionExpression, returnValues *string
+	if write.condition != nil {
+		names, values, mergeErr = mergePlaceholders(names, values, *write.condition)
+		if mergeErr != nil {
+			return nil, mergeErr
+		}
+
+		// The item as it was is handed back when the condition fails
+		conditionExpression = aws.String(write.condition.Expression)
+		returnValues = aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld)
+	}
+
+	switch write.operation {
+	case transactionPut:
+		return &dynamodb.TransactWriteItem{Put: &dynamodb.Put{
+			TableName:                           aws.String(write.tableName),
+			Item:                                write.item,
+			ConditionExpression:                 conditionExpression,
+			ExpressionAttributeNames:            names,
+			ExpressionAttributeValues:           values,
+			ReturnValuesOnConditionCheckFailure: returnValues,
+		}}, nil
+	case transactionUpdate:
+		return &dynamodb.TransactWriteItem{Update: &dynamodb.Update{
+			TableName:                           aws.String(write.tableName),
+			Key:                                 write.tableKey,
+			UpdateExpression:                    aws.String(write.update.Expression),
+			ConditionExpression:                 conditionExpression,
+			ExpressionAttributeNames:            names,
+			ExpressionAttributeValues:           values,
+			ReturnValuesOnConditionCheckFailure: returnValues,
+		}}, nil
+	case transactionDelete:
+		return &dynamodb.TransactWriteItem{Delete: &dynamodb.Delete{
+			TableName:                           aws.String(write.tableName),
+			Key:                                 write.tableKey,
+			ConditionExpression:                 conditionExpression,
+			ExpressionAttributeNames:            names,
+			ExpressionAttributeValues:           values,
+			ReturnValuesOnConditionCheckFailure: returnValues,
+		}}, nil
+	default:
+		return &dynamodb.TransactWriteItem{ConditionCheck: &dynamodb.ConditionCheck{
+			TableName:                           aws.String(write.tableName),
+			Key:                                 write.tableKey,
+			ConditionExpression:                 conditionExpression,
+			ExpressionAttributeNames:            names,
+			ExpressionAttributeValues:           values,
+			ReturnValuesOnConditionCheckFailure: returnValues,
+		}}, nil
+	}
+}
+
+// Puts an item, replacing whatever was there before
+func (transaction *Transaction) Put(tableName string, tableKey map[string]*dynamodb.AttributeValue, itemData interface{}) *Transaction {
+	itemAttributes, marshalErr := dynamodbattribute.MarshalMap(itemData)
+	if marshalErr != nil {
+		return transaction.fail(marshalErr)
+	}
+	delete(itemAttributes, "key")
+
+	transaction.writes = append(transaction.writes, transactionWrite{
+		operation: transactionPut,
+		tableName: tableName,
+		tableKey:  tableKey,
+		item:      CombineAttributes(tableKey, itemAttributes),
+	})
+	return transaction
+}
+
+// Writes the fields of the table data following their dynamo tags and removes the given attributes, like UpdateItem
+func (transaction *Transaction) Update(tableName string, tableKey map[string]*dynamodb.AttributeValue, tableData interface{}, removeAttributes ...string) *Transaction {
+	updateExpression, expressionAttributeNames, expressionAttributeValues, expressionErr := CreateUpdateExpressionAttributes(tableData, removeAttributes...)
+	if expressionErr != nil {
+		return transaction.fail(expressionErr)
+	}
+
+	return transaction.UpdateExpression(tableName, tableKey, Expression{
+		Expression: updateExpression,
+		Names:      expressionAttributeNames,
+		Values:     expressionAttributeValues,
+	})
+}
+
+// Updates an item with a hand written expression, such as adding to counters
+func (transaction *Transaction) UpdateExpression(tableName string, tableKey map[string]*dynamodb.AttributeValue, update Expression) *Transaction {
+	transaction.writes = append(transaction.writes, transactionWrite{
+		operation: transactionUpdate,
+		tableName: tableName,
+		tableKey:  tableKey,
+		update:    update,
+	})
+	return transaction
+}
+
+func (transaction *Transaction) Delete(tableName string, tableKey map[string]*dynamodb.AttributeValue) *Transaction {
+	transaction.writes = append(transaction.writes, transactionWrite{
+		operation: transactionDelete,
+		tableName: tableName,
+		tableKey:  tableKey,
+	})
+	return transaction
+}
+
+// Requires an item to meet a condition without writing to it
+func (transaction *Transaction) ConditionCheck(tableName string, tableKey map[string]*dynamodb.AttributeValue, condition Expression) *Transaction {
+	transaction.writes = append(transaction.writes, transactionWrite{
+		operation: transactionConditionCheck,
+		tableName: tableName,
+		tableKey:  tableKey,
+		condition: &condition,
+	})
+	return transaction
+}
+
+// Only lets the last write through when its item meets the condition
+// Conditions given one after another must all hold
+func (transaction *Transaction) When(condition Expression) *Transaction {
+	if len(transaction.writes) == 0 {
+		return transaction.fail(errors.New("condition given before any write"))
+	}
+	write := &transaction.writes[len(transaction.writes)-1]
+
+	if write.condition != nil {
+		names, values, mergeErr := mergePlaceholders(nil, nil, *write.condition)
+		if mergeErr == nil {
+			names, values, mergeErr = mergePlaceholders(names, values, condition)
+		}
+		if mergeErr != nil {
+			return transaction.fail(mergeErr)
+		}
+
+		condition = Expression{
+			Expression: "(" + write.condition.Expression + ") AND (" + condition.Expression + ")",
+			Names:      names,
+			Values:     values,
+		}
+	}
+
+	write.condition = &condition
+	return transaction
+}
+
+func (transaction *Transaction) cancelledError(cancelledErr *dynamodb.TransactionCanceledException) error {
+	err := &TransactionCancelledError{}
+
+	for i, reason := range cancelledErr.CancellationReasons {
+		if reason == nil || reason.Code == nil || *reason.Code == "None" {
+			continue
+		}
+
+		cancellationReason := CancellationReason{
+			Index: i,
+			Code:  *reason.Code,
+			Item:  reason.Item,
+		}
+		if reason.Message != nil {
+			cancellationReason.Message = *reason.Message
+		}
+		if i < len(transaction.writes) {
+			cancellationReason.TableName = transaction.writes[i].tableName
+			cancellationReason.Key = transaction.writes[i].tableKey
+		}
+
+		err.Reasons = append(err.Reasons, cancellationReason)
+	}
+
+	return err
+}
+
+// Writes everything at once, with cancellations decoded into a TransactionCancelledError
+func (transaction *Transaction) Commit(ctx context.Context, svc storage.Storage) error {
+	if transaction.err != nil {
+		log.Ctx(ctx).Error().Err(transaction.err).Msg("Transaction could not be built")
+		return transaction.err
+	}
+	if len(transaction.writes) == 0 {
+		return ErrEmptyTransaction
+	}
+	if len(transaction.writes) > AWSMaxTransactionSize {
+		log.Ctx(ctx).Error().Err(ErrTransactionTooLarge).Int("writes", len(transaction.writes)).Send()
+		return ErrTransactionTooLarge
+	}
+
+	tableNames := []string{}
+	transactItems := []*dynamodb.TransactWriteItem{}
+	for _, write := range transaction.writes {
+		transactItem, itemErr := write.transactItem()
+		if itemErr != nil {
+			log.Ctx(ctx).Error().Err(itemErr).Str("table_name", write.tableName).Interface("table_key", write.tableKey).Msg("Transaction could not be built")
+			return itemErr
+		}
+
+		tableNames = append(tableNames, write.tableName)
+		transactItems = append(transactItems, transactItem)
+	}
+
+	_, transactErr := svc.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: transactItems,
+	})
+	if transactErr != nil {
+		var cancelledErr *dynamodb.TransactionCanceledException
+		if errors.As(transactErr, &cancelledErr) {
+			err := transaction.cancelledError(cancelledErr)
+			log.Ctx(ctx).Info().Err(err).Strs("tables", tableNames).Msg("Dynamodb transaction cancelled")
+			return err
+		}
+
+		log.Ctx(ctx).Error().Err(transactErr).Strs("tables", tableNames).Msg("Dynamodb transaction errored")
+		return transactErr
+	}
+
+	return nil
+}
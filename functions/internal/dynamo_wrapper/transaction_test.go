@@ -0,0 +1,140 @@
+package dynamo_wrapper
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+type transactionStat struct {
+	TimeRead   int64 `json:"time_read"`
+	LastUpdate int64 `json:"last_update"`
+}
+
+func leaderboardKey(username string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"section":  {S: aws.String("vn#week")},
+		"username": {S: aws.String(username)},
+	}
+}
+
+func addTimeRead(timeRead string) Expression {
+	return Expression{
+		Expression: "ADD time_read :time_read",
+		Values: map[string]*dynamodb.AttributeValue{
+			":time_read": {N: aws.String(timeRead)},
+		},
+	}
+}
+
+func getItem(t *testing.T, svc storage.Storage, tableName string, tableKey map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	output, getErr := svc.GetItemWithContext(context.Background(), &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       tableKey,
+	})
+	assert.NoError(t, getErr)
+	return output.Item
+}
+
+func TestTransaction(t *testing.T) {
+	memory := storage.NewMemoryStorage(config.Defaults())
+	statKey := mediaKey("0000000000000000#identifier")
+	entryKey := mediaKey("identifier")
+
+	commitErr := NewTransaction().
+		Put("media", statKey, transactionStat{TimeRead: 60, LastUpdate: 10}).
+		Update("media", entryKey, transactionStat{LastUpdate: 10}).
+		UpdateExpression("leaderboard", leaderboardKey("username"), addTimeRead("60")).
+		Commit(context.Background(), memory)
+	assert.NoError(t, commitErr)
+
+	assert.Equal(t, "60", *getItem(t, memory, "media", statKey)["time_read"].N)
+	assert.Equal(t, "10", *getItem(t, memory, "media", entryKey)["last_update"].N)
+	assert.Equal(t, "60", *getItem(t, memory, "leaderboard", leaderboardKey("username"))["time_read"].N)
+
+	// Stale updates are turned away, leaving every table as it was
+	commitErr = NewTransaction().
+		Put("media", statKey, transactionStat{TimeRead: 120, LastUpdate: 5}).
+		Update("media", entryKey, transactionStat{LastUpdate: 5}).
+		When(Expression{
+			Expression: "last_update < :last_update",
+			Values: map[string]*dynamodb.AttributeValue{
+				":last_update": {N: aws.String("5")},
+			},
+		}).
+		UpdateExpression("leaderboard", leaderboardKey("username"), addTimeRead("60")).
+		Commit(context.Background(), memory)
+
+	assert.ErrorIs(t, commitErr, ErrConditionFailed)
+	assert.False(t, errors.Is(commitErr, ErrTransactionConflict))
+
+	var cancelledErr *TransactionCancelledError
+	assert.ErrorAs(t, commitErr, &cancelledErr)
+	assert.Len(t, cancelledErr.Reasons, 1)
+	assert.Equal(t, 1, cancelledErr.Reasons[0].Index)
+	assert.Equal(t, "media", cancelledErr.Reasons[0].TableName)
+	assert.Equal(t, entryKey, cancelledErr.Reasons[0].Key)
+	assert.Equal(t, "10", *cancelledErr.Reasons[0].Item["last_update"].N)
+
+	assert.Equal(t, "60", *getItem(t, memory, "media", statKey)["time_read"].N)
+	assert.Equal(t, "60", *getItem(t, memory, "leaderboard", leaderboardKey("username"))["time_read"].N)
+}
+
+func TestConditionCheck(t *testing.T) {
+	memory := storage.NewMemoryStorage(config.Defaults())
+	settingsKey := map[string]*dynamodb.AttributeValue{
+		"username":   {S: aws.String("username")},
+		"media_type": {S: aws.String("vn")},
+	}
+	exists := Expression{Expression: "attribute_exists(username)"}
+
+	commitErr := NewTransaction().
+		ConditionCheck("settings", settingsKey, exists).
+		UpdateExpression("leaderboard", leaderboardKey("username"), addTimeRead("60")).
+		Commit(context.Background(), memory)
+	assert.ErrorIs(t, commitErr, ErrConditionFailed)
+	assert.Nil(t, getItem(t, memory, "leaderboard", leaderboardKey("username")))
+
+	assert.NoError(t, NewTransaction().Put("settings", settingsKey, struct{}{}).Commit(context.Background(), memory))
+
+	commitErr = NewTransaction().
+		ConditionCheck("settings", settingsKey, exists).
+		UpdateExpression("leaderboard", leaderboardKey("username"), addTimeRead("60")).
+		When(Expression{Expression: "attribute_not_exists(time_read)"}).
+		When(Expression{Expression: "attribute_not_exists(chars_read)"}).
+		Commit(context.Background(), memory)
+	assert.NoError(t, commitErr)
+	assert.Equal(t, "60", *getItem(t, memory, "leaderboard", leaderboardKey("username"))["time_read"].N)
+}
+
+func TestInvalidTransactions(t *testing.T) {
+	memory := storage.NewMemoryStorage(config.Defaults())
+
+	assert.ErrorIs(t, NewTransaction().Commit(context.Background(), memory), ErrEmptyTransaction)
+
+	// Placeholders can't mean two different things
+	commitErr := NewTransaction().
+		UpdateExpression("leaderboard", leaderboardKey("username"), addTimeRead("60")).
+		When(Expression{
+			Expression: "time_read < :time_read",
+			Values: map[string]*dynamodb.AttributeValue{
+				":time_read": {N: aws.String("1000")},
+			},
+		}).
+		Commit(context.Background(), memory)
+	assert.Error(t, commitErr)
+
+	// Nor can one item be written twice
+	commitErr = NewTransaction().
+		UpdateExpression("leaderboard", leaderboardKey("username"), addTimeRead("60")).
+		Delete("leaderboard", leaderboardKey("username")).
+		Commit(context.Background(), memory)
+	assert.Error(t, commitErr)
+	assert.NotErrorIs(t, commitErr, ErrConditionFailed)
+}
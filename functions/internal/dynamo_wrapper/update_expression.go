@@ -0,0 +1,212 @@
+package dynamo_wrapper
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Options for how a field is written, given through its dynamo struct tag
+// Untagged fields are set whenever they aren't the zero value
+type updateOptions struct {
+	// Skipped entirely
+	skip bool
+	// Atomically added to the stored number or set rather than replacing it
+	add bool
+	// Removed from the item when nil rather than left untouched
+	removeIfNil bool
+	// Only written when the item doesn't have it yet
+	setIfNotExists bool
+	// Fields of nested structs are written one by one, the parent map must already exist
+	nested bool
+}
+
+func parseUpdateOptions(tag string) (updateOptions, error) {
+	options := updateOptions{}
+	if tag == "" {
+		return options, nil
+	}
+
+	for _, option := range strings.Split(tag, ",") {
+		switch strings.TrimSpace(option) {
+		case "-":
+			options.skip = true
+		case "add":
+			options.add = true
+		case "remove_if_nil":
+			options.removeIfNil = true
+		case "set_if_not_exists":
+			options.setIfNotExists = true
+		case "nested":
+			options.nested = true
+		default:
+			return options, fmt.Errorf("unknown dynamo tag option %q", option)
+		}
+	}
+
+	if options.add && options.setIfNotExists {
+		return options, errors.New("dynamo tag options add and set_if_not_exists can't be combined")
+	}
+	return options, nil
+}
+
+// Collects the clauses of an update expression along with its placeholders
+type updateBuilder struct {
+	setActions    []string
+	removeActions []string
+	addActions    []string
+	names         map[string]*string
+	values        map[string]*dynamodb.AttributeValue
+}
+
+func newUpdateBuilder() *updateBuilder {
+	return &updateBuilder{
+		names:  map[string]*string{},
+		values: map[string]*dynamodb.AttributeValue{},
+	}
+}
+
+// Placeholders are named after the go fields leading to an attribute, which are unique within a struct
+func (builder *updateBuilder) path(fieldNames []string, attributeNames []string) string {
+	elements := make([]string, len(fieldNames))
+	for i := range fieldNames {
+		placeholder := "#" + strings.Join(fieldNames[:i+1], "_")
+		builder.names[placeholder] = aws.String(attributeNames[i])
+		elements[i] = placeholder
+	}
+	return strings.Join(elements, ".")
+}
+
+func (builder *updateBuilder) value(fieldNames []string, value interface{}) (string, error) {
+	attributeValue, marshalErr := dynamodbattribute.Marshal(value)
+	if marshalErr != nil {
+		return "", marshalErr
+	}
+
+	placeholder := ":" + strings.Join(fieldNames, "_")
+	builder.values[placeholder] = attributeValue
+	return placeholder, nil
+}
+
+func (builder *updateBuilder) addFields(value reflect.Value, fieldNames []string, attributeNames []string) error {
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	valueType := value.Type()
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		fieldType := valueType.Field(i)
+
+		// Embedded structs are flattened into the item like when marshalling, even unexported ones
+		if fieldType.Anonymous && reflect.Indirect(field).Kind() == reflect.Struct && fieldType.Tag.Get("json") == "" {
+			if embeddedErr := builder.addFields(field, fieldNames, attributeNames); embeddedErr != nil {
+				return embeddedErr
+			}
+			continue
+		}
+
+		if !fieldType.IsExported() || field.Kind() == reflect.Invalid {
+			continue
+		}
+
+		options, optionsErr := parseUpdateOptions(fieldType.Tag.Get("dynamo"))
+		if optionsErr != nil {
+			return fmt.Errorf("field %s: %w", fieldType.Name, optionsErr)
+		}
+		if options.skip {
+			continue
+		}
+
+		jsonTag := strings.Split(fieldType.Tag.Get("json"), ",")[0]
+		if jsonTag == "-" {
+			continue
+		}
+		if jsonTag == "" {
+			jsonTag = fieldType.Name
+		}
+
+		fieldPath := append(append([]string{}, fieldNames...), fieldType.Name)
+		attributePath := append(append([]string{}, attributeNames...), jsonTag)
+
+		if field.IsZero() {
+			if options.removeIfNil && isNillable(field) {
+				builder.removeActions = append(builder.removeActions, builder.path(fieldPath, attributePath))
+			}
+			continue
+		}
+
+		if options.nested {
+			nestedValue := reflect.Indirect(field)
+			if nestedValue.Kind() != reflect.Struct {
+				return fmt.Errorf("field %s: only structs can be nested", fieldType.Name)
+			}
+			if nestedErr := builder.addFields(nestedValue, fieldPath, attributePath); nestedErr != nil {
+				return nestedErr
+			}
+			continue
+		}
+
+		path := builder.path(fieldPath, attributePath)
+		placeholder, valueErr := builder.value(fieldPath, field.Interface())
+		if valueErr != nil {
+			return valueErr
+		}
+
+		switch {
+		case options.add && len(fieldPath) == 1:
+			builder.addActions = append(builder.addActions, path+" "+placeholder)
+		case options.add:
+			// Dynamodb only adds to top level attributes, so nested numbers are summed in place
+			zeroPlaceholder := placeholder + "_zero"
+			builder.values[zeroPlaceholder] = &dynamodb.AttributeValue{N: aws.String("0")}
+			builder.setActions = append(builder.setActions, path+" = if_not_exists("+path+", "+zeroPlaceholder+") + "+placeholder)
+		case options.setIfNotExists:
+			builder.setActions = append(builder.setActions, path+" = if_not_exists("+path+", "+placeholder+")")
+		default:
+			builder.setActions = append(builder.setActions, path+" = "+placeholder)
+		}
+	}
+
+	return nil
+}
+
+func isNillable(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+		return true
+	default:
+		return false
+	}
+}
+
+// Removes attributes by name regardless of the fields of the table data
+func (builder *updateBuilder) removeAttributes(attributeNames []string) {
+	for i, attributeName := range attributeNames {
+		placeholder := fmt.Sprintf("#remove%d", i)
+		builder.names[placeholder] = aws.String(attributeName)
+		builder.removeActions = append(builder.removeActions, placeholder)
+	}
+}
+
+func (builder *updateBuilder) expression() string {
+	clauses := []string{}
+	if len(builder.setActions) > 0 {
+		clauses = append(clauses, "SET "+strings.Join(builder.setActions, ", "))
+	}
+	if len(builder.removeActions) > 0 {
+		clauses = append(clauses, "REMOVE "+strings.Join(builder.removeActions, ", "))
+	}
+	if len(builder.addActions) > 0 {
+		clauses = append(clauses, "ADD "+strings.Join(builder.addActions, ", "))
+	}
+	return strings.Join(clauses, " ")
+}
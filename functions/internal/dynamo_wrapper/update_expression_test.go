@@ -0,0 +1,110 @@
+package dynamo_wrapper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+type taggedCounts struct {
+	TimeRead  int64 `json:"time_read" dynamo:"add"`
+	CharsRead int64 `json:"chars_read" dynamo:"add"`
+}
+
+type taggedUpdate struct {
+	Ignored    string       `json:"ignored" dynamo:"-"`
+	Name       *string      `json:"name" dynamo:"remove_if_nil"`
+	Created    int64        `json:"created" dynamo:"set_if_not_exists"`
+	Sessions   int64        `json:"sessions" dynamo:"add"`
+	Counts     taggedCounts `json:"counts" dynamo:"nested"`
+	LastUpdate int64        `json:"last_update"`
+}
+
+func TestTaggedUpdates(t *testing.T) {
+	memory := storage.NewMemoryStorage(config.Defaults())
+	key := mediaKey("identifier")
+
+	// Nested fields need their parent map to be there already
+	_, updateErr := UpdateItem(context.Background(), memory, "media", key, taggedUpdate{Counts: taggedCounts{TimeRead: 1}})
+	assert.Error(t, updateErr)
+
+	_, updateErr = UpdateItem(context.Background(), memory, "media", key, struct {
+		Counts map[string]int64 `json:"counts"`
+	}{Counts: map[string]int64{"lines_read": 0}})
+	assert.NoError(t, updateErr)
+
+	for i := int64(1); i <= 2; i++ {
+		output, updateErr := UpdateItem(context.Background(), memory, "media", key, taggedUpdate{
+			Ignored:    "ignored",
+			Name:       aws.String("name"),
+			Created:    i,
+			Sessions:   1,
+			Counts:     taggedCounts{TimeRead: 60, CharsRead: 100},
+			LastUpdate: i,
+		})
+		assert.NoError(t, updateErr)
+
+		attributes := output.Attributes
+		assert.NotContains(t, attributes, "ignored")
+		assert.Equal(t, "name", *attributes["name"].S)
+		assert.Equal(t, "1", *attributes["created"].N)
+		assert.Equal(t, *attributes["last_update"].N, *attributes["sessions"].N)
+		assert.Equal(t, *attributes["last_update"].N+"00", *attributes["counts"].M["chars_read"].N)
+	}
+
+	// Leaving out the name clears it, while counters are left as they are
+	output, updateErr := UpdateItem(context.Background(), memory, "media", key, taggedUpdate{LastUpdate: 3})
+	assert.NoError(t, updateErr)
+	assert.NotContains(t, output.Attributes, "name")
+	assert.Equal(t, "2", *output.Attributes["sessions"].N)
+	assert.Equal(t, "120", *output.Attributes["counts"].M["time_read"].N)
+}
+
+func TestInvalidTags(t *testing.T) {
+	_, _, _, expressionErr := CreateUpdateExpressionAttributes(struct {
+		Count int64 `json:"count" dynamo:"add,set_if_not_exists"`
+	}{Count: 1})
+	assert.Error(t, expressionErr)
+
+	_, _, _, expressionErr = CreateUpdateExpressionAttributes(struct {
+		Count int64 `json:"count" dynamo:"increment"`
+	}{Count: 1})
+	assert.Error(t, expressionErr)
+
+	expression, names, _, expressionErr := CreateUpdateExpressionAttributes(struct {
+		Count int64 `json:"count"`
+	}{Count: 1}, "deleted_at")
+	assert.NoError(t, expressionErr)
+	assert.Equal(t, "SET #Count = :Count REMOVE #remove0", expression)
+	assert.Equal(t, "deleted_at", *names["#remove0"])
+}
+
+func TestEmbeddedUpdates(t *testing.T) {
+	expression, names, values, expressionErr := CreateUpdateExpressionAttributes(struct {
+		taggedCounts
+		LastUpdate int64 `json:"last_update"`
+	}{taggedCounts: taggedCounts{TimeRead: 60}, LastUpdate: 1})
+	assert.NoError(t, expressionErr)
+	assert.Equal(t, "SET #LastUpdate = :LastUpdate ADD #TimeRead :TimeRead", expression)
+	assert.Equal(t, "time_read", *names["#TimeRead"])
+	assert.Equal(t, "60", *values[":TimeRead"].N)
+}
+
+func TestRemoveNullAttributes(t *testing.T) {
+	updateExpression := "SET"
+	names := map[string]*string{}
+	values := map[string]*dynamodb.AttributeValue{}
+
+	RemoveNullAttributes(&updateExpression, names, values, "TimeRead", "time_read", int64(5))
+	RemoveNullAttributes(&updateExpression, names, values, "Name", "name", nil)
+	RemoveNullAttributes(&updateExpression, names, values, "CharsRead", "chars_read", int64(10))
+
+	assert.Equal(t, "SET #TimeRead = :TimeRead, #CharsRead = :CharsRead", updateExpression)
+	assert.Equal(t, map[string]*string{"#TimeRead": aws.String("time_read"), "#CharsRead": aws.String("chars_read")}, names)
+	assert.Equal(t, "10", *values[":CharsRead"].N)
+}
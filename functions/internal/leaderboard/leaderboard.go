@@ -1,5 +1,17 @@
 package leaderboard
 
+import (
+	"strconv"
+	"time"
+
+	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Reading counts towards every period as well as the month it happened in
+const AllTime = "all_time"
+
 type LeaderboardKey struct {
 	Username   string `json:"username" binding:"required"`
 	TimePeriod string `json:"time_period" binding:"required"`
@@ -12,3 +24,64 @@ type LeaderboardEntry struct {
 	TimeRead   int64          `json:"time_read"`
 	CharsRead  int64          `json:"chars_read"`
 }
+
+// Entries are ranked within sections of a media type and period
+func Section(key LeaderboardKey) string {
+	return key.MediaType + "#" + key.TimePeriod
+}
+
+func TableKey(key LeaderboardKey) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"section":  {S: aws.String(Section(key))},
+		"username": {S: aws.String(key.Username)},
+	}
+}
+
+// The periods reading on the given day counts towards
+func TimePeriods(day time.Time) []string {
+	return []string{AllTime, day.Format("2006-01")}
+}
+
+// Adds reading to the totals of an entry as part of a transaction, starting the entry when it's the first
+func AddReading(transaction *dynamo_wrapper.Transaction, tableName string, key LeaderboardKey, timeRead int64, charsRead int64) *dynamo_wrapper.Transaction {
+	return transaction.UpdateExpression(tableName, TableKey(key), dynamo_wrapper.Expression{
+		Expression: "ADD #time_read :time_read, #chars_read :chars_read",
+		Names: map[string]*string{
+			"#time_read":  aws.String("time_read"),
+			"#chars_read": aws.String("chars_read"),
+		},
+		Values: map[string]*dynamodb.AttributeValue{
+			":time_read":  {N: aws.String(strconv.FormatInt(timeRead, 10))},
+			":chars_read": {N: aws.String(strconv.FormatInt(charsRead, 10))},
+		},
+	})
+}
+
+type Reading struct {
+	TimeRead  int64
+	CharsRead int64
+}
+
+// Reading summed per entry, since a transaction can only write to each entry once
+type Totals map[LeaderboardKey]Reading
+
+// Counts reading done on the given day towards each of its periods, negative reading taking it back off
+func (totals Totals) Add(username string, mediaType string, day time.Time, reading Reading) {
+	for _, timePeriod := range TimePeriods(day) {
+		key := LeaderboardKey{Username: username, TimePeriod: timePeriod, MediaType: mediaType}
+		total := totals[key]
+		total.TimeRead += reading.TimeRead
+		total.CharsRead += reading.CharsRead
+		totals[key] = total
+	}
+}
+
+// Adds every total to its entry as part of a transaction, skipping those which come to nothing
+func (totals Totals) Write(transaction *dynamo_wrapper.Transaction, tableName string) *dynamo_wrapper.Transaction {
+	for key, total := range totals {
+		if total != (Reading{}) {
+			AddReading(transaction, tableName, key, total.TimeRead, total.CharsRead)
+		}
+	}
+	return transaction
+}
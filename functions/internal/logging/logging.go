@@ -0,0 +1,28 @@
+package logging
+
+import (
+	"context"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Contexts without a request logger still log through the global one
+func init() {
+	zerolog.DefaultContextLogger = &log.Logger
+}
+
+// Attaches the Lambda request ID and user to everything logged through the returned context
+func WithRequest(ctx context.Context, username string) context.Context {
+	logger := log.Ctx(ctx).With()
+
+	if lambdaContext, ok := lambdacontext.FromContext(ctx); ok {
+		logger = logger.Str("request_id", lambdaContext.AwsRequestID)
+	}
+	if len(username) > 0 {
+		logger = logger.Str("username", username)
+	}
+
+	return logger.Logger().WithContext(ctx)
+}
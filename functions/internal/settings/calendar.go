@@ -0,0 +1,44 @@
+package settings
+
+import (
+	"fmt"
+	"time"
+)
+
+// ISO weeks start on monday like monday weeks, but are labelled by their ISO 8601 year and number
+const (
+	WeekStartISO      = "iso"
+	WeekStartMonday   = "monday"
+	WeekStartSunday   = "sunday"
+	WeekStartSaturday = "saturday"
+)
+
+var weekStartDays = map[string]time.Weekday{
+	WeekStartISO:      time.Monday,
+	WeekStartMonday:   time.Monday,
+	WeekStartSunday:   time.Sunday,
+	WeekStartSaturday: time.Saturday,
+}
+
+// The first day of the week the day falls in, at the same time of day
+func WeekOf(day time.Time, weekStart string) time.Time {
+	offset := (int(day.Weekday()) - int(weekStartDays[weekStart]) + 7) % 7
+	return day.AddDate(0, 0, -offset)
+}
+
+// ISO weeks are labelled like 2024-W09, others by the date they start on
+func WeekLabel(day time.Time, weekStart string) string {
+	if weekStart == WeekStartISO {
+		year, week := day.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}
+	return WeekOf(day, weekStart).Format("2006-01-02")
+}
+
+// Where the user's weeks start, every weekly computation following it
+func (resolved *ResolvedSettings) WeekStart() string {
+	if resolved.Settings.WeekStart == nil {
+		return WeekStartISO
+	}
+	return *resolved.Settings.WeekStart
+}
@@ -0,0 +1,21 @@
+package settings
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeeks(t *testing.T) {
+	// A wednesday, in the first ISO week of 2025
+	day := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, time.Date(2024, time.December, 30, 0, 0, 0, 0, time.UTC), WeekOf(day, WeekStartMonday))
+	assert.Equal(t, time.Date(2024, time.December, 29, 0, 0, 0, 0, time.UTC), WeekOf(day, WeekStartSunday))
+	assert.Equal(t, time.Date(2024, time.December, 28, 0, 0, 0, 0, time.UTC), WeekOf(day, WeekStartSaturday))
+	assert.Equal(t, day.AddDate(0, 0, 3), WeekOf(day.AddDate(0, 0, 3), WeekStartSaturday))
+
+	assert.Equal(t, "2025-W01", WeekLabel(day, WeekStartISO))
+	assert.Equal(t, "2024-12-29", WeekLabel(day, WeekStartSunday))
+}
@@ -0,0 +1,43 @@
+package settings
+
+import (
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Bumped whenever a default changes, so clients can tell the defaults they've seen are out of date
+const DefaultsVersion = 1
+
+// What every media type starts with, so only the settings which depend on where the user lives are ever left unset
+func baseDefaults(cfg *config.Config) UserSettings {
+	return UserSettings{
+		ShowOnLeaderboard:   aws.Bool(false),
+		InterfaceBlurAmount: aws.Float32(0.5),
+		MenuBlurAmount:      aws.Float32(0.5),
+		MaxAFKTime:          aws.Int16(cfg.MaxAFKTime),
+		MaxBlurTime:         aws.Int16(60),
+		MaxLoadLines:        aws.Int16(100),
+		WeekStart:           aws.String(WeekStartISO),
+		Extensions:          extensionDefaults(),
+	}
+}
+
+// Only the fields which differ from the base defaults
+var mediaTypeDefaults = map[string]UserSettings{
+	// Lines come slower when watching, and whole scenes can pass without any
+	"video": {
+		MaxAFKTime:   aws.Int16(300),
+		MaxLoadLines: aws.Int16(200),
+	},
+	// Pages take longer to read than a single line
+	"mokuro": {
+		MaxAFKTime: aws.Int16(180),
+	},
+}
+
+// The complete set of defaults for a media type, an empty one gives the base defaults
+func DefaultProfile(cfg *config.Config, mediaType string) UserSettings {
+	profile := &ResolvedSettings{Settings: baseDefaults(cfg), Sources: map[string]SettingSource{}}
+	profile.overlay(mediaTypeDefaults[mediaType], SourceServerDefault)
+	return profile.Settings
+}
@@ -0,0 +1,178 @@
+package settings
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Extension settings are kept under extensions.<client>.<key>
+const extensionsPrefix = "extensions"
+
+// Most keys one client can keep in a single settings item
+const MaxExtensionKeys = 50
+
+const MaxExtensionKeyLength = 64
+
+var extensionKeyPattern = regexp.MustCompile(fmt.Sprintf("^[a-z0-9_]{1,%d}$", MaxExtensionKeyLength))
+
+type ExtensionType string
+
+const (
+	ExtensionString ExtensionType = "string"
+	ExtensionNumber ExtensionType = "number"
+	ExtensionBool   ExtensionType = "bool"
+	// Any of the above, for clients trying out preferences before they're registered properly
+	ExtensionAny ExtensionType = "any"
+)
+
+// What an extension setting may hold, limits left at their zero value aren't checked
+type ExtensionSetting struct {
+	Type      ExtensionType
+	Min       *float64
+	Max       *float64
+	MaxLength int
+	Options   []string
+	// Given to users who haven't set it, wildcards never have one
+	Default interface{}
+}
+
+func float64Pointer(value float64) *float64 {
+	return &value
+}
+
+// Keyed by client.key, where a key of * allows any key for that client
+var extensionRegistry = map[string]ExtensionSetting{
+	"exstatic.theme":     {Type: ExtensionString, Options: []string{"light", "dark", "system"}, Default: "system"},
+	"exstatic.font_size": {Type: ExtensionNumber, Min: float64Pointer(8), Max: float64Pointer(72)},
+}
+
+// Lets a client keep a setting, replacing whatever was registered under the name before
+func RegisterExtension(name string, setting ExtensionSetting) {
+	extensionRegistry[name] = setting
+}
+
+func extensionName(client string, key string) string {
+	return extensionsPrefix + "." + client + "." + key
+}
+
+func lookupExtension(client string, key string) (ExtensionSetting, bool) {
+	if setting, exists := extensionRegistry[client+"."+key]; exists {
+		return setting, true
+	}
+	setting, exists := extensionRegistry[client+".*"]
+	return setting, exists
+}
+
+// Explains what's wrong with the value, or returns an empty string when it's fine
+func (setting ExtensionSetting) check(value interface{}) string {
+	settingType := setting.Type
+	if settingType == ExtensionAny {
+		switch value.(type) {
+		case string:
+			settingType = ExtensionString
+		case float64:
+			settingType = ExtensionNumber
+		case bool:
+			settingType = ExtensionBool
+		default:
+			return "must be a string, number or bool"
+		}
+	}
+
+	switch settingType {
+	case ExtensionString:
+		text, ok := value.(string)
+		if !ok {
+			return "must be a string"
+		}
+		if setting.MaxLength > 0 && len(text) > setting.MaxLength {
+			return fmt.Sprintf("must be at most %d characters", setting.MaxLength)
+		}
+		if len(setting.Options) > 0 && !contains(setting.Options, text) {
+			return "must be one of " + strings.Join(setting.Options, ", ")
+		}
+	case ExtensionNumber:
+		number, ok := value.(float64)
+		if !ok {
+			return "must be a number"
+		}
+		if setting.Min != nil && number < *setting.Min {
+			return "must be at least " + formatBound(*setting.Min)
+		}
+		if setting.Max != nil && number > *setting.Max {
+			return "must be at most " + formatBound(*setting.Max)
+		}
+	case ExtensionBool:
+		if _, ok := value.(bool); !ok {
+			return "must be a bool"
+		}
+	}
+
+	return ""
+}
+
+func contains(values []string, value string) bool {
+	for _, option := range values {
+		if option == value {
+			return true
+		}
+	}
+	return false
+}
+
+func checkExtensionKeyCount(extensions map[string]map[string]interface{}, validationErr *ValidationError) {
+	for client, values := range extensions {
+		if len(values) > MaxExtensionKeys {
+			validationErr.add(extensionsPrefix+"."+client, "must have at most %d keys", MaxExtensionKeys)
+		}
+	}
+}
+
+// Checks every extension setting given, nil values being removals which are always allowed
+func validateExtensions(extensions map[string]map[string]interface{}, validationErr *ValidationError) {
+	checkExtensionKeyCount(extensions, validationErr)
+
+	for client, values := range extensions {
+		for key, value := range values {
+			// Keys which are no longer registered can still be removed
+			if value == nil {
+				continue
+			}
+			// Wildcards would otherwise let clients make up keys of any shape
+			if !extensionKeyPattern.MatchString(key) {
+				validationErr.add(extensionName(client, key), "must be at most %d lowercase letters, digits or underscores", MaxExtensionKeyLength)
+				continue
+			}
+			setting, registered := lookupExtension(client, key)
+			if !registered {
+				validationErr.add(extensionName(client, key), "isn't a registered setting")
+			} else if reason := setting.check(value); reason != "" {
+				validationErr.add(extensionName(client, key), reason)
+			}
+		}
+	}
+}
+
+// Every registered extension setting with a default, by client then key
+func extensionDefaults() map[string]map[string]interface{} {
+	defaults := map[string]map[string]interface{}{}
+	for name, setting := range extensionRegistry {
+		client, key, _ := strings.Cut(name, ".")
+		if key == "*" || setting.Default == nil {
+			continue
+		}
+		if defaults[client] == nil {
+			defaults[client] = map[string]interface{}{}
+		}
+		defaults[client][key] = setting.Default
+	}
+	return defaults
+}
+
+// Keys kept alongside those already saved have to stay within the limit too
+func validateMergedExtensions(merged map[string]map[string]interface{}) error {
+	validationErr := &ValidationError{}
+	checkExtensionKeyCount(merged, validationErr)
+	return validationErr.err()
+}
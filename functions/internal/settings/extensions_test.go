@@ -0,0 +1,151 @@
+package settings
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtensionSettings(t *testing.T) {
+	RegisterExtension("exstatic.furigana", ExtensionSetting{Type: ExtensionBool})
+	RegisterExtension("exstatic.ruby", ExtensionSetting{Type: ExtensionString, Options: []string{"hover", "always"}})
+	ctx := context.Background()
+	svc := localStorage(t)
+	globalKey := UserSettingsKey{Username: "extensions"}
+	vnKey := UserSettingsKey{Username: "extensions", MediaType: "vn"}
+
+	putUserSettings(t, ctx, svc, UserSettings{
+		Key:        globalKey,
+		Extensions: map[string]map[string]interface{}{"exstatic": {"theme": "dark", "font_size": 16.0}},
+	})
+	putUserSettings(t, ctx, svc, UserSettings{
+		Key:        vnKey,
+		Extensions: map[string]map[string]interface{}{"exstatic": {"font_size": 24.0, "furigana": true}},
+	})
+
+	// Keys are inherited one by one
+	resolved, resolveErr := ResolveUserSettings(ctx, svc, vnKey)
+	assert.NoError(t, resolveErr)
+	assert.Equal(t, map[string]interface{}{"theme": "dark", "font_size": 24.0, "furigana": true}, resolved.Settings.Extensions["exstatic"])
+	assert.Equal(t, SourceGlobal, resolved.Sources["extensions.exstatic.theme"])
+	assert.Equal(t, SourceMediaType, resolved.Sources["extensions.exstatic.font_size"])
+
+	// Saving one key keeps the others, and nil removes a key
+	putUserSettings(t, ctx, svc, UserSettings{
+		Key:        vnKey,
+		Extensions: map[string]map[string]interface{}{"exstatic": {"font_size": nil, "ruby": "hover"}},
+	})
+	vn, getErr := GetUserSettings(ctx, svc, vnKey)
+	assert.NoError(t, getErr)
+	assert.Equal(t, map[string]interface{}{"furigana": true, "ruby": "hover"}, vn.Extensions["exstatic"])
+
+	// Removing every key removes the map, leaving nothing saved
+	merged := putUserSettings(t, ctx, svc, UserSettings{
+		Key:        vnKey,
+		Extensions: map[string]map[string]interface{}{"exstatic": {"furigana": nil, "ruby": nil}},
+	})
+	assert.Nil(t, merged.Extensions)
+	_, getErr = GetUserSettings(ctx, svc, vnKey)
+	assert.ErrorIs(t, getErr, ErrSettingsNotFound)
+
+	resolved, resolveErr = ResolveUserSettings(ctx, svc, vnKey)
+	assert.NoError(t, resolveErr)
+	assert.Equal(t, 16.0, resolved.Settings.Extensions["exstatic"]["font_size"])
+}
+
+func TestExtensionValidation(t *testing.T) {
+	RegisterExtension("reader.columns", ExtensionSetting{Type: ExtensionNumber, Min: float64Pointer(1), Max: float64Pointer(4)})
+
+	err := ValidateUserSettings(UserSettings{
+		Key: UserSettingsKey{Username: "extensions"},
+		Extensions: map[string]map[string]interface{}{
+			"exstatic": {"theme": "blue", "font_size": "large", "note": map[string]interface{}{}},
+			"reader":   {"columns": 8.0, "rows": 2.0},
+			"unknown":  {"anything": true},
+		},
+	}, UserSettings{})
+
+	var validationErr *ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, []FieldError{
+		{Field: "extensions.exstatic.font_size", Reason: "must be a number"},
+		{Field: "extensions.exstatic.note", Reason: "isn't a registered setting"},
+		{Field: "extensions.exstatic.theme", Reason: "must be one of light, dark, system"},
+		{Field: "extensions.reader.columns", Reason: "must be at most 4"},
+		{Field: "extensions.reader.rows", Reason: "isn't a registered setting"},
+		{Field: "extensions.unknown.anything", Reason: "isn't a registered setting"},
+	}, validationErr.Fields)
+
+	assert.NoError(t, ValidateUserSettings(UserSettings{
+		Key:        UserSettingsKey{Username: "extensions"},
+		Extensions: map[string]map[string]interface{}{"reader": {"columns": 2.0}, "exstatic": {"theme": nil}, "retired": {"key": nil}},
+	}, UserSettings{}))
+}
+
+func TestWildcardExtensions(t *testing.T) {
+	RegisterExtension("scratch.*", ExtensionSetting{Type: ExtensionAny, MaxLength: 16})
+
+	err := ValidateUserSettings(UserSettings{
+		Key: UserSettingsKey{Username: "extensions"},
+		Extensions: map[string]map[string]interface{}{
+			"scratch": {"colour": "red", "Bad Key": true, strings.Repeat("k", MaxExtensionKeyLength+1): 1.0, "list": []interface{}{}},
+		},
+	}, UserSettings{})
+
+	var validationErr *ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, []FieldError{
+		{Field: "extensions.scratch.Bad Key", Reason: "must be at most 64 lowercase letters, digits or underscores"},
+		{Field: "extensions.scratch." + strings.Repeat("k", MaxExtensionKeyLength+1), Reason: "must be at most 64 lowercase letters, digits or underscores"},
+		{Field: "extensions.scratch.list", Reason: "must be a string, number or bool"},
+	}, validationErr.Fields)
+}
+
+func TestExtensionKeyLimit(t *testing.T) {
+	RegisterExtension("scratch.*", ExtensionSetting{Type: ExtensionAny, MaxLength: 16})
+	ctx := context.Background()
+	svc := localStorage(t)
+	key := UserSettingsKey{Username: "extension-limit"}
+
+	values := func(prefix string, count int) map[string]interface{} {
+		values := map[string]interface{}{}
+		for i := 0; i < count; i++ {
+			values[prefix+strconv.Itoa(i)] = true
+		}
+		return values
+	}
+
+	putUserSettings(t, ctx, svc, UserSettings{
+		Key:        key,
+		Extensions: map[string]map[string]interface{}{"scratch": values("first_", MaxExtensionKeys-10)},
+	})
+
+	// Each update is within the limit, but not once merged with what's saved
+	_, putErr := PutUserSettings(ctx, svc, UserSettings{
+		Key:        key,
+		Extensions: map[string]map[string]interface{}{"scratch": values("second_", 20)},
+	})
+	var validationErr *ValidationError
+	assert.ErrorAs(t, putErr, &validationErr)
+	assert.Equal(t, []FieldError{{Field: "extensions.scratch", Reason: "must have at most 50 keys"}}, validationErr.Fields)
+
+	saved, getErr := GetUserSettings(ctx, svc, key)
+	assert.NoError(t, getErr)
+	assert.Len(t, saved.Extensions["scratch"], MaxExtensionKeys-10)
+
+	// Removals make room for new keys in the same update
+	changes := values("second_", 20)
+	for i := 0; i < 10; i++ {
+		changes["first_"+strconv.Itoa(i)] = nil
+	}
+	putUserSettings(t, ctx, svc, UserSettings{
+		Key:        key,
+		Extensions: map[string]map[string]interface{}{"scratch": changes},
+	})
+	saved, getErr = GetUserSettings(ctx, svc, key)
+	assert.NoError(t, getErr)
+	assert.Len(t, saved.Extensions["scratch"], MaxExtensionKeys)
+}
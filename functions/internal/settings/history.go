@@ -0,0 +1,322 @@
+package settings
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/rs/zerolog/log"
+)
+
+// How long changes are kept for, settings can't be restored to before then
+const HistoryRetention = 90 * 24 * time.Hour
+
+const MaxHistoryRecords = 100
+
+// Swapped out by tests which need changes made at set times
+var clock = time.Now
+
+// A nil value means the setting wasn't saved, so was inherited
+type SettingChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// Every setting changed by one save, reset or restore
+type HistoryRecord struct {
+	Key UserSettingsKey `json:"key"`
+	// Empty for resets, which aren't made from any one device
+	DeviceID  string          `json:"device_id,omitempty"`
+	ChangedAt int64           `json:"changed_at"`
+	Changes   []SettingChange `json:"changes"`
+}
+
+type historyItem struct {
+	Username string `json:"username"`
+	SK       string `json:"sk"`
+	HistoryRecord
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// Records sort by when they were made within each media type
+func historyPrefix(key UserSettingsKey) string {
+	return storedMediaType(key.MediaType) + "#"
+}
+
+func historySK(key UserSettingsKey, changedAt time.Time) string {
+	return historyPrefix(key) + fmt.Sprintf("%020d", changedAt.UnixNano())
+}
+
+// Settings saved in a layer keyed by their json name, with extension settings under extensions.<client>.<key>
+// Values take their json form, so compare equal however they were read
+func flattenSettings(options UserSettings) (map[string]interface{}, error) {
+	options.Key, options.UpdatedAt, options.Clear, options.DeviceID = UserSettingsKey{}, nil, nil, ""
+	encoded, marshalErr := json.Marshal(options)
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+
+	fields := map[string]interface{}{}
+	if unmarshalErr := json.Unmarshal(encoded, &fields); unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	delete(fields, "key")
+
+	flattened := map[string]interface{}{}
+	for name, value := range fields {
+		if name == extensionsPrefix {
+			continue
+		}
+		if value != nil {
+			flattened[name] = value
+		}
+	}
+	for client, values := range options.Extensions {
+		for key, value := range values {
+			if value != nil {
+				flattened[extensionName(client, key)] = value
+			}
+		}
+	}
+
+	return flattened, nil
+}
+
+func unflattenSettings(flattened map[string]interface{}) (UserSettings, error) {
+	fields := map[string]interface{}{}
+	extensions := map[string]map[string]interface{}{}
+	for name, value := range flattened {
+		prefix, rest, _ := strings.Cut(name, ".")
+		if prefix != extensionsPrefix {
+			fields[name] = value
+			continue
+		}
+
+		client, key, _ := strings.Cut(rest, ".")
+		if extensions[client] == nil {
+			extensions[client] = map[string]interface{}{}
+		}
+		extensions[client][key] = value
+	}
+	if len(extensions) > 0 {
+		fields[extensionsPrefix] = extensions
+	}
+
+	options := UserSettings{}
+	encoded, marshalErr := json.Marshal(fields)
+	if marshalErr != nil {
+		return options, marshalErr
+	}
+	return options, json.Unmarshal(encoded, &options)
+}
+
+// Each setting whose value differs, sorted by name
+func diffSettings(before map[string]interface{}, after map[string]interface{}) []SettingChange {
+	changes := []SettingChange{}
+	for name, value := range before {
+		if !reflect.DeepEqual(value, after[name]) {
+			changes = append(changes, SettingChange{Field: name, Old: value, New: after[name]})
+		}
+	}
+	for name, value := range after {
+		if _, existed := before[name]; !existed {
+			changes = append(changes, SettingChange{Field: name, New: value})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+	return changes
+}
+
+// Adds a record of how the layer changed to the transaction writing it, doing nothing when nothing did
+// The key isn't kept on the item since transactions write keys from the table key, it's filled back in as records are read
+func recordHistory(transaction *dynamo_wrapper.Transaction, tableName string, key UserSettingsKey, deviceID string, before map[string]interface{}, after map[string]interface{}) *dynamo_wrapper.Transaction {
+	changes := diffSettings(before, after)
+	if len(changes) == 0 {
+		return transaction
+	}
+
+	timeNow := clock()
+	item := historyItem{
+		Username: key.Username,
+		SK:       historySK(key, timeNow),
+		HistoryRecord: HistoryRecord{
+			Key:       key,
+			DeviceID:  deviceID,
+			ChangedAt: timeNow.Unix(),
+			Changes:   changes,
+		},
+		ExpiresAt: timeNow.Add(HistoryRetention).Unix(),
+	}
+	return transaction.Put(tableName, map[string]*dynamodb.AttributeValue{
+		"username": {S: aws.String(item.Username)},
+		"sk":       {S: aws.String(item.SK)},
+	}, item)
+}
+
+// How the layer's saved settings look once the update is applied over them
+func applyUpdate(layer map[string]interface{}, options UserSettings) (map[string]interface{}, error) {
+	updated, flattenErr := flattenSettings(options)
+	if flattenErr != nil {
+		return nil, flattenErr
+	}
+
+	after := map[string]interface{}{}
+	for name, value := range layer {
+		after[name] = value
+	}
+	for name, value := range updated {
+		after[name] = value
+	}
+	for _, name := range options.Clear {
+		delete(after, name)
+	}
+	for client, values := range options.Extensions {
+		for key, value := range values {
+			if value == nil {
+				delete(after, extensionName(client, key))
+			}
+		}
+	}
+
+	return after, nil
+}
+
+// Goes through the history of a layer newest first, until the callback stops it with ErrStopIteration
+func eachHistoryRecord(ctx context.Context, svc storage.Storage, key UserSettingsKey, limit int, callback func(record HistoryRecord) error) error {
+	query := dynamo_wrapper.NewQuery(svc.Config().Tables.SettingsHistory).
+		Partition("username", key.Username).
+		SortBeginsWith("sk", historyPrefix(key)).
+		Reverse()
+	if limit > 0 {
+		query.Limit(limit)
+	}
+
+	return query.Each(ctx, svc, func(item map[string]*dynamodb.AttributeValue) error {
+		record := historyItem{}
+		if unmarshalErr := dynamodbattribute.UnmarshalMap(item, &record); unmarshalErr != nil {
+			log.Ctx(ctx).Error().Err(unmarshalErr).Interface("item", item).Msg("Could not unmarshal settings history")
+			return unmarshalErr
+		}
+		record.Key = key
+		return callback(record.HistoryRecord)
+	})
+}
+
+// The most recent changes to the settings saved under a key, newest first
+func ListSettingsHistory(ctx context.Context, svc storage.Storage, key UserSettingsKey, limit int) ([]HistoryRecord, error) {
+	if keyErr := ValidateKey(key); keyErr != nil {
+		log.Ctx(ctx).Info().Err(keyErr).Interface("key", key).Msg("Invalid settings key given")
+		return nil, keyErr
+	}
+	if limit <= 0 || limit > MaxHistoryRecords {
+		limit = MaxHistoryRecords
+	}
+
+	records := []HistoryRecord{}
+	eachErr := eachHistoryRecord(ctx, svc, key, limit, func(record HistoryRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	if eachErr != nil {
+		return nil, eachErr
+	}
+
+	return records, nil
+}
+
+// Puts the settings saved under a key back to how they were at the given unix time, by undoing every change since
+// The restore is itself recorded, so can be undone in turn
+// Times from before the history kept are turned away with a ValidationError, since the changes since are gone
+func RestoreUserSettings(ctx context.Context, svc storage.Storage, key UserSettingsKey, deviceID string, at int64) (*UserSettings, error) {
+	validationErr := &ValidationError{}
+	validateKey(key, validationErr)
+	if at < clock().Add(-HistoryRetention).Unix() {
+		validationErr.add("at", "must be within the last %d days", int(HistoryRetention.Hours()/24))
+	}
+	if err := validationErr.err(); err != nil {
+		log.Ctx(ctx).Info().Err(err).Interface("key", key).Int64("at", at).Msg("Invalid settings restore given")
+		return nil, err
+	}
+
+	var restored *UserSettings
+	writeErr := retryOnConflict(ctx, key, func() error {
+		var restoreErr error
+		restored, restoreErr = restoreUserSettings(ctx, svc, key, deviceID, at)
+		return restoreErr
+	})
+	if writeErr != nil {
+		return nil, writeErr
+	}
+
+	log.Ctx(ctx).Info().Interface("key", key).Int64("at", at).Msg("Restored settings")
+	return restored, nil
+}
+
+// One attempt at undoing the changes made to the row as it is now
+func restoreUserSettings(ctx context.Context, svc storage.Storage, key UserSettingsKey, deviceID string, at int64) (*UserSettings, error) {
+	stored, getErr := getStoredSettings(ctx, svc, key)
+	if getErr != nil {
+		return nil, getErr
+	}
+
+	before, flattenErr := flattenSettings(stored.UserSettings)
+	if flattenErr != nil {
+		return nil, flattenErr
+	}
+
+	after := map[string]interface{}{}
+	for name, value := range before {
+		after[name] = value
+	}
+	eachErr := eachHistoryRecord(ctx, svc, key, 0, func(record HistoryRecord) error {
+		if record.ChangedAt <= at {
+			return dynamo_wrapper.ErrStopIteration
+		}
+		for _, change := range record.Changes {
+			if change.Old == nil {
+				delete(after, change.Field)
+			} else {
+				after[change.Field] = change.Old
+			}
+		}
+		return nil
+	})
+	if eachErr != nil {
+		return nil, eachErr
+	}
+
+	restored, unflattenErr := unflattenSettings(after)
+	if unflattenErr != nil {
+		log.Ctx(ctx).Error().Err(unflattenErr).Interface("key", key).Msg("Could not rebuild restored settings")
+		return nil, unflattenErr
+	}
+	restored.Key = key
+	restored.UpdatedAt = stampChanges(stored.UpdatedAt, diffSettings(before, after), clock().Unix())
+
+	tableKey, keyErr := settingsRepository(ctx, svc).TableKey(ctx, key)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	// Settings saved since are nil in the restored layer, so are removed
+	transaction := dynamo_wrapper.NewTransaction().
+		Update(svc.Config().Tables.Settings, tableKey, settingsItem{UserSettings: restored, SchemaVersion: SchemaVersion(), Revision: stored.Revision + 1}).
+		When(unchangedSince(stored.Revision))
+	if commitErr := recordHistory(transaction, svc.Config().Tables.SettingsHistory, key, deviceID, before, after).Commit(ctx, svc); commitErr != nil {
+		return nil, commitErr
+	}
+
+	return &restored, nil
+}
@@ -0,0 +1,141 @@
+package settings
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+// Fails every transaction, so nothing it would have written lands
+type failingTransactions struct {
+	storage.Storage
+}
+
+func (failing failingTransactions) TransactWriteItemsWithContext(aws.Context, *dynamodb.TransactWriteItemsInput, ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	return nil, awserr.New(dynamodb.ErrCodeInternalServerError, "transaction failed", nil)
+}
+
+func TestSettingsHistory(t *testing.T) {
+	ctx := context.Background()
+	svc := localStorage(t)
+	key := UserSettingsKey{Username: "history", MediaType: "vn"}
+
+	start := time.Now()
+	defer func() { clock = time.Now }()
+	at := func(seconds int) {
+		clock = func() time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	}
+
+	at(0)
+	putUserSettings(t, ctx, svc, UserSettings{Key: key, DeviceID: "desktop", MaxAFKTime: aws.Int16(90), MaxBlurTime: aws.Int16(30)})
+	at(10)
+	putUserSettings(t, ctx, svc, UserSettings{
+		Key:         key,
+		DeviceID:    "phone",
+		MaxAFKTime:  aws.Int16(600),
+		MaxBlurTime: aws.Int16(30),
+		Extensions:  map[string]map[string]interface{}{"exstatic": {"theme": "dark"}},
+	})
+	// Saving the same values again changes nothing, so isn't recorded
+	at(15)
+	putUserSettings(t, ctx, svc, UserSettings{Key: key, DeviceID: "phone", MaxAFKTime: aws.Int16(600)})
+
+	records, listErr := ListSettingsHistory(ctx, svc, key, 0)
+	assert.NoError(t, listErr)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "phone", records[0].DeviceID)
+	assert.Equal(t, start.Add(10*time.Second).Unix(), records[0].ChangedAt)
+	assert.Equal(t, []SettingChange{
+		{Field: "extensions.exstatic.theme", New: "dark"},
+		{Field: "max_afk_time", Old: 90.0, New: 600.0},
+	}, records[0].Changes)
+	assert.Equal(t, "desktop", records[1].DeviceID)
+
+	limited, listErr := ListSettingsHistory(ctx, svc, key, 1)
+	assert.NoError(t, listErr)
+	assert.Len(t, limited, 1)
+
+	// Other media types have their own history
+	global, listErr := ListSettingsHistory(ctx, svc, UserSettingsKey{Username: "history"}, 0)
+	assert.NoError(t, listErr)
+	assert.Empty(t, global)
+
+	at(20)
+	restored, restoreErr := RestoreUserSettings(ctx, svc, key, "desktop", start.Add(5*time.Second).Unix())
+	assert.NoError(t, restoreErr)
+	assert.Equal(t, int16(90), *restored.MaxAFKTime)
+	assert.Nil(t, restored.Extensions)
+
+	options, getErr := GetUserSettings(ctx, svc, key)
+	assert.NoError(t, getErr)
+	assert.Equal(t, int16(90), *options.MaxAFKTime)
+	assert.Equal(t, int16(30), *options.MaxBlurTime)
+	assert.Nil(t, options.Extensions)
+
+	// The restore can itself be undone
+	at(30)
+	restored, restoreErr = RestoreUserSettings(ctx, svc, key, "desktop", start.Add(15*time.Second).Unix())
+	assert.NoError(t, restoreErr)
+	assert.Equal(t, int16(600), *restored.MaxAFKTime)
+	assert.Equal(t, "dark", restored.Extensions["exstatic"]["theme"])
+
+	// Resets are recorded too, without a device
+	at(40)
+	assert.NoError(t, ResetUserSettings(ctx, svc, key))
+	records, listErr = ListSettingsHistory(ctx, svc, key, 1)
+	assert.NoError(t, listErr)
+	assert.Equal(t, "", records[0].DeviceID)
+	assert.Equal(t, 600.0, records[0].Changes[1].Old)
+
+	// Restoring to before anything was saved leaves nothing saved
+	at(50)
+	restored, restoreErr = RestoreUserSettings(ctx, svc, key, "desktop", start.Add(-time.Second).Unix())
+	assert.NoError(t, restoreErr)
+	assert.Nil(t, restored.MaxAFKTime)
+	assert.Nil(t, restored.MaxBlurTime)
+}
+
+func TestHistoryWrittenWithSettings(t *testing.T) {
+	ctx := context.Background()
+	svc := localStorage(t)
+	key := UserSettingsKey{Username: "history_failed", MediaType: "vn"}
+	putUserSettings(t, ctx, svc, UserSettings{Key: key, MaxAFKTime: aws.Int16(90)})
+
+	failing := failingTransactions{Storage: svc}
+	_, putErr := PutUserSettings(ctx, failing, UserSettings{Key: key, MaxAFKTime: aws.Int16(600)})
+	assert.Error(t, putErr)
+	assert.Error(t, ResetUserSettings(ctx, failing, key))
+	_, restoreErr := RestoreUserSettings(ctx, failing, key, "desktop", time.Now().Add(-time.Hour).Unix())
+	assert.Error(t, restoreErr)
+
+	// Only the change which was saved is recorded
+	records, listErr := ListSettingsHistory(ctx, svc, key, 0)
+	assert.NoError(t, listErr)
+	assert.Len(t, records, 1)
+	assert.Equal(t, key, records[0].Key)
+	assert.Equal(t, []SettingChange{{Field: "max_afk_time", New: 90.0}}, records[0].Changes)
+}
+
+func TestRestoreBeforeRetention(t *testing.T) {
+	ctx := context.Background()
+	svc := localStorage(t)
+	key := UserSettingsKey{Username: "history_expired", MediaType: "vn"}
+	putUserSettings(t, ctx, svc, UserSettings{Key: key, MaxAFKTime: aws.Int16(90)})
+
+	_, restoreErr := RestoreUserSettings(ctx, svc, key, "desktop", time.Now().Add(-HistoryRetention-time.Hour).Unix())
+	assert.ErrorIs(t, restoreErr, ErrInvalidSettings)
+	validationErr := &ValidationError{}
+	assert.ErrorAs(t, restoreErr, &validationErr)
+	assert.Equal(t, "at", validationErr.Fields[0].Field)
+
+	options, getErr := GetUserSettings(ctx, svc, key)
+	assert.NoError(t, getErr)
+	assert.Equal(t, int16(90), *options.MaxAFKTime)
+}
@@ -0,0 +1,155 @@
+package settings
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
+)
+
+// Where a resolved setting was taken from
+type SettingSource string
+
+const (
+	SourceServerDefault SettingSource = "default"
+	SourceGlobal        SettingSource = "global"
+	SourceMediaType     SettingSource = "media_type"
+)
+
+// Settings with every field filled in, along with which layer each came from keyed by its json name
+type ResolvedSettings struct {
+	Settings UserSettings             `json:"settings"`
+	Sources  map[string]SettingSource `json:"sources"`
+	// Fields the user hasn't set, which follow the defaults of the given version
+	DefaultFields   []string `json:"default_fields"`
+	DefaultsVersion int      `json:"defaults_version"`
+}
+
+func (resolved *ResolvedSettings) IsDefault(name string) bool {
+	return resolved.Sources[name] == SourceServerDefault
+}
+
+func settingName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// Copies every field the layer sets over the resolved settings, noting where it came from
+func (resolved *ResolvedSettings) overlay(layer UserSettings, source SettingSource) {
+	resolvedValue := reflect.ValueOf(&resolved.Settings).Elem()
+	layerValue := reflect.ValueOf(layer)
+
+	for i := 0; i < layerValue.NumField(); i++ {
+		field := layerValue.Field(i)
+		if field.Kind() != reflect.Pointer || field.IsNil() {
+			continue
+		}
+
+		resolvedValue.Field(i).Set(field)
+		resolved.Sources[settingName(layerValue.Type().Field(i))] = source
+	}
+
+	// Extension settings are inherited key by key rather than as a whole map
+	for client, values := range layer.Extensions {
+		for key, value := range values {
+			if value == nil {
+				continue
+			}
+			if resolved.Settings.Extensions == nil {
+				resolved.Settings.Extensions = map[string]map[string]interface{}{}
+			}
+			if resolved.Settings.Extensions[client] == nil {
+				resolved.Settings.Extensions[client] = map[string]interface{}{}
+			}
+			resolved.Settings.Extensions[client][key] = value
+			resolved.Sources[extensionName(client, key)] = source
+		}
+	}
+}
+
+// Layers the media type's settings over the user's global settings, over the server defaults
+// Users who haven't saved any settings simply get the defaults for the media type
+func ResolveUserSettings(ctx context.Context, svc storage.Storage, key UserSettingsKey) (*ResolvedSettings, error) {
+	resolved, _, resolveErr := resolveUserSettings(ctx, svc, key, false)
+	return resolved, resolveErr
+}
+
+// Also gives back the layers read, keyed by their stored media type
+// Writes about to change the layers pass writeBack, so layers in an older shape are migrated in the table first
+func resolveUserSettings(ctx context.Context, svc storage.Storage, key UserSettingsKey, writeBack bool) (*ResolvedSettings, map[string]settingsItem, error) {
+	if keyErr := ValidateKey(key); keyErr != nil {
+		log.Ctx(ctx).Info().Err(keyErr).Interface("key", key).Msg("Invalid settings key given")
+		return nil, nil, keyErr
+	}
+
+	layerKeys := []UserSettingsKey{{Username: key.Username}}
+	if key.MediaType != "" {
+		layerKeys = append(layerKeys, key)
+	}
+
+	repository := settingsRepository(ctx, svc)
+	tableKeys := []map[string]*dynamodb.AttributeValue{}
+	for _, layerKey := range layerKeys {
+		tableKey, keyErr := repository.TableKey(ctx, layerKey)
+		if keyErr != nil {
+			return nil, nil, keyErr
+		}
+		tableKeys = append(tableKeys, tableKey)
+	}
+
+	// Read consistently since the layers are what updates are merged into
+	result, getErr := dynamo_wrapper.ConsistentBatchGetItems(ctx, svc, svc.Config().Tables.Settings, tableKeys)
+	if getErr != nil {
+		return nil, nil, getErr
+	}
+	if !result.Complete() {
+		err := errors.New("could not get every settings layer")
+		log.Ctx(ctx).Error().Err(err).Interface("key", key).Send()
+		return nil, nil, err
+	}
+
+	layers := map[string]settingsItem{}
+	for _, item := range result.Items {
+		layer, readErr := readSettingsItem(ctx, svc, item.Item, writeBack)
+		if readErr != nil {
+			return nil, nil, readErr
+		}
+		layers[*item.Key["media_type"].S] = *layer
+	}
+
+	return resolveLayers(svc.Config(), key, layers), layers, nil
+}
+
+// Layers the settings read for the key over the defaults
+func resolveLayers(cfg *config.Config, key UserSettingsKey, layers map[string]settingsItem) *ResolvedSettings {
+	resolved := &ResolvedSettings{
+		Sources:         map[string]SettingSource{},
+		DefaultFields:   []string{},
+		DefaultsVersion: DefaultsVersion,
+	}
+	resolved.overlay(DefaultProfile(cfg, key.MediaType), SourceServerDefault)
+	resolved.overlay(layers[GlobalMediaType].UserSettings, SourceGlobal)
+	if key.MediaType != "" {
+		resolved.overlay(layers[key.MediaType].UserSettings, SourceMediaType)
+	}
+	resolved.Settings.Key = key
+
+	for name := range resolved.Sources {
+		if resolved.IsDefault(name) {
+			resolved.DefaultFields = append(resolved.DefaultFields, name)
+		}
+	}
+	sort.Strings(resolved.DefaultFields)
+
+	return resolved
+}
@@ -0,0 +1,66 @@
+package settings
+
+import (
+	"context"
+	"testing"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveUserSettings(t *testing.T) {
+	ctx := context.Background()
+	svc := localStorage(t)
+	defaults := DefaultProfile(svc.Config(), "vn")
+
+	// Nothing saved yet leaves only the defaults
+	resolved, resolveErr := ResolveUserSettings(ctx, svc, UserSettingsKey{Username: "inheritance", MediaType: "vn"})
+	assert.NoError(t, resolveErr)
+	assert.Equal(t, *defaults.MaxLoadLines, *resolved.Settings.MaxLoadLines)
+	assert.Equal(t, SourceServerDefault, resolved.Sources["max_load_lines"])
+
+	putUserSettings(t, ctx, svc, UserSettings{
+		Key:          UserSettingsKey{Username: "inheritance"},
+		MaxAFKTime:   aws.Int16(300),
+		MaxLoadLines: aws.Int16(50),
+	})
+	putUserSettings(t, ctx, svc, UserSettings{
+		Key:          UserSettingsKey{Username: "inheritance", MediaType: "vn"},
+		MaxLoadLines: aws.Int16(20),
+	})
+
+	resolved, resolveErr = ResolveUserSettings(ctx, svc, UserSettingsKey{Username: "inheritance", MediaType: "vn"})
+	assert.NoError(t, resolveErr)
+	assert.Equal(t, UserSettingsKey{Username: "inheritance", MediaType: "vn"}, resolved.Settings.Key)
+	assert.Equal(t, int16(20), *resolved.Settings.MaxLoadLines)
+	assert.Equal(t, SourceMediaType, resolved.Sources["max_load_lines"])
+	assert.Equal(t, int16(300), *resolved.Settings.MaxAFKTime)
+	assert.Equal(t, SourceGlobal, resolved.Sources["max_afk_time"])
+	assert.Equal(t, *defaults.MenuBlurAmount, *resolved.Settings.MenuBlurAmount)
+	assert.Equal(t, SourceServerDefault, resolved.Sources["menu_blur_amount"])
+
+	// Other media types only inherit the global settings
+	resolved, resolveErr = ResolveUserSettings(ctx, svc, UserSettingsKey{Username: "inheritance", MediaType: "video"})
+	assert.NoError(t, resolveErr)
+	assert.Equal(t, int16(50), *resolved.Settings.MaxLoadLines)
+	assert.Equal(t, SourceGlobal, resolved.Sources["max_load_lines"])
+
+	global, getErr := GetUserSettings(ctx, svc, UserSettingsKey{Username: "inheritance"})
+	assert.NoError(t, getErr)
+	assert.Equal(t, int16(50), *global.MaxLoadLines)
+	assert.Nil(t, global.MenuBlurAmount)
+}
+
+func TestNewUserDefaults(t *testing.T) {
+	ctx := context.Background()
+
+	resolved, resolveErr := ResolveUserSettings(ctx, localStorage(t), UserSettingsKey{Username: "new_user", MediaType: "video"})
+	assert.NoError(t, resolveErr)
+	assert.Equal(t, DefaultsVersion, resolved.DefaultsVersion)
+	assert.Equal(t, []string{"extensions.exstatic.theme", "interface_blur_amount", "max_afk_time", "max_blur_time", "max_load_lines", "menu_blur_amount", "show_on_leaderboard", "week_start"}, resolved.DefaultFields)
+
+	// Media types keep the base defaults for anything they don't change
+	assert.Equal(t, int16(200), *resolved.Settings.MaxLoadLines)
+	assert.Equal(t, *DefaultProfile(config.Defaults(), "").MaxBlurTime, *resolved.Settings.MaxBlurTime)
+}
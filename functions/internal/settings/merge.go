@@ -0,0 +1,126 @@
+package settings
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Every setting the update touches by name, including extension settings it removes
+func updatedFields(options UserSettings) []string {
+	names := []string{}
+	optionsValue := reflect.ValueOf(options)
+	for i := 0; i < optionsValue.NumField(); i++ {
+		field := optionsValue.Field(i)
+		if field.Kind() == reflect.Pointer && !field.IsNil() {
+			names = append(names, settingName(optionsValue.Type().Field(i)))
+		}
+	}
+	for client, values := range options.Extensions {
+		for key := range values {
+			names = append(names, extensionName(client, key))
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Names of every setting which is saved on its own rather than inside the extensions
+func settingNames() []string {
+	names := []string{}
+	settingsType := reflect.TypeOf(UserSettings{})
+	for i := 0; i < settingsType.NumField(); i++ {
+		if settingsType.Field(i).Type.Kind() == reflect.Pointer {
+			names = append(names, settingName(settingsType.Field(i)))
+		}
+	}
+	return names
+}
+
+// Leaves the setting out of the update, copying the extension maps rather than changing the caller's
+func dropField(options *UserSettings, name string) {
+	cleared := []string{}
+	for _, clearedName := range options.Clear {
+		if clearedName != name {
+			cleared = append(cleared, clearedName)
+		}
+	}
+	options.Clear = cleared
+	if len(cleared) == 0 {
+		options.Clear = nil
+	}
+
+	optionsValue := reflect.ValueOf(options).Elem()
+	for i := 0; i < optionsValue.NumField(); i++ {
+		if settingName(optionsValue.Type().Field(i)) == name && optionsValue.Field(i).Kind() == reflect.Pointer {
+			optionsValue.Field(i).Set(reflect.Zero(optionsValue.Field(i).Type()))
+			return
+		}
+	}
+
+	extensions := map[string]map[string]interface{}{}
+	for client, values := range options.Extensions {
+		extensions[client] = map[string]interface{}{}
+		for key, value := range values {
+			if extensionName(client, key) != name {
+				extensions[client][key] = value
+			}
+		}
+		if len(extensions[client]) == 0 {
+			delete(extensions, client)
+		}
+	}
+	options.Extensions = extensions
+	if len(extensions) == 0 {
+		options.Extensions = nil
+	}
+}
+
+// Keeps only the settings in the update which are at least as new as those stored, each one judged on its own
+// Settings without a time given were changed now, and times from the future are taken as now so a fast clock can't pin a setting
+// Returns the update with the merged update times of the whole row, along with the settings left out
+func mergeUpdate(stored UserSettings, options UserSettings, now int64) (UserSettings, []string) {
+	updatedAt := map[string]int64{}
+	for name, storedAt := range stored.UpdatedAt {
+		updatedAt[name] = storedAt
+	}
+
+	// Clearing a setting changes it like any other value, so an older value can't bring it back
+	stale := []string{}
+	for _, name := range append(updatedFields(options), options.Clear...) {
+		changedAt, given := options.UpdatedAt[name]
+		if !given || changedAt > now {
+			changedAt = now
+		}
+
+		// Ties go to the update, since it arrived last
+		if stored.UpdatedAt[name] > changedAt {
+			dropField(&options, name)
+			stale = append(stale, name)
+			continue
+		}
+		updatedAt[name] = changedAt
+	}
+
+	options.UpdatedAt = updatedAt
+	if len(updatedAt) == 0 {
+		options.UpdatedAt = nil
+	}
+	return options, stale
+}
+
+// Stamps each changed setting with the time, keeping the times of the rest
+func stampChanges(updatedAt map[string]int64, changes []SettingChange, now int64) map[string]int64 {
+	stamped := map[string]int64{}
+	for name, changedAt := range updatedAt {
+		stamped[name] = changedAt
+	}
+	for _, change := range changes {
+		stamped[change.Field] = now
+	}
+
+	if len(stamped) == 0 {
+		return nil
+	}
+	return stamped
+}
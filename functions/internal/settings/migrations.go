@@ -0,0 +1,114 @@
+package settings
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
+)
+
+// Items written before settings were versioned don't have it, and count as version zero
+const schemaVersionAttribute = "schema_version"
+
+// Upgrades a raw settings item in place from the version at its index in the chain to the next
+type Migration func(item map[string]*dynamodb.AttributeValue) error
+
+var migrations = []Migration{
+	// Version zero items repeated their key inside a key map
+	func(item map[string]*dynamodb.AttributeValue) error {
+		delete(item, "key")
+		return nil
+	},
+}
+
+// Adds the next step to the chain, bumping the schema version every item is brought up to
+func RegisterMigration(migration Migration) {
+	migrations = append(migrations, migration)
+}
+
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+func itemSchemaVersion(item map[string]*dynamodb.AttributeValue) (int, error) {
+	version, exists := item[schemaVersionAttribute]
+	if !exists || version.N == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(*version.N)
+}
+
+// Runs each migration the item hasn't had yet on a copy, returning whether anything ran
+// Items from a newer version are left alone rather than downgraded
+func migrateItem(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, bool, error) {
+	version, versionErr := itemSchemaVersion(item)
+	if versionErr != nil {
+		return nil, false, fmt.Errorf("invalid settings schema version: %w", versionErr)
+	}
+	if version >= SchemaVersion() {
+		return item, false, nil
+	}
+
+	migrated := map[string]*dynamodb.AttributeValue{}
+	for name, value := range item {
+		migrated[name] = value
+	}
+	for ; version < SchemaVersion(); version++ {
+		if migrationErr := migrations[version](migrated); migrationErr != nil {
+			return nil, false, fmt.Errorf("settings migration from version %d: %w", version, migrationErr)
+		}
+	}
+	migrated[schemaVersionAttribute] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(SchemaVersion()))}
+
+	return migrated, true, nil
+}
+
+// Migrates items read in an older shape, writing them back when asked so each is only migrated once
+// Only writes pass writeBack, since functions which just read settings can't write to the table
+// Items changed since they were read aren't overwritten, and failing to write back never fails the read
+func upgradeItem(ctx context.Context, svc storage.Storage, item map[string]*dynamodb.AttributeValue, writeBack bool) (map[string]*dynamodb.AttributeValue, error) {
+	version, _ := itemSchemaVersion(item)
+	migrated, changed, migrateErr := migrateItem(item)
+	if migrateErr != nil {
+		log.Ctx(ctx).Error().Err(migrateErr).Interface("item", item).Msg("Could not migrate settings")
+		return nil, migrateErr
+	}
+	if !changed || !writeBack {
+		return migrated, nil
+	}
+
+	condition := "attribute_not_exists(#version)"
+	values := map[string]*dynamodb.AttributeValue{}
+	if version > 0 {
+		condition = "#version = :version"
+		values[":version"] = item[schemaVersionAttribute]
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName:                aws.String(svc.Config().Tables.Settings),
+		Item:                     migrated,
+		ConditionExpression:      aws.String(condition),
+		ExpressionAttributeNames: map[string]*string{"#version": aws.String(schemaVersionAttribute)},
+	}
+	if len(values) > 0 {
+		input.ExpressionAttributeValues = values
+	}
+
+	_, putErr := svc.PutItemWithContext(ctx, input)
+	var awsErr awserr.Error
+	if errors.As(putErr, &awsErr) && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		log.Ctx(ctx).Info().Interface("item", item).Msg("Settings changed whilst being migrated, leaving them be")
+	} else if putErr != nil {
+		log.Ctx(ctx).Warn().Err(putErr).Interface("item", item).Msg("Could not write back migrated settings")
+	} else {
+		log.Ctx(ctx).Info().Int("from", version).Int("to", SchemaVersion()).Msg("Migrated settings")
+	}
+
+	return migrated, nil
+}
@@ -0,0 +1,84 @@
+package settings
+
+import (
+	"context"
+	"testing"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func getRawSettings(t *testing.T, svc storage.Storage, mediaType string) map[string]*dynamodb.AttributeValue {
+	output, getErr := svc.GetItemWithContext(context.Background(), &dynamodb.GetItemInput{
+		TableName: aws.String("settings"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"username":   {S: aws.String("migration")},
+			"media_type": {S: aws.String(mediaType)},
+		},
+	})
+	assert.NoError(t, getErr)
+	return output.Item
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	svc := storage.NewMemoryStorage(config.Defaults())
+
+	// Renames a field in a later version of the schema
+	RegisterMigration(func(item map[string]*dynamodb.AttributeValue) error {
+		if afkTime, exists := item["afk_time"]; exists {
+			item["max_afk_time"] = afkTime
+			delete(item, "afk_time")
+		}
+		return nil
+	})
+	defer func() { migrations = migrations[:len(migrations)-1] }()
+
+	// Written before settings were versioned
+	_, putErr := svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String("settings"),
+		Item: map[string]*dynamodb.AttributeValue{
+			"username":       {S: aws.String("migration")},
+			"media_type":     {S: aws.String("vn")},
+			"key":            {M: map[string]*dynamodb.AttributeValue{"username": {S: aws.String("migration")}}},
+			"afk_time":       {N: aws.String("90")},
+			"max_load_lines": {N: aws.String("20")},
+		},
+	})
+	assert.NoError(t, putErr)
+
+	options, getErr := GetUserSettings(ctx, svc, UserSettingsKey{Username: "migration", MediaType: "vn"})
+	assert.NoError(t, getErr)
+	assert.Equal(t, int16(90), *options.MaxAFKTime)
+	assert.Equal(t, int16(20), *options.MaxLoadLines)
+
+	// Reading leaves the table alone, since read only functions can't write to it
+	item := getRawSettings(t, svc, "vn")
+	assert.NotContains(t, item, "schema_version")
+	assert.Contains(t, item, "afk_time")
+
+	// Writes upgrade the item before changing it
+	putUserSettings(t, ctx, svc, UserSettings{Key: UserSettingsKey{Username: "migration", MediaType: "vn"}, MaxLoadLines: aws.Int16(25)})
+	item = getRawSettings(t, svc, "vn")
+	assert.Equal(t, "2", *item["schema_version"].N)
+	assert.NotContains(t, item, "key")
+	assert.NotContains(t, item, "afk_time")
+	assert.Equal(t, "90", *item["max_afk_time"].N)
+	assert.Equal(t, "25", *item["max_load_lines"].N)
+
+	// New writes are stamped with the current version and skip migrating
+	putUserSettings(t, ctx, svc, UserSettings{Key: UserSettingsKey{Username: "migration"}, MaxLoadLines: aws.Int16(30)})
+	item = getRawSettings(t, svc, GlobalMediaType)
+	assert.Equal(t, "2", *item["schema_version"].N)
+	assert.NotContains(t, item, "key")
+
+	// Items from newer versions are left as they are
+	newer := map[string]*dynamodb.AttributeValue{"schema_version": {N: aws.String("5")}, "afk_time": {N: aws.String("1")}}
+	migrated, changed, migrateErr := migrateItem(newer)
+	assert.NoError(t, migrateErr)
+	assert.False(t, changed)
+	assert.Equal(t, newer, migrated)
+}
@@ -0,0 +1,34 @@
+package settings
+
+import "time"
+
+// Used when neither a request nor the user's settings give a timezone
+const DefaultTimezone = "UTC"
+
+// Only IANA names are taken, not the server's own Local timezone
+func validTimezone(name string) bool {
+	if name == "" || name == "Local" {
+		return false
+	}
+	_, loadErr := time.LoadLocation(name)
+	return loadErr == nil
+}
+
+// The timezone a request is read in, falling back to the one the user saved and then UTC
+func (resolved *ResolvedSettings) Location(requested string) (*time.Location, error) {
+	timezone := requested
+	if timezone == "" && resolved.Settings.Timezone != nil {
+		timezone = *resolved.Settings.Timezone
+	}
+	if timezone == "" {
+		timezone = DefaultTimezone
+	}
+
+	// Requests are held to the same names as saved settings
+	if !validTimezone(timezone) {
+		validationErr := &ValidationError{}
+		validationErr.add("timezone", "must be an IANA timezone")
+		return nil, validationErr.err()
+	}
+	return time.LoadLocation(timezone)
+}
@@ -1,72 +1,352 @@
 package settings
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"strconv"
 
 	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
-
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/rs/zerolog/log"
 )
 
+// An empty media type means the user's global settings
 type UserSettingsKey struct {
 	Username  string `json:"username" binding:"required"`
 	MediaType string `json:"media_type"`
 }
 
+// Settings are written as a whole, so those left nil are removed from the stored row
 type UserSettings struct {
-	Key                 UserSettingsKey `json:"key" binding:"required"`
-	ShowOnLeaderboard   *bool           `json:"show_on_leaderboard"`
-	InterfaceBlurAmount *float32        `json:"interface_blur_amount"`
-	MenuBlurAmount      *float32        `json:"menu_blur_amount"`
-	MaxAFKTime          *int16          `json:"max_afk_time"`
-	MaxBlurTime         *int16          `json:"max_blur_time"`
-	MaxLoadLines        *int16          `json:"max_load_lines"`
+	Key                 UserSettingsKey `json:"key" binding:"required" dynamo:"-"`
+	ShowOnLeaderboard   *bool           `json:"show_on_leaderboard" dynamo:"remove_if_nil"`
+	InterfaceBlurAmount *float32        `json:"interface_blur_amount" validate:"min=0,max=1" dynamo:"remove_if_nil"`
+	MenuBlurAmount      *float32        `json:"menu_blur_amount" validate:"min=0,max=1" dynamo:"remove_if_nil"`
+	MaxAFKTime          *int16          `json:"max_afk_time" validate:"min=1,max=3600" dynamo:"remove_if_nil"`
+	MaxBlurTime         *int16          `json:"max_blur_time" validate:"min=0,max=3600,lte=max_afk_time" dynamo:"remove_if_nil"`
+	MaxLoadLines        *int16          `json:"max_load_lines" validate:"min=1,max=1000" dynamo:"remove_if_nil"`
+	// The IANA timezone the user normally reads in, used whenever a request doesn't give one
+	Timezone *string `json:"timezone" validate:"timezone" dynamo:"remove_if_nil"`
+	// Reading before this hour counts towards the day before, unset keeps days split at midnight in the resolved timezone
+	DayRolloverHour *int16 `json:"day_rollover_hour" validate:"min=0,max=23" dynamo:"remove_if_nil"`
+	// Which day weekly stats, streaks and leaderboards start their weeks on
+	WeekStart *string `json:"week_start" validate:"oneof=iso monday sunday saturday" dynamo:"remove_if_nil"`
+	// Client defined settings by client then key, checked against the extension registry
+	Extensions map[string]map[string]interface{} `json:"extensions,omitempty" dynamo:"remove_if_nil"`
+	// Unix time each setting was last changed by name, settings given without one count as changed when saved
+	UpdatedAt map[string]int64 `json:"updated_at,omitempty"`
+	// Settings to remove so they fall back to the next layer down, extension settings are removed by setting them to nil instead
+	Clear []string `json:"clear,omitempty" dynamo:"-"`
+	// Which device saved the settings, only kept in their history
+	DeviceID string `json:"device_id,omitempty" dynamo:"-"`
+}
+
+var ErrSettingsNotFound = fmt.Errorf("settings %w", dynamo_wrapper.ErrNotFound)
+
+// Stored in place of the empty media type, since dynamodb keys can't be empty
+const GlobalMediaType = "#global"
+
+func storedMediaType(mediaType string) string {
+	if mediaType == "" {
+		return GlobalMediaType
+	}
+	return mediaType
+}
+
+func settingsTableKey(key UserSettingsKey) (map[string]*dynamodb.AttributeValue, error) {
+	key.MediaType = storedMediaType(key.MediaType)
+	return dynamo_wrapper.MarshalKey(key)
+}
+
+// Every write moves a row on to its next revision, so writes based on an older read can be turned away
+const revisionAttribute = "revision"
+
+// Writes which keep losing out to others writing the same row give up after this many attempts
+const MaxWriteAttempts = 5
+
+// How settings are stored, stamped with the schema version they were written in
+type settingsItem struct {
+	UserSettings
+	SchemaVersion int   `json:"schema_version"`
+	Revision      int64 `json:"revision"`
+}
+
+// What's left of a row once its settings are reset, remembering when each was removed
+type resetItem struct {
+	UpdatedAt     map[string]int64 `json:"updated_at,omitempty"`
+	SchemaVersion int              `json:"schema_version"`
+	Revision      int64            `json:"revision"`
+}
+
+// Attributes rows keep whether or not any settings are saved in them
+var bookkeepingAttributes = []string{"username", "media_type", "updated_at", schemaVersionAttribute, revisionAttribute}
+
+// Rows which were reset, or had every setting removed, are kept so their update times can turn away older values
+func holdsNoSettings(item map[string]*dynamodb.AttributeValue) bool {
+	for name := range item {
+		if !contains(bookkeepingAttributes, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Items in an older shape are migrated as they're read without being written back, and rows without settings are treated as missing
+func settingsRepository(ctx context.Context, svc storage.Storage) *dynamo_wrapper.Repository[UserSettingsKey, settingsItem] {
+	repository := dynamo_wrapper.NewRepository[UserSettingsKey, settingsItem](svc, svc.Config().Tables.Settings, settingsTableKey)
+	repository.Upgrade = func(ctx context.Context, item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+		return upgradeItem(ctx, svc, item, false)
+	}
+	repository.Hidden = holdsNoSettings
+	return repository
+}
+
+// Migrates then unmarshals items read without going through the repository
+func readSettingsItem(ctx context.Context, svc storage.Storage, item map[string]*dynamodb.AttributeValue, writeBack bool) (*settingsItem, error) {
+	upgradedItem, upgradeErr := upgradeItem(ctx, svc, item, writeBack)
+	if upgradeErr != nil {
+		return nil, upgradeErr
+	}
+
+	options := settingsItem{}
+	if unmarshalErr := dynamodbattribute.UnmarshalMap(upgradedItem, &options); unmarshalErr != nil {
+		log.Ctx(ctx).Error().Err(unmarshalErr).Str("table", svc.Config().Tables.Settings).Interface("item", item).Msg("Could not unmarshal dynamodb item")
+		return nil, unmarshalErr
+	}
+	return &options, nil
+}
+
+// The row as stored, reset or not, read consistently so its revision is current
+// Rows which were never written are empty at revision zero, rows in an older shape are migrated before being written over
+func getStoredSettings(ctx context.Context, svc storage.Storage, key UserSettingsKey) (*settingsItem, error) {
+	repository := settingsRepository(ctx, svc)
+	repository.Hidden = nil
+	repository.ConsistentRead = true
+	repository.Upgrade = func(ctx context.Context, item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+		return upgradeItem(ctx, svc, item, true)
+	}
+
+	item, getErr := repository.Get(ctx, key)
+	if errors.Is(getErr, dynamo_wrapper.ErrNotFound) {
+		return &settingsItem{}, nil
+	} else if getErr != nil {
+		return nil, getErr
+	}
+	return item, nil
+}
+
+// Only lets a write through while the row is still at the revision it was read at
+func unchangedSince(revision int64) dynamo_wrapper.Expression {
+	return dynamo_wrapper.Expression{
+		Expression: "attribute_not_exists(#revision) OR #revision = :read_revision",
+		Names:      map[string]*string{"#revision": aws.String(revisionAttribute)},
+		Values: map[string]*dynamodb.AttributeValue{
+			":read_revision": {N: aws.String(strconv.FormatInt(revision, 10))},
+		},
+	}
+}
+
+// Reads, changes and writes a row again whenever someone else wrote it in between
+func retryOnConflict(ctx context.Context, key UserSettingsKey, attempt func() error) error {
+	var err error
+	for i := 1; i <= MaxWriteAttempts; i++ {
+		err = attempt()
+		if !errors.Is(err, dynamo_wrapper.ErrConditionFailed) && !errors.Is(err, dynamo_wrapper.ErrTransactionConflict) {
+			return err
+		}
+		log.Ctx(ctx).Info().Err(err).Interface("key", key).Int("attempt", i).Msg("Settings changed whilst being written")
+	}
+
+	log.Ctx(ctx).Error().Err(err).Interface("key", key).Msg("Gave up writing settings")
+	return err
+}
+
+func GetUserSettings(ctx context.Context, svc storage.Storage, key UserSettingsKey) (*UserSettings, error) {
+	item, getErr := settingsRepository(ctx, svc).Get(ctx, key)
+	if errors.Is(getErr, dynamo_wrapper.ErrNotFound) {
+		return nil, ErrSettingsNotFound
+	} else if getErr != nil {
+		return nil, getErr
+	}
+	item.Key = key
+
+	return &item.UserSettings, nil
 }
 
-func GetUserSettings(svc *dynamodb.DynamoDB, key UserSettingsKey) (*UserSettings, error) {
-	tableKey, keyErr := dynamodbattribute.MarshalMap(key)
+// Merges the update into the saved settings field by field, the most recently changed value of each winning
+// Turns away invalid settings with a ValidationError before anything is written, returning the merged settings otherwise
+func PutUserSettings(ctx context.Context, svc storage.Storage, options UserSettings) (*UserSettings, error) {
+	// Fields are checked alone first, the key has to be valid to find the settings they combine with
+	if validationErr := ValidateUserSettings(options, UserSettings{}); validationErr != nil {
+		log.Ctx(ctx).Info().Err(validationErr).Interface("key", options.Key).Msg("Invalid settings given")
+		return nil, validationErr
+	}
+
+	var merged *UserSettings
+	writeErr := retryOnConflict(ctx, options.Key, func() error {
+		var mergeErr error
+		merged, mergeErr = mergeUserSettings(ctx, svc, options)
+		return mergeErr
+	})
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	return merged, nil
+}
+
+// One attempt at merging the update into the row as it is now, failing if the row changes before it's written
+func mergeUserSettings(ctx context.Context, svc storage.Storage, options UserSettings) (*UserSettings, error) {
+	_, layers, resolveErr := resolveUserSettings(ctx, svc, options.Key, true)
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	layer := storedMediaType(options.Key.MediaType)
+	stored := layers[layer]
+
+	options, stale := mergeUpdate(stored.UserSettings, options, clock().Unix())
+	if len(stale) > 0 {
+		log.Ctx(ctx).Info().Interface("key", options.Key).Strs("fields", stale).Msg("Kept newer settings over those given")
+	}
+
+	before, flattenErr := flattenSettings(stored.UserSettings)
+	if flattenErr != nil {
+		return nil, flattenErr
+	}
+	after, applyErr := applyUpdate(before, options)
+	if applyErr != nil {
+		return nil, applyErr
+	}
+	merged, unflattenErr := unflattenSettings(after)
+	if unflattenErr != nil {
+		log.Ctx(ctx).Error().Err(unflattenErr).Interface("key", options.Key).Msg("Could not rebuild merged settings")
+		return nil, unflattenErr
+	}
+	merged.Key, merged.UpdatedAt = options.Key, options.UpdatedAt
+
+	// Checked against the settings as they'd be, so cleared settings fall back to the layers below
+	mergedLayers := map[string]settingsItem{}
+	for mediaType, item := range layers {
+		mergedLayers[mediaType] = item
+	}
+	mergedLayers[layer] = settingsItem{UserSettings: merged}
+	if validationErr := ValidateUserSettings(options, resolveLayers(svc.Config(), options.Key, mergedLayers).Settings); validationErr != nil {
+		log.Ctx(ctx).Info().Err(validationErr).Interface("key", options.Key).Msg("Invalid settings given")
+		return nil, validationErr
+	}
+	if validationErr := validateMergedExtensions(merged.Extensions); validationErr != nil {
+		log.Ctx(ctx).Info().Err(validationErr).Interface("key", options.Key).Msg("Invalid settings given")
+		return nil, validationErr
+	}
+
+	// Resolving migrated the item already, so the fields written are in the current shape
+	tableKey, keyErr := settingsRepository(ctx, svc).TableKey(ctx, options.Key)
 	if keyErr != nil {
-		log.Error().Err(keyErr).Str("table", "settings").Interface("key", key).Msg("Could not unmarshal dynamodb key")
 		return nil, keyErr
 	}
+	// The whole layer is written so cleared settings are removed, and the history alongside so it only records changes which were made
+	transaction := dynamo_wrapper.NewTransaction().
+		Update(svc.Config().Tables.Settings, tableKey, settingsItem{UserSettings: merged, SchemaVersion: SchemaVersion(), Revision: stored.Revision + 1}).
+		When(unchangedSince(stored.Revision))
+	if commitErr := recordHistory(transaction, svc.Config().Tables.SettingsHistory, options.Key, options.DeviceID, before, after).Commit(ctx, svc); commitErr != nil {
+		return nil, commitErr
+	}
 
-	result, getErr := svc.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String("settings"),
-		Key:       tableKey,
-	})
-	if getErr != nil {
-		log.Error().Str("table", "settings").Interface("key", key).Msg("Dynamodb failed to get item")
-		return nil, getErr
+	return &merged, nil
+}
+
+// Every settings row saved for a user, the global one having an empty media type
+func ListUserSettings(ctx context.Context, svc storage.Storage, username string) ([]UserSettings, error) {
+	if username == "" {
+		validationErr := &ValidationError{Fields: []FieldError{{Field: "username", Reason: "is required"}}}
+		log.Ctx(ctx).Info().Err(validationErr).Msg("Invalid settings key given")
+		return nil, validationErr
 	}
 
-	if result.Item == nil || len(result.Item) == 0 {
-		log.Info().Str("table", "settings").Interface("key", key).Msg("Item not in table")
-		return nil, errors.New("item not found in table")
+	tableName := svc.Config().Tables.Settings
+	userSettings := []UserSettings{}
+	queryErr := dynamo_wrapper.NewQuery(tableName).Partition("username", username).Each(ctx, svc, func(item map[string]*dynamodb.AttributeValue) error {
+		if holdsNoSettings(item) {
+			return nil
+		}
+		stored, readErr := readSettingsItem(ctx, svc, item, false)
+		if readErr != nil {
+			return readErr
+		}
+
+		options := &stored.UserSettings
+		options.Key = UserSettingsKey{Username: username, MediaType: *item["media_type"].S}
+		if options.Key.MediaType == GlobalMediaType {
+			options.Key.MediaType = ""
+		}
+		userSettings = append(userSettings, *options)
+		return nil
+	})
+	if queryErr != nil {
+		return nil, queryErr
 	}
 
-	optionArgs := UserSettings{}
-	if unmarshalErr := dynamodbattribute.UnmarshalMap(result.Item, &optionArgs); unmarshalErr != nil {
-		log.Error().Err(unmarshalErr).Str("table", "settings").Interface("key", key).Interface("item", result.Item).Msg("Could not unmarshal dynamodb item")
-		return nil, unmarshalErr
+	return userSettings, nil
+}
+
+// Removes the settings saved under a single key, so it falls back to the next layer down
+// Resetting the global settings leaves media type overrides in place
+func ResetUserSettings(ctx context.Context, svc storage.Storage, key UserSettingsKey) error {
+	if keyErr := ValidateKey(key); keyErr != nil {
+		log.Ctx(ctx).Info().Err(keyErr).Interface("key", key).Msg("Invalid settings key given")
+		return keyErr
 	}
-	optionArgs.Key = key
 
-	return &optionArgs, nil
+	return retryOnConflict(ctx, key, func() error {
+		return resetUserSettings(ctx, svc, key)
+	})
 }
 
-func PutUserSettings(svc *dynamodb.DynamoDB, options UserSettings) error {
-	tableKey, keyErr := dynamodbattribute.MarshalMap(options.Key)
+// One attempt at resetting the row as it is now
+// The row is kept with every removed setting stamped with the time, so a device still holding older values can't bring them back
+func resetUserSettings(ctx context.Context, svc storage.Storage, key UserSettingsKey) error {
+	stored, getErr := getStoredSettings(ctx, svc, key)
+	if getErr != nil {
+		return getErr
+	}
+	stored.Key = key
+
+	before, flattenErr := flattenSettings(stored.UserSettings)
+	if flattenErr != nil {
+		return flattenErr
+	}
+	if len(before) == 0 {
+		return nil
+	}
+	tableKey, keyErr := settingsRepository(ctx, svc).TableKey(ctx, key)
 	if keyErr != nil {
-		log.Error().Err(keyErr).Str("table", "settings").Interface("key", options.Key).Msg("Could not marshal dynamodb key")
 		return keyErr
 	}
+	after := map[string]interface{}{}
+	transaction := dynamo_wrapper.NewTransaction().
+		Put(svc.Config().Tables.Settings, tableKey, resetItem{
+			UpdatedAt:     stampChanges(stored.UpdatedAt, diffSettings(before, after), clock().Unix()),
+			SchemaVersion: SchemaVersion(),
+			Revision:      stored.Revision + 1,
+		}).
+		When(unchangedSince(stored.Revision))
+	return recordHistory(transaction, svc.Config().Tables.SettingsHistory, key, "", before, after).Commit(ctx, svc)
+}
+
+// Resets every settings row for a user, returning them to the defaults
+func ResetAllUserSettings(ctx context.Context, svc storage.Storage, username string) error {
+	userSettings, listErr := ListUserSettings(ctx, svc, username)
+	if listErr != nil {
+		return listErr
+	}
 
-	_, updateErr := dynamo_wrapper.UpdateItem(svc, "settings", tableKey, options)
-	if updateErr != nil {
-		return updateErr
+	for _, options := range userSettings {
+		if resetErr := ResetUserSettings(ctx, svc, options.Key); resetErr != nil {
+			return resetErr
+		}
 	}
 
 	return nil
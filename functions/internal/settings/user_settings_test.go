@@ -0,0 +1,220 @@
+package settings
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+// Lets another write in just before the next transaction commits
+type racingStorage struct {
+	storage.Storage
+	race func()
+}
+
+func (racing *racingStorage) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	if race := racing.race; race != nil {
+		racing.race = nil
+		race()
+	}
+	return racing.Storage.TransactWriteItemsWithContext(ctx, input, opts...)
+}
+
+// Storage of its own so racing writes and seeded rows don't leak into other tests
+func localStorage(t *testing.T) storage.Storage {
+	svc, storageErr := storage.NewLocalStorage()
+	if storageErr != nil {
+		t.Fatal(storageErr)
+	}
+	return svc
+}
+
+func putUserSettings(t *testing.T, ctx context.Context, svc storage.Storage, options UserSettings) *UserSettings {
+	merged, putErr := PutUserSettings(ctx, svc, options)
+	assert.NoError(t, putErr)
+	return merged
+}
+
+func TestListAndResetUserSettings(t *testing.T) {
+	ctx := context.Background()
+	svc := localStorage(t)
+
+	for _, mediaType := range []string{"", "vn", "video"} {
+		putUserSettings(t, ctx, svc, UserSettings{
+			Key:          UserSettingsKey{Username: "reset", MediaType: mediaType},
+			MaxLoadLines: aws.Int16(20),
+		})
+	}
+
+	userSettings, listErr := ListUserSettings(ctx, svc, "reset")
+	assert.NoError(t, listErr)
+	mediaTypes := []string{}
+	for _, options := range userSettings {
+		assert.Equal(t, "reset", options.Key.Username)
+		assert.Equal(t, int16(20), *options.MaxLoadLines)
+		mediaTypes = append(mediaTypes, options.Key.MediaType)
+	}
+	assert.ElementsMatch(t, []string{"", "vn", "video"}, mediaTypes)
+
+	// Resetting a media type falls back to the global settings
+	assert.NoError(t, ResetUserSettings(ctx, svc, UserSettingsKey{Username: "reset", MediaType: "vn"}))
+	resolved, resolveErr := ResolveUserSettings(ctx, svc, UserSettingsKey{Username: "reset", MediaType: "vn"})
+	assert.NoError(t, resolveErr)
+	assert.Equal(t, SourceGlobal, resolved.Sources["max_load_lines"])
+
+	assert.NoError(t, ResetAllUserSettings(ctx, svc, "reset"))
+	userSettings, listErr = ListUserSettings(ctx, svc, "reset")
+	assert.NoError(t, listErr)
+	assert.Empty(t, userSettings)
+
+	resolved, resolveErr = ResolveUserSettings(ctx, svc, UserSettingsKey{Username: "reset", MediaType: "video"})
+	assert.NoError(t, resolveErr)
+	assert.True(t, resolved.IsDefault("max_load_lines"))
+
+	assert.ErrorIs(t, ResetUserSettings(ctx, svc, UserSettingsKey{Username: "reset", MediaType: "book"}), ErrInvalidSettings)
+	assert.NoError(t, ResetAllUserSettings(ctx, svc, "reset"))
+}
+
+func TestLastWriterWins(t *testing.T) {
+	ctx := context.Background()
+	svc := localStorage(t)
+	key := UserSettingsKey{Username: "last_writer", MediaType: "vn"}
+
+	now := time.Now()
+	defer func() { clock = time.Now }()
+	clock = func() time.Time { return now }
+
+	merged := putUserSettings(t, ctx, svc, UserSettings{
+		Key:          key,
+		MaxAFKTime:   aws.Int16(90),
+		MaxLoadLines: aws.Int16(50),
+		Extensions:   map[string]map[string]interface{}{"exstatic": {"theme": "dark"}},
+	})
+	assert.Equal(t, map[string]int64{"extensions.exstatic.theme": now.Unix(), "max_afk_time": now.Unix(), "max_load_lines": now.Unix()}, merged.UpdatedAt)
+
+	// A device coming back online only wins the settings it changed after the stored ones
+	offline := now.Add(-time.Hour).Unix()
+	merged = putUserSettings(t, ctx, svc, UserSettings{
+		Key:          key,
+		MaxAFKTime:   aws.Int16(300),
+		MaxLoadLines: aws.Int16(20),
+		MaxBlurTime:  aws.Int16(30),
+		Extensions:   map[string]map[string]interface{}{"exstatic": {"theme": nil}},
+		UpdatedAt:    map[string]int64{"max_afk_time": offline, "max_blur_time": offline, "extensions.exstatic.theme": offline},
+	})
+	assert.Equal(t, int16(90), *merged.MaxAFKTime)
+	assert.Equal(t, int16(20), *merged.MaxLoadLines)
+	assert.Equal(t, int16(30), *merged.MaxBlurTime)
+	assert.Equal(t, "dark", merged.Extensions["exstatic"]["theme"])
+	assert.Equal(t, now.Unix(), merged.UpdatedAt["max_afk_time"])
+	assert.Equal(t, offline, merged.UpdatedAt["max_blur_time"])
+
+	// Times from the future are capped, so a later write still wins
+	putUserSettings(t, ctx, svc, UserSettings{Key: key, MaxLoadLines: aws.Int16(10), UpdatedAt: map[string]int64{"max_load_lines": now.Add(time.Hour).Unix()}})
+	clock = func() time.Time { return now.Add(time.Minute) }
+	merged = putUserSettings(t, ctx, svc, UserSettings{Key: key, MaxLoadLines: aws.Int16(40)})
+	assert.Equal(t, int16(40), *merged.MaxLoadLines)
+
+	stored, getErr := GetUserSettings(ctx, svc, key)
+	assert.NoError(t, getErr)
+	assert.Equal(t, merged.UpdatedAt, stored.UpdatedAt)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	svc := localStorage(t)
+	key := UserSettingsKey{Username: "concurrent", MediaType: "vn"}
+	putUserSettings(t, ctx, svc, UserSettings{Key: key, MaxLoadLines: aws.Int16(20)})
+
+	// The write read the row before the other one landed, so it has to read it again rather than overwrite it
+	racing := &racingStorage{Storage: svc, race: func() {
+		putUserSettings(t, ctx, svc, UserSettings{Key: key, MaxAFKTime: aws.Int16(300), Extensions: map[string]map[string]interface{}{"exstatic": {"theme": "dark"}}})
+	}}
+	merged := putUserSettings(t, ctx, racing, UserSettings{Key: key, MaxBlurTime: aws.Int16(30), Extensions: map[string]map[string]interface{}{"exstatic": {"font_size": 20.0}}})
+
+	assert.Equal(t, int16(20), *merged.MaxLoadLines)
+	assert.Equal(t, int16(300), *merged.MaxAFKTime)
+	assert.Equal(t, int16(30), *merged.MaxBlurTime)
+	assert.Equal(t, map[string]interface{}{"theme": "dark", "font_size": 20.0}, merged.Extensions["exstatic"])
+
+	stored, getErr := GetUserSettings(ctx, svc, key)
+	assert.NoError(t, getErr)
+	assert.Equal(t, merged.MaxAFKTime, stored.MaxAFKTime)
+	assert.Equal(t, merged.Extensions, stored.Extensions)
+}
+
+func TestResetKeepsRemovalTimes(t *testing.T) {
+	ctx := context.Background()
+	svc := localStorage(t)
+	key := UserSettingsKey{Username: "reset_times", MediaType: "vn"}
+
+	now := time.Now()
+	defer func() { clock = time.Now }()
+	clock = func() time.Time { return now }
+
+	putUserSettings(t, ctx, svc, UserSettings{Key: key, MaxLoadLines: aws.Int16(20)})
+	clock = func() time.Time { return now.Add(time.Minute) }
+	assert.NoError(t, ResetUserSettings(ctx, svc, key))
+
+	// A device which changed the setting before the reset can't bring it back
+	merged := putUserSettings(t, ctx, svc, UserSettings{Key: key, MaxLoadLines: aws.Int16(40), UpdatedAt: map[string]int64{"max_load_lines": now.Unix()}})
+	assert.Nil(t, merged.MaxLoadLines)
+	assert.Equal(t, now.Add(time.Minute).Unix(), merged.UpdatedAt["max_load_lines"])
+	_, getErr := GetUserSettings(ctx, svc, key)
+	assert.ErrorIs(t, getErr, ErrSettingsNotFound)
+
+	// Changes made after the reset still win
+	merged = putUserSettings(t, ctx, svc, UserSettings{Key: key, MaxLoadLines: aws.Int16(60)})
+	assert.Equal(t, int16(60), *merged.MaxLoadLines)
+
+	clock = func() time.Time { return now.Add(2 * time.Minute) }
+	assert.NoError(t, ResetAllUserSettings(ctx, svc, "reset_times"))
+	merged = putUserSettings(t, ctx, svc, UserSettings{Key: key, MaxLoadLines: aws.Int16(80), UpdatedAt: map[string]int64{"max_load_lines": now.Add(time.Minute).Unix()}})
+	assert.Nil(t, merged.MaxLoadLines)
+}
+
+func TestClearSettings(t *testing.T) {
+	ctx := context.Background()
+	svc := localStorage(t)
+	key := UserSettingsKey{Username: "clear", MediaType: "vn"}
+
+	now := time.Now()
+	defer func() { clock = time.Now }()
+	clock = func() time.Time { return now }
+
+	putUserSettings(t, ctx, svc, UserSettings{Key: UserSettingsKey{Username: "clear"}, MaxAFKTime: aws.Int16(300)})
+	putUserSettings(t, ctx, svc, UserSettings{Key: key, MaxAFKTime: aws.Int16(90), MaxLoadLines: aws.Int16(20)})
+
+	clock = func() time.Time { return now.Add(time.Minute) }
+	merged := putUserSettings(t, ctx, svc, UserSettings{Key: key, Clear: []string{"max_afk_time"}})
+	assert.Nil(t, merged.MaxAFKTime)
+	assert.Equal(t, int16(20), *merged.MaxLoadLines)
+	assert.Equal(t, now.Add(time.Minute).Unix(), merged.UpdatedAt["max_afk_time"])
+
+	// The cleared setting falls back to the global one
+	stored, getErr := GetUserSettings(ctx, svc, key)
+	assert.NoError(t, getErr)
+	assert.Nil(t, stored.MaxAFKTime)
+	resolved, resolveErr := ResolveUserSettings(ctx, svc, key)
+	assert.NoError(t, resolveErr)
+	assert.Equal(t, int16(300), *resolved.Settings.MaxAFKTime)
+	assert.Equal(t, SourceGlobal, resolved.Sources["max_afk_time"])
+
+	// Values changed before the setting was cleared don't bring it back
+	merged = putUserSettings(t, ctx, svc, UserSettings{Key: key, MaxAFKTime: aws.Int16(60), UpdatedAt: map[string]int64{"max_afk_time": now.Unix()}})
+	assert.Nil(t, merged.MaxAFKTime)
+
+	_, putErr := PutUserSettings(ctx, svc, UserSettings{Key: key, MaxAFKTime: aws.Int16(60), Clear: []string{"max_afk_time", "key"}})
+	validationErr := &ValidationError{}
+	assert.ErrorAs(t, putErr, &validationErr)
+	assert.ElementsMatch(t, []FieldError{
+		{Field: "max_afk_time", Reason: "can't be given and cleared at once"},
+		{Field: "clear", Reason: "key isn't a setting which can be cleared"},
+	}, validationErr.Fields)
+}
@@ -0,0 +1,212 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidSettings = errors.New("invalid settings")
+
+// Media types settings can be saved for, besides the empty global one
+var MediaTypes = []string{"mokuro", "ttu", "video", "vn"}
+
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// Lists every invalid field at once so they can all be highlighted together
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (validationErr *ValidationError) Error() string {
+	reasons := []string{}
+	for _, fieldErr := range validationErr.Fields {
+		reasons = append(reasons, fieldErr.Field+" "+fieldErr.Reason)
+	}
+	return ErrInvalidSettings.Error() + ": " + strings.Join(reasons, "; ")
+}
+
+func (validationErr *ValidationError) Is(target error) bool {
+	return target == ErrInvalidSettings
+}
+
+func (validationErr *ValidationError) add(field string, format string, args ...interface{}) {
+	validationErr.Fields = append(validationErr.Fields, FieldError{Field: field, Reason: fmt.Sprintf(format, args...)})
+}
+
+// Nil when every field passed
+func (validationErr *ValidationError) err() error {
+	if len(validationErr.Fields) == 0 {
+		return nil
+	}
+	sort.SliceStable(validationErr.Fields, func(i, j int) bool {
+		return validationErr.Fields[i].Field < validationErr.Fields[j].Field
+	})
+	return validationErr
+}
+
+// Rules for a field, given through its validate struct tag
+// min and max bound the value itself while lte names another field it can't exceed
+// oneof lists the only strings allowed, separated by spaces, and timezone takes IANA timezone names
+type fieldRules struct {
+	min           *float64
+	max           *float64
+	lessOrEqualTo string
+	oneOf         []string
+	timezone      bool
+}
+
+func parseFieldRules(tag string) (fieldRules, error) {
+	rules := fieldRules{}
+	if tag == "" {
+		return rules, nil
+	}
+
+	for _, rule := range strings.Split(tag, ",") {
+		name, argument, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		switch name {
+		case "min", "max":
+			bound, parseErr := strconv.ParseFloat(argument, 64)
+			if parseErr != nil {
+				return rules, fmt.Errorf("validate tag %s needs a number: %w", name, parseErr)
+			}
+			if name == "min" {
+				rules.min = &bound
+			} else {
+				rules.max = &bound
+			}
+		case "lte":
+			rules.lessOrEqualTo = argument
+		case "oneof":
+			rules.oneOf = strings.Fields(argument)
+		case "timezone":
+			rules.timezone = true
+		default:
+			return rules, fmt.Errorf("unknown validate tag rule %q", name)
+		}
+	}
+
+	return rules, nil
+}
+
+func numericValue(value reflect.Value) (float64, bool) {
+	value = reflect.Indirect(value)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	}
+	return 0, false
+}
+
+func formatBound(bound float64) string {
+	return strconv.FormatFloat(bound, 'f', -1, 64)
+}
+
+func validateKey(key UserSettingsKey, validationErr *ValidationError) {
+	if key.Username == "" {
+		validationErr.add("username", "is required")
+	}
+
+	if key.MediaType == "" {
+		return
+	}
+	for _, mediaType := range MediaTypes {
+		if key.MediaType == mediaType {
+			return
+		}
+	}
+	validationErr.add("media_type", "must be one of %s", strings.Join(MediaTypes, ", "))
+}
+
+// Fails with a ValidationError when the key isn't one settings can be kept under
+func ValidateKey(key UserSettingsKey) error {
+	validationErr := &ValidationError{}
+	validateKey(key, validationErr)
+	return validationErr.err()
+}
+
+// Checks the fields being saved along with how they combine with those already in effect
+// Only fields set in the update are checked, so existing bad values never block unrelated changes
+func ValidateUserSettings(update UserSettings, effective UserSettings) error {
+	validationErr := &ValidationError{}
+	validateKey(update.Key, validationErr)
+
+	updateValue, effectiveValue := reflect.ValueOf(update), reflect.ValueOf(effective)
+	fieldIndexes := map[string]int{}
+	for i := 0; i < updateValue.NumField(); i++ {
+		fieldIndexes[settingName(updateValue.Type().Field(i))] = i
+	}
+
+	for i := 0; i < updateValue.NumField(); i++ {
+		field := updateValue.Type().Field(i)
+		name := settingName(field)
+		rules, rulesErr := parseFieldRules(field.Tag.Get("validate"))
+		if rulesErr != nil {
+			return rulesErr
+		}
+
+		if value, ok := numericValue(updateValue.Field(i)); ok && !updateValue.Field(i).IsNil() {
+			if rules.min != nil && value < *rules.min {
+				validationErr.add(name, "must be at least %s", formatBound(*rules.min))
+			} else if rules.max != nil && value > *rules.max {
+				validationErr.add(name, "must be at most %s", formatBound(*rules.max))
+			}
+		}
+
+		if text, ok := updateValue.Field(i).Interface().(*string); ok && text != nil {
+			if len(rules.oneOf) > 0 && !contains(rules.oneOf, *text) {
+				validationErr.add(name, "must be one of %s", strings.Join(rules.oneOf, ", "))
+			} else if rules.timezone && !validTimezone(*text) {
+				validationErr.add(name, "must be an IANA timezone")
+			}
+		}
+
+		if rules.lessOrEqualTo == "" {
+			continue
+		}
+		otherIndex, exists := fieldIndexes[rules.lessOrEqualTo]
+		if !exists {
+			return fmt.Errorf("validate tag of %s refers to unknown field %s", name, rules.lessOrEqualTo)
+		}
+		if updateValue.Field(i).IsNil() && updateValue.Field(otherIndex).IsNil() {
+			continue
+		}
+
+		value, valueOk := numericValue(effectiveValue.Field(i))
+		other, otherOk := numericValue(effectiveValue.Field(otherIndex))
+		if !valueOk || !otherOk || effectiveValue.Field(i).IsNil() || effectiveValue.Field(otherIndex).IsNil() || value <= other {
+			continue
+		}
+
+		// Whichever field is being changed is the one at fault
+		if !updateValue.Field(i).IsNil() {
+			validationErr.add(name, "must be at most %s (%s)", rules.lessOrEqualTo, formatBound(other))
+		} else {
+			validationErr.add(rules.lessOrEqualTo, "must be at least %s (%s)", name, formatBound(value))
+		}
+	}
+
+	validateClear(update, validationErr)
+	validateExtensions(update.Extensions, validationErr)
+	return validationErr.err()
+}
+
+// Only settings can be cleared, and not whilst also being given a value
+func validateClear(update UserSettings, validationErr *ValidationError) {
+	given := updatedFields(update)
+	for _, name := range update.Clear {
+		if !contains(settingNames(), name) {
+			validationErr.add("clear", "%s isn't a setting which can be cleared", name)
+		} else if contains(given, name) {
+			validationErr.add(name, "can't be given and cleared at once")
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package settings
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateUserSettings(t *testing.T) {
+	ctx := context.Background()
+	svc := localStorage(t)
+
+	_, putErr := PutUserSettings(ctx, svc, UserSettings{
+		Key:                 UserSettingsKey{Username: "validation", MediaType: "book"},
+		InterfaceBlurAmount: aws.Float32(10000),
+		MaxAFKTime:          aws.Int16(-5),
+		MaxLoadLines:        aws.Int16(0),
+	})
+	assert.ErrorIs(t, putErr, ErrInvalidSettings)
+
+	var validationErr *ValidationError
+	assert.True(t, errors.As(putErr, &validationErr))
+	assert.Equal(t, []FieldError{
+		{Field: "interface_blur_amount", Reason: "must be at most 1"},
+		{Field: "max_afk_time", Reason: "must be at least 1"},
+		{Field: "max_load_lines", Reason: "must be at least 1"},
+		{Field: "media_type", Reason: "must be one of mokuro, ttu, video, vn"},
+	}, validationErr.Fields)
+
+	// Nothing invalid is written
+	_, getErr := GetUserSettings(ctx, svc, UserSettingsKey{Username: "validation", MediaType: "book"})
+	assert.ErrorIs(t, getErr, ErrSettingsNotFound)
+
+	// Combinations are checked against the settings already in effect
+	putUserSettings(t, ctx, svc, UserSettings{Key: UserSettingsKey{Username: "validation"}, MaxAFKTime: aws.Int16(90)})
+	_, putErr = PutUserSettings(ctx, svc, UserSettings{Key: UserSettingsKey{Username: "validation", MediaType: "vn"}, MaxBlurTime: aws.Int16(100)})
+	assert.True(t, errors.As(putErr, &validationErr))
+	assert.Equal(t, []FieldError{{Field: "max_blur_time", Reason: "must be at most max_afk_time (90)"}}, validationErr.Fields)
+
+	_, putErr = PutUserSettings(ctx, svc, UserSettings{Key: UserSettingsKey{Username: "validation"}, MaxAFKTime: aws.Int16(30)})
+	assert.True(t, errors.As(putErr, &validationErr))
+	assert.Equal(t, []FieldError{{Field: "max_afk_time", Reason: "must be at least max_blur_time (60)"}}, validationErr.Fields)
+
+	putUserSettings(t, ctx, svc, UserSettings{Key: UserSettingsKey{Username: "validation", MediaType: "vn"}, MaxBlurTime: aws.Int16(90)})
+}
+
+func TestValidateTimezone(t *testing.T) {
+	key := UserSettingsKey{Username: "validation"}
+	for _, timezone := range []string{"", "Local", "Mars/Olympus_Mons"} {
+		var validationErr *ValidationError
+		assert.True(t, errors.As(ValidateUserSettings(UserSettings{Key: key, Timezone: aws.String(timezone)}, UserSettings{}), &validationErr))
+		assert.Equal(t, []FieldError{{Field: "timezone", Reason: "must be an IANA timezone"}}, validationErr.Fields)
+	}
+
+	assert.NoError(t, ValidateUserSettings(UserSettings{Key: key, Timezone: aws.String("Australia/Perth"), DayRolloverHour: aws.Int16(4)}, UserSettings{}))
+	assert.Error(t, ValidateUserSettings(UserSettings{Key: key, DayRolloverHour: aws.Int16(24)}, UserSettings{}))
+}
+
+func TestValidateWeekStart(t *testing.T) {
+	key := UserSettingsKey{Username: "validation"}
+	assert.NoError(t, ValidateUserSettings(UserSettings{Key: key, WeekStart: aws.String(WeekStartSunday)}, UserSettings{}))
+
+	var validationErr *ValidationError
+	assert.True(t, errors.As(ValidateUserSettings(UserSettings{Key: key, WeekStart: aws.String("tuesday")}, UserSettings{}), &validationErr))
+	assert.Equal(t, []FieldError{{Field: "week_start", Reason: "must be one of iso, monday, sunday, saturday"}}, validationErr.Fields)
+}
+
+func TestDefaultProfilesValid(t *testing.T) {
+	for _, maxAFKTime := range []int16{60, 3600} {
+		testConfig := config.Defaults()
+		testConfig.MaxAFKTime = maxAFKTime
+
+		for _, mediaType := range append([]string{""}, MediaTypes...) {
+			profile := DefaultProfile(testConfig, mediaType)
+			profile.Key = UserSettingsKey{Username: "defaults", MediaType: mediaType}
+			assert.NoError(t, ValidateUserSettings(profile, profile), "%d %s", maxAFKTime, mediaType)
+		}
+	}
+}
+
+func TestLocation(t *testing.T) {
+	resolved := &ResolvedSettings{Settings: UserSettings{Timezone: aws.String("Asia/Tokyo")}}
+	for _, timezone := range []string{"Local", "Mars/Olympus_Mons"} {
+		_, locationErr := resolved.Location(timezone)
+		var validationErr *ValidationError
+		assert.True(t, errors.As(locationErr, &validationErr))
+		assert.Equal(t, []FieldError{{Field: "timezone", Reason: "must be an IANA timezone"}}, validationErr.Fields)
+	}
+
+	location, locationErr := resolved.Location("")
+	assert.NoError(t, locationErr)
+	assert.Equal(t, "Asia/Tokyo", location.String())
+	location, locationErr = resolved.Location("Australia/Perth")
+	assert.NoError(t, locationErr)
+	assert.Equal(t, "Australia/Perth", location.String())
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Dynamodb numbers hold up to 38 significant digits
+const numberPrecision = 38
+
+func numberValue(number string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(number)}
+}
+
+func parseNumber(number string) (*big.Rat, error) {
+	rat, ok := new(big.Rat).SetString(strings.TrimSpace(number))
+	if !ok {
+		return nil, fmt.Errorf("invalid number %q", number)
+	}
+	return rat, nil
+}
+
+func formatNumber(rat *big.Rat) string {
+	if rat.IsInt() {
+		return rat.Num().String()
+	}
+
+	formatted := rat.FloatString(numberPrecision)
+	return strings.TrimRight(strings.TrimRight(formatted, "0"), ".")
+}
+
+func addNumbers(first string, second string) (string, error) {
+	firstRat, firstErr := parseNumber(first)
+	if firstErr != nil {
+		return "", firstErr
+	}
+	secondRat, secondErr := parseNumber(second)
+	if secondErr != nil {
+		return "", secondErr
+	}
+
+	return formatNumber(new(big.Rat).Add(firstRat, secondRat)), nil
+}
+
+func compareNumbers(first string, second string) (int, error) {
+	firstRat, firstErr := parseNumber(first)
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	secondRat, secondErr := parseNumber(second)
+	if secondErr != nil {
+		return 0, secondErr
+	}
+
+	return firstRat.Cmp(secondRat), nil
+}
+
+// Orders scalar values of the same type, the way dynamodb sorts keys
+func compareAttributeValues(first *dynamodb.AttributeValue, second *dynamodb.AttributeValue) (int, bool) {
+	switch {
+	case first.N != nil && second.N != nil:
+		order, err := compareNumbers(*first.N, *second.N)
+		return order, err == nil
+	case first.S != nil && second.S != nil:
+		return strings.Compare(*first.S, *second.S), true
+	case first.B != nil && second.B != nil:
+		return bytes.Compare(first.B, second.B), true
+	default:
+		return 0, false
+	}
+}
+
+// Only scalars are ever compared, sets, maps and lists are never equal to anything
+func scalarsEqual(first *dynamodb.AttributeValue, second *dynamodb.AttributeValue) bool {
+	if first.BOOL != nil && second.BOOL != nil {
+		return *first.BOOL == *second.BOOL
+	}
+
+	order, comparable := compareAttributeValues(first, second)
+	return comparable && order == 0
+}
+
+func copyStrings(values []*string) []*string {
+	if values == nil {
+		return nil
+	}
+
+	copied := make([]*string, len(values))
+	for i, value := range values {
+		copied[i] = aws.String(*value)
+	}
+	return copied
+}
+
+// Deep copies so callers can never alias what is stored
+func copyAttributeValue(value *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if value == nil {
+		return nil
+	}
+
+	copied := &dynamodb.AttributeValue{
+		SS: copyStrings(value.SS),
+		NS: copyStrings(value.NS),
+	}
+
+	if value.S != nil {
+		copied.S = aws.String(*value.S)
+	}
+	if value.N != nil {
+		copied.N = aws.String(*value.N)
+	}
+	if value.B != nil {
+		copied.B = append([]byte{}, value.B...)
+	}
+	if value.BOOL != nil {
+		copied.BOOL = aws.Bool(*value.BOOL)
+	}
+	if value.NULL != nil {
+		copied.NULL = aws.Bool(*value.NULL)
+	}
+	if value.BS != nil {
+		copied.BS = make([][]byte, len(value.BS))
+		for i, member := range value.BS {
+			copied.BS[i] = append([]byte{}, member...)
+		}
+	}
+	if value.M != nil {
+		copied.M = copyItem(value.M)
+	}
+	if value.L != nil {
+		copied.L = make([]*dynamodb.AttributeValue, len(value.L))
+		for i, member := range value.L {
+			copied.L[i] = copyAttributeValue(member)
+		}
+	}
+
+	return copied
+}
+
+func copyItem(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if item == nil {
+		return nil
+	}
+
+	copied := make(map[string]*dynamodb.AttributeValue, len(item))
+	for name, value := range item {
+		copied[name] = copyAttributeValue(value)
+	}
+	return copied
+}
+
+// A canonical string for a scalar key value, used to index stored items
+func scalarKey(value *dynamodb.AttributeValue) string {
+	switch {
+	case value.S != nil:
+		return "S:" + *value.S
+	case value.N != nil:
+		if rat, err := parseNumber(*value.N); err == nil {
+			return "N:" + formatNumber(rat)
+		}
+		return "N:" + *value.N
+	case value.B != nil:
+		return "B:" + string(value.B)
+	default:
+		return ""
+	}
+}
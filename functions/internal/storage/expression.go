@@ -0,0 +1,680 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// A parser and evaluator for the parts of the dynamodb expression language this repository writes
+// Anything else is rejected rather than guessed at, so tests can't pass on semantics dynamodb doesn't share
+// Conditions: comparisons, BETWEEN, AND, OR, parentheses, attribute_exists, attribute_not_exists and begins_with
+// Updates: SET to a value, if_not_exists or a sum of the two, REMOVE and ADD to numbers
+// Paths: attributes and nested map keys, no list indexes
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenIdentifier
+	tokenName
+	tokenValue
+	tokenSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func unsupported(feature string) error {
+	return fmt.Errorf("%s is not supported by the in-memory storage", feature)
+}
+
+func tokenize(expression string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); {
+		char := runes[i]
+
+		switch {
+		case unicode.IsSpace(char):
+			i++
+		case char == '#' || char == ':':
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			if i == start+1 {
+				return nil, fmt.Errorf("invalid expression: empty placeholder at %d", start)
+			}
+
+			kind := tokenName
+			if char == ':' {
+				kind = tokenValue
+			}
+			tokens = append(tokens, token{kind: kind, text: string(runes[start:i])})
+		case unicode.IsLetter(char) || char == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '-') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdentifier, text: string(runes[start:i])})
+		case char == '<' || char == '>':
+			if i+1 < len(runes) && (runes[i+1] == '=' || (char == '<' && runes[i+1] == '>')) {
+				tokens = append(tokens, token{kind: tokenSymbol, text: string(runes[i : i+2])})
+				i += 2
+			} else {
+				tokens = append(tokens, token{kind: tokenSymbol, text: string(char)})
+				i++
+			}
+		case strings.ContainsRune("=(),.+", char):
+			tokens = append(tokens, token{kind: tokenSymbol, text: string(char)})
+			i++
+		case char == '[' || char == '-':
+			return nil, unsupported(fmt.Sprintf("%q", char))
+		default:
+			return nil, fmt.Errorf("invalid expression: unexpected character %q", char)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEnd}), nil
+}
+
+// An attribute followed by the map keys leading into it
+type documentPath []string
+
+func (path documentPath) root() string {
+	return path[0]
+}
+
+type operand interface {
+	evaluate(item map[string]*dynamodb.AttributeValue) *dynamodb.AttributeValue
+}
+
+type pathOperand struct {
+	path documentPath
+}
+
+type valueOperand struct {
+	value *dynamodb.AttributeValue
+}
+
+type ifNotExistsOperand struct {
+	path     documentPath
+	fallback operand
+}
+
+type sumOperand struct {
+	left, right operand
+}
+
+type condition interface {
+	matches(item map[string]*dynamodb.AttributeValue) bool
+}
+
+type andCondition struct {
+	left, right condition
+}
+
+type orCondition struct {
+	left, right condition
+}
+
+type comparisonCondition struct {
+	left, right operand
+	comparator  string
+}
+
+type betweenCondition struct {
+	value, lower, upper operand
+}
+
+type functionCondition struct {
+	function string
+	path     documentPath
+	argument operand
+}
+
+type parser struct {
+	tokens   []token
+	position int
+	names    map[string]*string
+	values   map[string]*dynamodb.AttributeValue
+	// Placeholders used, dynamodb rejects requests which define unused ones
+	usedNames  map[string]bool
+	usedValues map[string]bool
+}
+
+func newParser(expression string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (*parser, error) {
+	tokens, tokenizeErr := tokenize(expression)
+	if tokenizeErr != nil {
+		return nil, tokenizeErr
+	}
+
+	return &parser{
+		tokens:     tokens,
+		names:      names,
+		values:     values,
+		usedNames:  map[string]bool{},
+		usedValues: map[string]bool{},
+	}, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.position]
+}
+
+func (p *parser) next() token {
+	current := p.tokens[p.position]
+	if current.kind != tokenEnd {
+		p.position++
+	}
+	return current
+}
+
+func (p *parser) isSymbol(symbol string) bool {
+	current := p.peek()
+	return current.kind == tokenSymbol && current.text == symbol
+}
+
+func (p *parser) isKeyword(keyword string) bool {
+	current := p.peek()
+	return current.kind == tokenIdentifier && strings.EqualFold(current.text, keyword)
+}
+
+// Whether a function call starts here
+func (p *parser) isFunction() bool {
+	following := p.tokens[p.position+1]
+	return p.peek().kind == tokenIdentifier && following.kind == tokenSymbol && following.text == "("
+}
+
+func (p *parser) expectSymbol(symbol string) error {
+	if !p.isSymbol(symbol) {
+		return fmt.Errorf("invalid expression: expected %q but found %q", symbol, p.peek().text)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) expectEnd() error {
+	if p.peek().kind != tokenEnd {
+		return fmt.Errorf("invalid expression: unexpected %q", p.peek().text)
+	}
+	return nil
+}
+
+func (p *parser) parsePathElementName() (string, error) {
+	current := p.next()
+
+	switch current.kind {
+	case tokenIdentifier:
+		return current.text, nil
+	case tokenName:
+		name, exists := p.names[current.text]
+		if !exists || name == nil {
+			return "", fmt.Errorf("invalid expression: undefined attribute name %s", current.text)
+		}
+		p.usedNames[current.text] = true
+		return *name, nil
+	default:
+		return "", fmt.Errorf("invalid expression: expected attribute name but found %q", current.text)
+	}
+}
+
+func (p *parser) parsePath() (documentPath, error) {
+	path := documentPath{}
+
+	for {
+		name, nameErr := p.parsePathElementName()
+		if nameErr != nil {
+			return nil, nameErr
+		}
+		path = append(path, name)
+
+		if !p.isSymbol(".") {
+			return path, nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) parseValue() (*dynamodb.AttributeValue, error) {
+	current := p.next()
+	value, exists := p.values[current.text]
+	if !exists || value == nil {
+		return nil, fmt.Errorf("invalid expression: undefined attribute value %s", current.text)
+	}
+	p.usedValues[current.text] = true
+	return value, nil
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	if p.peek().kind == tokenValue {
+		value, valueErr := p.parseValue()
+		if valueErr != nil {
+			return nil, valueErr
+		}
+		return valueOperand{value: value}, nil
+	}
+
+	if p.isFunction() {
+		function := p.next().text
+		if !strings.EqualFold(function, "if_not_exists") {
+			return nil, unsupported("function " + function)
+		}
+		p.next()
+
+		path, pathErr := p.parsePath()
+		if pathErr != nil {
+			return nil, pathErr
+		}
+		if err := p.expectSymbol(","); err != nil {
+			return nil, err
+		}
+		fallback, fallbackErr := p.parseOperand()
+		if fallbackErr != nil {
+			return nil, fallbackErr
+		}
+		return ifNotExistsOperand{path: path, fallback: fallback}, p.expectSymbol(")")
+	}
+
+	path, pathErr := p.parsePath()
+	if pathErr != nil {
+		return nil, pathErr
+	}
+	return pathOperand{path: path}, nil
+}
+
+func (p *parser) parseCondition() (condition, error) {
+	left, leftErr := p.parseAnd()
+	if leftErr != nil {
+		return nil, leftErr
+	}
+
+	for p.isKeyword("OR") {
+		p.next()
+		right, rightErr := p.parseAnd()
+		if rightErr != nil {
+			return nil, rightErr
+		}
+		left = orCondition{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (condition, error) {
+	left, leftErr := p.parsePrimary()
+	if leftErr != nil {
+		return nil, leftErr
+	}
+
+	for p.isKeyword("AND") {
+		p.next()
+		right, rightErr := p.parsePrimary()
+		if rightErr != nil {
+			return nil, rightErr
+		}
+		left = andCondition{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parsePrimary() (condition, error) {
+	if p.isSymbol("(") {
+		p.next()
+		inner, innerErr := p.parseCondition()
+		if innerErr != nil {
+			return nil, innerErr
+		}
+		return inner, p.expectSymbol(")")
+	}
+	if p.isKeyword("NOT") {
+		return nil, unsupported("NOT")
+	}
+
+	if p.isFunction() {
+		function := strings.ToLower(p.next().text)
+		if function != "attribute_exists" && function != "attribute_not_exists" && function != "begins_with" {
+			return nil, unsupported("function " + function)
+		}
+		p.next()
+
+		path, pathErr := p.parsePath()
+		if pathErr != nil {
+			return nil, pathErr
+		}
+
+		var argument operand
+		if function == "begins_with" {
+			if err := p.expectSymbol(","); err != nil {
+				return nil, err
+			}
+			var argumentErr error
+			if argument, argumentErr = p.parseOperand(); argumentErr != nil {
+				return nil, argumentErr
+			}
+		}
+
+		return functionCondition{function: function, path: path, argument: argument}, p.expectSymbol(")")
+	}
+
+	left, leftErr := p.parseOperand()
+	if leftErr != nil {
+		return nil, leftErr
+	}
+
+	if p.isKeyword("BETWEEN") {
+		p.next()
+		lower, lowerErr := p.parseOperand()
+		if lowerErr != nil {
+			return nil, lowerErr
+		}
+		if !p.isKeyword("AND") {
+			return nil, fmt.Errorf("invalid expression: expected AND in BETWEEN")
+		}
+		p.next()
+		upper, upperErr := p.parseOperand()
+		if upperErr != nil {
+			return nil, upperErr
+		}
+		return betweenCondition{value: left, lower: lower, upper: upper}, nil
+	}
+	if p.isKeyword("IN") {
+		return nil, unsupported("IN")
+	}
+
+	comparator := p.next()
+	switch comparator.text {
+	case "=", "<>", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("invalid expression: expected comparator but found %q", comparator.text)
+	}
+
+	right, rightErr := p.parseOperand()
+	if rightErr != nil {
+		return nil, rightErr
+	}
+
+	return comparisonCondition{left: left, right: right, comparator: comparator.text}, nil
+}
+
+func parseCondition(expression string, names map[string]*string, values map[string]*dynamodb.AttributeValue, usage *placeholderUsage) (condition, error) {
+	p, parserErr := newParser(expression, names, values)
+	if parserErr != nil {
+		return nil, parserErr
+	}
+
+	parsed, parseErr := p.parseCondition()
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	if endErr := p.expectEnd(); endErr != nil {
+		return nil, endErr
+	}
+
+	usage.add(p)
+	return parsed, nil
+}
+
+// Projections only ever name top level attributes
+func parseProjection(expression string, names map[string]*string, usage *placeholderUsage) ([]string, error) {
+	p, parserErr := newParser(expression, names, nil)
+	if parserErr != nil {
+		return nil, parserErr
+	}
+
+	attributes := []string{}
+	for {
+		name, nameErr := p.parsePathElementName()
+		if nameErr != nil {
+			return nil, nameErr
+		}
+		attributes = append(attributes, name)
+
+		if p.isSymbol(".") {
+			return nil, unsupported("projecting nested attributes")
+		}
+		if !p.isSymbol(",") {
+			break
+		}
+		p.next()
+	}
+	if endErr := p.expectEnd(); endErr != nil {
+		return nil, endErr
+	}
+
+	usage.add(p)
+	return attributes, nil
+}
+
+type updateAction struct {
+	clause string
+	path   documentPath
+	value  operand
+}
+
+func parseUpdate(expression string, names map[string]*string, values map[string]*dynamodb.AttributeValue, usage *placeholderUsage) ([]updateAction, error) {
+	p, parserErr := newParser(expression, names, values)
+	if parserErr != nil {
+		return nil, parserErr
+	}
+
+	actions := []updateAction{}
+	seenClauses := map[string]bool{}
+
+	for p.peek().kind != tokenEnd {
+		clauseToken := p.next()
+		clause := strings.ToUpper(clauseToken.text)
+		if clauseToken.kind == tokenIdentifier && clause == "DELETE" {
+			return nil, unsupported("DELETE")
+		}
+		if clauseToken.kind != tokenIdentifier || (clause != "SET" && clause != "REMOVE" && clause != "ADD") {
+			return nil, fmt.Errorf("invalid update expression: unexpected %q", clauseToken.text)
+		}
+		if seenClauses[clause] {
+			return nil, fmt.Errorf("invalid update expression: %s clause repeated", clause)
+		}
+		seenClauses[clause] = true
+
+		for {
+			path, pathErr := p.parsePath()
+			if pathErr != nil {
+				return nil, pathErr
+			}
+			action := updateAction{clause: clause, path: path}
+
+			switch clause {
+			case "SET":
+				if err := p.expectSymbol("="); err != nil {
+					return nil, err
+				}
+				value, valueErr := p.parseOperand()
+				if valueErr != nil {
+					return nil, valueErr
+				}
+				if p.isSymbol("+") {
+					p.next()
+					right, rightErr := p.parseOperand()
+					if rightErr != nil {
+						return nil, rightErr
+					}
+					value = sumOperand{left: value, right: right}
+				}
+				action.value = value
+			case "ADD":
+				if len(path) > 1 {
+					return nil, fmt.Errorf("invalid update expression: ADD only applies to top level attributes")
+				}
+				value, valueErr := p.parseOperand()
+				if valueErr != nil {
+					return nil, valueErr
+				}
+				action.value = value
+			}
+
+			actions = append(actions, action)
+			if !p.isSymbol(",") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if len(actions) == 0 {
+		return nil, fmt.Errorf("invalid update expression: no actions")
+	}
+
+	usage.add(p)
+	return actions, nil
+}
+
+// Tracks placeholders across every expression of a request
+type placeholderUsage struct {
+	names  map[string]bool
+	values map[string]bool
+}
+
+func newPlaceholderUsage() *placeholderUsage {
+	return &placeholderUsage{names: map[string]bool{}, values: map[string]bool{}}
+}
+
+func (usage *placeholderUsage) add(p *parser) {
+	for name := range p.usedNames {
+		usage.names[name] = true
+	}
+	for value := range p.usedValues {
+		usage.values[value] = true
+	}
+}
+
+func (usage *placeholderUsage) check(names map[string]*string, values map[string]*dynamodb.AttributeValue) error {
+	for name := range names {
+		if !usage.names[name] {
+			return fmt.Errorf("value provided in ExpressionAttributeNames unused in expressions: keys: {%s}", name)
+		}
+	}
+	for value := range values {
+		if !usage.values[value] {
+			return fmt.Errorf("value provided in ExpressionAttributeValues unused in expressions: keys: {%s}", value)
+		}
+	}
+	return nil
+}
+
+func resolvePath(item map[string]*dynamodb.AttributeValue, path documentPath) *dynamodb.AttributeValue {
+	current, exists := item[path.root()]
+	if !exists {
+		return nil
+	}
+
+	for _, name := range path[1:] {
+		if current.M == nil {
+			return nil
+		}
+		if current, exists = current.M[name]; !exists {
+			return nil
+		}
+	}
+
+	return current
+}
+
+func (operand pathOperand) evaluate(item map[string]*dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	return resolvePath(item, operand.path)
+}
+
+func (operand valueOperand) evaluate(item map[string]*dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	return operand.value
+}
+
+func (operand ifNotExistsOperand) evaluate(item map[string]*dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if value := resolvePath(item, operand.path); value != nil {
+		return value
+	}
+	return operand.fallback.evaluate(item)
+}
+
+func (operand sumOperand) evaluate(item map[string]*dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	left, right := operand.left.evaluate(item), operand.right.evaluate(item)
+	if left == nil || right == nil || left.N == nil || right.N == nil {
+		return nil
+	}
+
+	result, err := addNumbers(*left.N, *right.N)
+	if err != nil {
+		return nil
+	}
+	return numberValue(result)
+}
+
+func (c andCondition) matches(item map[string]*dynamodb.AttributeValue) bool {
+	return c.left.matches(item) && c.right.matches(item)
+}
+
+func (c orCondition) matches(item map[string]*dynamodb.AttributeValue) bool {
+	return c.left.matches(item) || c.right.matches(item)
+}
+
+func (c comparisonCondition) matches(item map[string]*dynamodb.AttributeValue) bool {
+	left, right := c.left.evaluate(item), c.right.evaluate(item)
+	if left == nil || right == nil {
+		return c.comparator == "<>" && (left != nil || right != nil)
+	}
+
+	if c.comparator == "=" {
+		return scalarsEqual(left, right)
+	} else if c.comparator == "<>" {
+		return !scalarsEqual(left, right)
+	}
+
+	order, comparable := compareAttributeValues(left, right)
+	if !comparable {
+		return false
+	}
+
+	switch c.comparator {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+func (c betweenCondition) matches(item map[string]*dynamodb.AttributeValue) bool {
+	value, lower, upper := c.value.evaluate(item), c.lower.evaluate(item), c.upper.evaluate(item)
+	if value == nil || lower == nil || upper == nil {
+		return false
+	}
+
+	lowerOrder, lowerComparable := compareAttributeValues(value, lower)
+	upperOrder, upperComparable := compareAttributeValues(value, upper)
+	return lowerComparable && upperComparable && lowerOrder >= 0 && upperOrder <= 0
+}
+
+func (c functionCondition) matches(item map[string]*dynamodb.AttributeValue) bool {
+	value := resolvePath(item, c.path)
+
+	switch c.function {
+	case "attribute_exists":
+		return value != nil
+	case "attribute_not_exists":
+		return value == nil
+	}
+
+	argument := c.argument.evaluate(item)
+	if value == nil || argument == nil || value.S == nil || argument.S == nil {
+		return false
+	}
+	return strings.HasPrefix(*value.S, *argument.S)
+}
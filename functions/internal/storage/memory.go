@@ -0,0 +1,786 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const errCodeValidation = "ValidationException"
+
+// An in-memory stand-in for dynamodb covering only the requests this repository makes, for tests and local runs
+// Operations outside of Storage panic, and expressions or options nothing here uses are rejected as unsupported
+// Anything relying on more of dynamodb belongs in a test against DynamoDB Local through ENDPOINT instead
+type MemoryStorage struct {
+	dynamodbiface.DynamoDBAPI
+	mutex  sync.Mutex
+	cfg    *config.Config
+	tables map[string]*memoryTable
+}
+
+type memoryTable struct {
+	schema TableSchema
+	items  map[string]map[string]*dynamodb.AttributeValue
+}
+
+// Holds every table of the configuration, empty to begin with
+func NewMemoryStorage(cfg *config.Config) *MemoryStorage {
+	memory := &MemoryStorage{cfg: cfg, tables: map[string]*memoryTable{}}
+
+	for _, schema := range Schemas(cfg) {
+		memory.tables[schema.Name] = &memoryTable{
+			schema: schema,
+			items:  map[string]map[string]*dynamodb.AttributeValue{},
+		}
+	}
+
+	return memory
+}
+
+func (memory *MemoryStorage) Config() *config.Config {
+	return memory.cfg
+}
+
+func validationError(format string, args ...interface{}) error {
+	return awserr.New(errCodeValidation, fmt.Sprintf(format, args...), nil)
+}
+
+func canceledError(ctx aws.Context) error {
+	return awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+}
+
+func conditionFailedError() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+func (memory *MemoryStorage) table(tableName *string) (*memoryTable, error) {
+	if tableName == nil {
+		return nil, validationError("TableName is required")
+	}
+
+	table, exists := memory.tables[*tableName]
+	if !exists {
+		return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "Requested resource not found: Table: "+*tableName+" not found", nil)
+	}
+	return table, nil
+}
+
+// Builds the storage key for an item, failing unless every key attribute is a scalar
+func (table *memoryTable) itemKey(item map[string]*dynamodb.AttributeValue, exact bool) (string, error) {
+	names := table.schema.names()
+	if exact && len(item) != len(names) {
+		return "", validationError("The provided key element does not match the schema")
+	}
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		value, exists := item[name]
+		if !exists || value == nil {
+			return "", validationError("The provided key element does not match the schema")
+		}
+
+		parts[i] = scalarKey(value)
+		if parts[i] == "" {
+			return "", validationError("The provided key element does not match the schema")
+		}
+	}
+
+	return strings.Join(parts, "\x00"), nil
+}
+
+func (table *memoryTable) keyAttributes(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	key := map[string]*dynamodb.AttributeValue{}
+	for _, name := range table.schema.names() {
+		key[name] = copyAttributeValue(item[name])
+	}
+	return key
+}
+
+func (table *memoryTable) indexSchema(indexName *string) (KeySchema, error) {
+	if indexName == nil {
+		return table.schema.KeySchema, nil
+	}
+
+	index, exists := table.schema.Indexes[*indexName]
+	if !exists {
+		return KeySchema{}, validationError("The table does not have the specified index: %s", *indexName)
+	}
+	return index, nil
+}
+
+func project(item map[string]*dynamodb.AttributeValue, attributes []string) map[string]*dynamodb.AttributeValue {
+	if attributes == nil {
+		return copyItem(item)
+	}
+
+	projected := map[string]*dynamodb.AttributeValue{}
+	for _, attribute := range attributes {
+		if value, exists := item[attribute]; exists {
+			projected[attribute] = copyAttributeValue(value)
+		}
+	}
+	return projected
+}
+
+func (memory *MemoryStorage) parseConditionInput(expression *string, names map[string]*string, values map[string]*dynamodb.AttributeValue, usage *placeholderUsage) (condition, error) {
+	if expression == nil {
+		return nil, nil
+	}
+
+	parsed, parseErr := parseCondition(*expression, names, values, usage)
+	if parseErr != nil {
+		return nil, validationError("Invalid ConditionExpression: %s", parseErr)
+	}
+	return parsed, nil
+}
+
+func (memory *MemoryStorage) parseProjectionInput(expression *string, names map[string]*string, usage *placeholderUsage) ([]string, error) {
+	if expression == nil {
+		return nil, nil
+	}
+
+	attributes, parseErr := parseProjection(*expression, names, usage)
+	if parseErr != nil {
+		return nil, validationError("Invalid ProjectionExpression: %s", parseErr)
+	}
+	return attributes, nil
+}
+
+func checkUsage(usage *placeholderUsage, names map[string]*string, values map[string]*dynamodb.AttributeValue) error {
+	if usageErr := usage.check(names, values); usageErr != nil {
+		return validationError("%s", usageErr)
+	}
+	return nil
+}
+
+func conditionMatches(parsed condition, item map[string]*dynamodb.AttributeValue) bool {
+	if parsed == nil {
+		return true
+	}
+	if item == nil {
+		item = map[string]*dynamodb.AttributeValue{}
+	}
+	return parsed.matches(item)
+}
+
+// Updates can hand back the whole new item, every other request returns nothing
+func checkReturnValues(returnValues *string, supported ...string) error {
+	if returnValues == nil || *returnValues == dynamodb.ReturnValueNone {
+		return nil
+	}
+
+	for _, value := range supported {
+		if *returnValues == value {
+			return nil
+		}
+	}
+	return validationError("%s", unsupported("ReturnValues "+*returnValues))
+}
+
+func (memory *MemoryStorage) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	if ctx.Err() != nil {
+		return nil, canceledError(ctx)
+	}
+
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	table, tableErr := memory.table(input.TableName)
+	if tableErr != nil {
+		return nil, tableErr
+	}
+
+	key, keyErr := table.itemKey(input.Key, true)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	usage := newPlaceholderUsage()
+	projection, projectionErr := memory.parseProjectionInput(input.ProjectionExpression, input.ExpressionAttributeNames, usage)
+	if projectionErr != nil {
+		return nil, projectionErr
+	}
+	if usageErr := checkUsage(usage, input.ExpressionAttributeNames, nil); usageErr != nil {
+		return nil, usageErr
+	}
+
+	item, exists := table.items[key]
+	if !exists {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	return &dynamodb.GetItemOutput{Item: project(item, projection)}, nil
+}
+
+func (memory *MemoryStorage) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	if ctx.Err() != nil {
+		return nil, canceledError(ctx)
+	}
+
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	total := 0
+	for tableName, keysAndAttributes := range input.RequestItems {
+		if _, tableErr := memory.table(aws.String(tableName)); tableErr != nil {
+			return nil, tableErr
+		}
+		total += len(keysAndAttributes.Keys)
+	}
+	if total == 0 || total > 100 {
+		return nil, validationError("Too many items requested for the BatchGetItem call")
+	}
+
+	responses := map[string][]map[string]*dynamodb.AttributeValue{}
+	for tableName, keysAndAttributes := range input.RequestItems {
+		table := memory.tables[tableName]
+
+		usage := newPlaceholderUsage()
+		projection, projectionErr := memory.parseProjectionInput(keysAndAttributes.ProjectionExpression, keysAndAttributes.ExpressionAttributeNames, usage)
+		if projectionErr != nil {
+			return nil, projectionErr
+		}
+		if usageErr := checkUsage(usage, keysAndAttributes.ExpressionAttributeNames, nil); usageErr != nil {
+			return nil, usageErr
+		}
+
+		requested := map[string]bool{}
+		items := []map[string]*dynamodb.AttributeValue{}
+		for _, tableKey := range keysAndAttributes.Keys {
+			key, keyErr := table.itemKey(tableKey, true)
+			if keyErr != nil {
+				return nil, keyErr
+			}
+			if requested[key] {
+				return nil, validationError("Provided list of item keys contains duplicates")
+			}
+			requested[key] = true
+
+			if item, exists := table.items[key]; exists {
+				items = append(items, project(item, projection))
+			}
+		}
+		responses[tableName] = items
+	}
+
+	return &dynamodb.BatchGetItemOutput{
+		Responses:       responses,
+		UnprocessedKeys: map[string]*dynamodb.KeysAndAttributes{},
+	}, nil
+}
+
+func (memory *MemoryStorage) putItem(table *memoryTable, input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	key, keyErr := table.itemKey(input.Item, false)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	if returnErr := checkReturnValues(input.ReturnValues); returnErr != nil {
+		return nil, returnErr
+	}
+
+	usage := newPlaceholderUsage()
+	parsedCondition, conditionErr := memory.parseConditionInput(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, usage)
+	if conditionErr != nil {
+		return nil, conditionErr
+	}
+	if usageErr := checkUsage(usage, input.ExpressionAttributeNames, input.ExpressionAttributeValues); usageErr != nil {
+		return nil, usageErr
+	}
+
+	oldItem := table.items[key]
+	if !conditionMatches(parsedCondition, oldItem) {
+		return nil, conditionFailedError()
+	}
+
+	table.items[key] = copyItem(input.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (memory *MemoryStorage) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	if ctx.Err() != nil {
+		return nil, canceledError(ctx)
+	}
+
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	table, tableErr := memory.table(input.TableName)
+	if tableErr != nil {
+		return nil, tableErr
+	}
+
+	return memory.putItem(table, input)
+}
+
+func (memory *MemoryStorage) deleteItem(table *memoryTable, input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	key, keyErr := table.itemKey(input.Key, true)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	if returnErr := checkReturnValues(input.ReturnValues); returnErr != nil {
+		return nil, returnErr
+	}
+
+	usage := newPlaceholderUsage()
+	parsedCondition, conditionErr := memory.parseConditionInput(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, usage)
+	if conditionErr != nil {
+		return nil, conditionErr
+	}
+	if usageErr := checkUsage(usage, input.ExpressionAttributeNames, input.ExpressionAttributeValues); usageErr != nil {
+		return nil, usageErr
+	}
+
+	oldItem := table.items[key]
+	if !conditionMatches(parsedCondition, oldItem) {
+		return nil, conditionFailedError()
+	}
+
+	delete(table.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (memory *MemoryStorage) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	if ctx.Err() != nil {
+		return nil, canceledError(ctx)
+	}
+
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	table, tableErr := memory.table(input.TableName)
+	if tableErr != nil {
+		return nil, tableErr
+	}
+
+	return memory.deleteItem(table, input)
+}
+
+func (memory *MemoryStorage) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	if ctx.Err() != nil {
+		return nil, canceledError(ctx)
+	}
+
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	table, tableErr := memory.table(input.TableName)
+	if tableErr != nil {
+		return nil, tableErr
+	}
+
+	return memory.updateItem(table, input)
+}
+
+func (memory *MemoryStorage) updateItem(table *memoryTable, input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	key, keyErr := table.itemKey(input.Key, true)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	if returnErr := checkReturnValues(input.ReturnValues, dynamodb.ReturnValueAllNew); returnErr != nil {
+		return nil, returnErr
+	}
+
+	usage := newPlaceholderUsage()
+	parsedCondition, conditionErr := memory.parseConditionInput(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, usage)
+	if conditionErr != nil {
+		return nil, conditionErr
+	}
+
+	if input.UpdateExpression == nil {
+		return nil, validationError("UpdateExpression is required")
+	}
+	actions, updateErr := parseUpdate(*input.UpdateExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, usage)
+	if updateErr != nil {
+		return nil, validationError("Invalid UpdateExpression: %s", updateErr)
+	}
+	if usageErr := checkUsage(usage, input.ExpressionAttributeNames, input.ExpressionAttributeValues); usageErr != nil {
+		return nil, usageErr
+	}
+
+	oldItem := table.items[key]
+	if !conditionMatches(parsedCondition, oldItem) {
+		return nil, conditionFailedError()
+	}
+
+	newItem := copyItem(oldItem)
+	if newItem == nil {
+		newItem = copyItem(input.Key)
+	}
+
+	if applyErr := applyUpdate(newItem, actions, table.schema.names()); applyErr != nil {
+		return nil, validationError("%s", applyErr)
+	}
+	table.items[key] = newItem
+
+	output := &dynamodb.UpdateItemOutput{}
+	if input.ReturnValues != nil && *input.ReturnValues == dynamodb.ReturnValueAllNew {
+		output.Attributes = copyItem(newItem)
+	}
+	return output, nil
+}
+
+func (memory *MemoryStorage) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	if ctx.Err() != nil {
+		return nil, canceledError(ctx)
+	}
+
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	table, tableErr := memory.table(input.TableName)
+	if tableErr != nil {
+		return nil, tableErr
+	}
+
+	keySchema, indexErr := table.indexSchema(input.IndexName)
+	if indexErr != nil {
+		return nil, indexErr
+	}
+	if input.Select != nil {
+		return nil, validationError("%s", unsupported("Select"))
+	}
+
+	usage := newPlaceholderUsage()
+	if input.KeyConditionExpression == nil {
+		return nil, validationError("KeyConditionExpression is required")
+	}
+	keyCondition, keyConditionErr := parseCondition(*input.KeyConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, usage)
+	if keyConditionErr != nil {
+		return nil, validationError("Invalid KeyConditionExpression: %s", keyConditionErr)
+	}
+
+	var filter condition
+	if input.FilterExpression != nil {
+		var filterErr error
+		if filter, filterErr = parseCondition(*input.FilterExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, usage); filterErr != nil {
+			return nil, validationError("Invalid FilterExpression: %s", filterErr)
+		}
+	}
+
+	projection, projectionErr := memory.parseProjectionInput(input.ProjectionExpression, input.ExpressionAttributeNames, usage)
+	if projectionErr != nil {
+		return nil, projectionErr
+	}
+	if usageErr := checkUsage(usage, input.ExpressionAttributeNames, input.ExpressionAttributeValues); usageErr != nil {
+		return nil, usageErr
+	}
+
+	// Indexes are sparse, items missing an index key attribute never appear in it
+	candidates := []map[string]*dynamodb.AttributeValue{}
+	for _, item := range table.items {
+		indexed := true
+		for _, name := range keySchema.names() {
+			if value, exists := item[name]; !exists || scalarKey(value) == "" {
+				indexed = false
+			}
+		}
+
+		if indexed && keyCondition.matches(item) {
+			candidates = append(candidates, item)
+		}
+	}
+
+	sortKeys := append(keySchema.names(), table.schema.names()...)
+	compareItems := func(first, second map[string]*dynamodb.AttributeValue) int {
+		for _, name := range sortKeys {
+			if order, _ := compareAttributeValues(first[name], second[name]); order != 0 {
+				return order
+			}
+		}
+		return 0
+	}
+
+	forward := input.ScanIndexForward == nil || *input.ScanIndexForward
+	sort.Slice(candidates, func(i, j int) bool {
+		if forward {
+			return compareItems(candidates[i], candidates[j]) < 0
+		}
+		return compareItems(candidates[i], candidates[j]) > 0
+	})
+
+	if input.ExclusiveStartKey != nil {
+		start := 0
+		for start < len(candidates) {
+			order := compareItems(candidates[start], input.ExclusiveStartKey)
+			if (forward && order > 0) || (!forward && order < 0) {
+				break
+			}
+			start++
+		}
+		candidates = candidates[start:]
+	}
+
+	var lastEvaluatedKey map[string]*dynamodb.AttributeValue
+	if input.Limit != nil && int(*input.Limit) < len(candidates) {
+		candidates = candidates[:*input.Limit]
+
+		last := candidates[len(candidates)-1]
+		lastEvaluatedKey = table.keyAttributes(last)
+		for _, name := range keySchema.names() {
+			lastEvaluatedKey[name] = copyAttributeValue(last[name])
+		}
+	}
+
+	items := []map[string]*dynamodb.AttributeValue{}
+	for _, item := range candidates {
+		if filter == nil || filter.matches(item) {
+			items = append(items, project(item, projection))
+		}
+	}
+
+	return &dynamodb.QueryOutput{
+		Items:            items,
+		Count:            aws.Int64(int64(len(items))),
+		ScannedCount:     aws.Int64(int64(len(candidates))),
+		LastEvaluatedKey: lastEvaluatedKey,
+	}, nil
+}
+
+func (memory *MemoryStorage) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, callback func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	pageInput := *input
+
+	for {
+		output, queryErr := memory.QueryWithContext(ctx, &pageInput, opts...)
+		if queryErr != nil {
+			return queryErr
+		}
+
+		lastPage := output.LastEvaluatedKey == nil
+		if !callback(output, lastPage) || lastPage {
+			return nil
+		}
+		pageInput.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+func (memory *MemoryStorage) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	if ctx.Err() != nil {
+		return nil, canceledError(ctx)
+	}
+
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	total := 0
+	for tableName, writeRequests := range input.RequestItems {
+		if _, tableErr := memory.table(aws.String(tableName)); tableErr != nil {
+			return nil, tableErr
+		}
+		total += len(writeRequests)
+	}
+	if total == 0 || total > 25 {
+		return nil, validationError("Too many items requested for the BatchWriteItem call")
+	}
+
+	for tableName, writeRequests := range input.RequestItems {
+		table := memory.tables[tableName]
+
+		for _, writeRequest := range writeRequests {
+			var writeErr error
+			if writeRequest.PutRequest != nil {
+				_, writeErr = memory.putItem(table, &dynamodb.PutItemInput{Item: writeRequest.PutRequest.Item})
+			} else if writeRequest.DeleteRequest != nil {
+				_, writeErr = memory.deleteItem(table, &dynamodb.DeleteItemInput{Key: writeRequest.DeleteRequest.Key})
+			} else {
+				writeErr = validationError("Write request must contain a put or delete")
+			}
+
+			if writeErr != nil {
+				return nil, writeErr
+			}
+		}
+	}
+
+	return &dynamodb.BatchWriteItemOutput{
+		UnprocessedItems: map[string][]*dynamodb.WriteRequest{},
+	}, nil
+}
+
+func (memory *MemoryStorage) conditionCheck(table *memoryTable, input *dynamodb.ConditionCheck) error {
+	key, keyErr := table.itemKey(input.Key, true)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	usage := newPlaceholderUsage()
+	if input.ConditionExpression == nil {
+		return validationError("ConditionExpression is required")
+	}
+	parsedCondition, conditionErr := memory.parseConditionInput(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, usage)
+	if conditionErr != nil {
+		return conditionErr
+	}
+	if usageErr := checkUsage(usage, input.ExpressionAttributeNames, input.ExpressionAttributeValues); usageErr != nil {
+		return usageErr
+	}
+
+	if !conditionMatches(parsedCondition, table.items[key]) {
+		return conditionFailedError()
+	}
+	return nil
+}
+
+// The table, key and write of a single transaction item, which must hold exactly one operation
+func (memory *MemoryStorage) transactWrite(transactItem *dynamodb.TransactWriteItem) (*memoryTable, string, *string, func(*memoryTable) error, error) {
+	var tableName *string
+	var tableKey map[string]*dynamodb.AttributeValue
+	var returnValues *string
+	var write func(*memoryTable) error
+	operations := 0
+
+	if put := transactItem.Put; put != nil {
+		operations++
+		tableName, tableKey, returnValues = put.TableName, put.Item, put.ReturnValuesOnConditionCheckFailure
+		write = func(table *memoryTable) error {
+			_, err := memory.putItem(table, &dynamodb.PutItemInput{
+				Item:                      put.Item,
+				ConditionExpression:       put.ConditionExpression,
+				ExpressionAttributeNames:  put.ExpressionAttributeNames,
+				ExpressionAttributeValues: put.ExpressionAttributeValues,
+			})
+			return err
+		}
+	}
+	if update := transactItem.Update; update != nil {
+		operations++
+		tableName, tableKey, returnValues = update.TableName, update.Key, update.ReturnValuesOnConditionCheckFailure
+		write = func(table *memoryTable) error {
+			_, err := memory.updateItem(table, &dynamodb.UpdateItemInput{
+				Key:                       update.Key,
+				UpdateExpression:          update.UpdateExpression,
+				ConditionExpression:       update.ConditionExpression,
+				ExpressionAttributeNames:  update.ExpressionAttributeNames,
+				ExpressionAttributeValues: update.ExpressionAttributeValues,
+			})
+			return err
+		}
+	}
+	if deleteItem := transactItem.Delete; deleteItem != nil {
+		operations++
+		tableName, tableKey, returnValues = deleteItem.TableName, deleteItem.Key, deleteItem.ReturnValuesOnConditionCheckFailure
+		write = func(table *memoryTable) error {
+			_, err := memory.deleteItem(table, &dynamodb.DeleteItemInput{
+				Key:                       deleteItem.Key,
+				ConditionExpression:       deleteItem.ConditionExpression,
+				ExpressionAttributeNames:  deleteItem.ExpressionAttributeNames,
+				ExpressionAttributeValues: deleteItem.ExpressionAttributeValues,
+			})
+			return err
+		}
+	}
+	if check := transactItem.ConditionCheck; check != nil {
+		operations++
+		tableName, tableKey, returnValues = check.TableName, check.Key, check.ReturnValuesOnConditionCheckFailure
+		write = func(table *memoryTable) error {
+			return memory.conditionCheck(table, check)
+		}
+	}
+
+	if operations != 1 {
+		return nil, "", nil, nil, validationError("TransactItems can only contain one of Check, Put, Update or Delete")
+	}
+
+	table, tableErr := memory.table(tableName)
+	if tableErr != nil {
+		return nil, "", nil, nil, tableErr
+	}
+	key, keyErr := table.itemKey(tableKey, false)
+	if keyErr != nil {
+		return nil, "", nil, nil, keyErr
+	}
+
+	return table, key, returnValues, write, nil
+}
+
+// Applies every write or none of them, reporting why each item was cancelled like dynamodb does
+func (memory *MemoryStorage) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	if ctx.Err() != nil {
+		return nil, canceledError(ctx)
+	}
+
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	if len(input.TransactItems) == 0 || len(input.TransactItems) > 100 {
+		return nil, validationError("Member must have length less than or equal to 100")
+	}
+
+	// Items are only ever replaced, so copying each table's item map is enough to roll back
+	snapshots := map[*memoryTable]map[string]map[string]*dynamodb.AttributeValue{}
+	rollback := func() {
+		for table, items := range snapshots {
+			table.items = items
+		}
+	}
+
+	written := map[*memoryTable]map[string]bool{}
+	reasons := make([]*dynamodb.CancellationReason, len(input.TransactItems))
+	cancelled := false
+
+	for i, transactItem := range input.TransactItems {
+		table, key, returnValues, write, transactErr := memory.transactWrite(transactItem)
+		if transactErr != nil {
+			rollback()
+			return nil, transactErr
+		}
+
+		if written[table] == nil {
+			written[table] = map[string]bool{}
+		}
+		if written[table][key] {
+			rollback()
+			return nil, validationError("Transaction request cannot include multiple operations on one item")
+		}
+		written[table][key] = true
+
+		if _, exists := snapshots[table]; !exists {
+			items := map[string]map[string]*dynamodb.AttributeValue{}
+			for itemKey, item := range table.items {
+				items[itemKey] = item
+			}
+			snapshots[table] = items
+		}
+
+		oldItem := table.items[key]
+		reasons[i] = &dynamodb.CancellationReason{Code: aws.String("None")}
+
+		if writeErr := write(table); writeErr != nil {
+			awsErr, isAWSErr := writeErr.(awserr.Error)
+			if !isAWSErr || awsErr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+				rollback()
+				return nil, writeErr
+			}
+
+			cancelled = true
+			reasons[i] = &dynamodb.CancellationReason{
+				Code:    aws.String("ConditionalCheckFailed"),
+				Message: aws.String(awsErr.Message()),
+			}
+			if returnValues != nil && *returnValues == dynamodb.ReturnValuesOnConditionCheckFailureAllOld {
+				reasons[i].Item = copyItem(oldItem)
+			}
+		}
+	}
+
+	if cancelled {
+		rollback()
+
+		codes := make([]string, len(reasons))
+		for i, reason := range reasons {
+			codes[i] = *reason.Code
+		}
+		return nil, &dynamodb.TransactionCanceledException{
+			Message_:            aws.String("Transaction cancelled, please refer cancellation reasons for specific reasons [" + strings.Join(codes, ", ") + "]"),
+			CancellationReasons: reasons,
+		}
+	}
+
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
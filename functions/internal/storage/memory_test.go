@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func putMediaItem(t *testing.T, memory *MemoryStorage, sk string, lastUpdate string) {
+	item := map[string]*dynamodb.AttributeValue{
+		"pk": {S: aws.String("vn#username")},
+		"sk": {S: aws.String(sk)},
+	}
+	if lastUpdate != "" {
+		item["last_update"] = &dynamodb.AttributeValue{N: aws.String(lastUpdate)}
+	}
+
+	_, putErr := memory.PutItemWithContext(context.Background(), &dynamodb.PutItemInput{
+		TableName: aws.String("media"),
+		Item:      item,
+	})
+	assert.NoError(t, putErr)
+}
+
+func TestKeyConditions(t *testing.T) {
+	memory := NewMemoryStorage(config.Defaults())
+	putMediaItem(t, memory, "identifier", "30")
+	putMediaItem(t, memory, "0000000000000010#identifier", "10")
+	putMediaItem(t, memory, "0000000000000020#identifier", "")
+
+	result, queryErr := memory.QueryWithContext(context.Background(), &dynamodb.QueryInput{
+		TableName:              aws.String("media"),
+		KeyConditionExpression: aws.String("pk = :pk AND begins_with(sk, :prefix)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk":     {S: aws.String("vn#username")},
+			":prefix": {S: aws.String("0")},
+		},
+		ScanIndexForward: aws.Bool(false),
+	})
+	assert.NoError(t, queryErr)
+	assert.Len(t, result.Items, 2)
+	assert.Equal(t, "0000000000000020#identifier", *result.Items[0]["sk"].S)
+
+	// Items without the index range key are left out of the index
+	result, queryErr = memory.QueryWithContext(context.Background(), &dynamodb.QueryInput{
+		TableName:              aws.String("media"),
+		IndexName:              aws.String("lastUpdatedIndex"),
+		KeyConditionExpression: aws.String("pk = :pk AND last_update > :last_update"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk":          {S: aws.String("vn#username")},
+			":last_update": {N: aws.String("5")},
+		},
+	})
+	assert.NoError(t, queryErr)
+	assert.Len(t, result.Items, 2)
+	assert.Equal(t, "10", *result.Items[0]["last_update"].N)
+}
+
+func TestQueryPages(t *testing.T) {
+	memory := NewMemoryStorage(config.Defaults())
+	for _, sk := range []string{"a", "b", "c", "d", "e"} {
+		putMediaItem(t, memory, sk, "1")
+	}
+
+	pages, items := 0, []string{}
+	pagesErr := memory.QueryPagesWithContext(context.Background(), &dynamodb.QueryInput{
+		TableName:              aws.String("media"),
+		KeyConditionExpression: aws.String("pk = :pk"),
+		FilterExpression:       aws.String("sk <> :skipped"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk":      {S: aws.String("vn#username")},
+			":skipped": {S: aws.String("c")},
+		},
+		Limit: aws.Int64(2),
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		pages++
+		for _, item := range page.Items {
+			items = append(items, *item["sk"].S)
+		}
+		return true
+	})
+
+	assert.NoError(t, pagesErr)
+	assert.Equal(t, 3, pages)
+	assert.Equal(t, []string{"a", "b", "d", "e"}, items)
+}
+
+func TestUpdateExpressions(t *testing.T) {
+	memory := NewMemoryStorage(config.Defaults())
+	key := map[string]*dynamodb.AttributeValue{
+		"username":   {S: aws.String("username")},
+		"media_type": {S: aws.String("vn")},
+	}
+
+	result, updateErr := memory.UpdateItemWithContext(context.Background(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String("settings"),
+		Key:              key,
+		UpdateExpression: aws.String("SET #count = if_not_exists(#count, :zero) + :one, nested = :nested ADD total :one"),
+		ExpressionAttributeNames: map[string]*string{
+			"#count": aws.String("count"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":zero":   {N: aws.String("0")},
+			":one":    {N: aws.String("1")},
+			":nested": {M: map[string]*dynamodb.AttributeValue{}},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	})
+	assert.NoError(t, updateErr)
+	assert.Equal(t, "1", *result.Attributes["count"].N)
+	assert.Equal(t, "1", *result.Attributes["total"].N)
+
+	result, updateErr = memory.UpdateItemWithContext(context.Background(), &dynamodb.UpdateItemInput{
+		TableName:           aws.String("settings"),
+		Key:                 key,
+		UpdateExpression:    aws.String("SET nested.inner = :one REMOVE #count ADD total :one"),
+		ConditionExpression: aws.String("attribute_exists(#count)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#count": aws.String("count"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": {N: aws.String("1")},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	})
+	assert.NoError(t, updateErr)
+	assert.NotContains(t, result.Attributes, "count")
+	assert.Equal(t, "2", *result.Attributes["total"].N)
+	assert.Equal(t, "1", *result.Attributes["nested"].M["inner"].N)
+
+	_, updateErr = memory.UpdateItemWithContext(context.Background(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String("settings"),
+		Key:              key,
+		UpdateExpression: aws.String("SET media_type = :value"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":value": {S: aws.String("ln")},
+		},
+	})
+	assert.Error(t, updateErr)
+
+	_, updateErr = memory.UpdateItemWithContext(context.Background(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String("settings"),
+		Key:              key,
+		UpdateExpression: aws.String("SET missing.inner = :value"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":value": {S: aws.String("value")},
+		},
+	})
+	assert.Error(t, updateErr)
+}
+
+// Tests leaning on anything this storage doesn't implement fail instead of passing on made up semantics
+func TestUnsupportedExpressions(t *testing.T) {
+	memory := NewMemoryStorage(config.Defaults())
+	key := map[string]*dynamodb.AttributeValue{
+		"username":   {S: aws.String("username")},
+		"media_type": {S: aws.String("vn")},
+	}
+
+	for _, expression := range []string{"SET tags = list_append(tags, :value)", "ADD tags :value", "DELETE tags :value", "SET tags[0] = :value"} {
+		_, updateErr := memory.UpdateItemWithContext(context.Background(), &dynamodb.UpdateItemInput{
+			TableName:        aws.String("settings"),
+			Key:              key,
+			UpdateExpression: aws.String(expression),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":value": {SS: []*string{aws.String("a")}},
+			},
+		})
+		assert.ErrorContains(t, updateErr, "not supported", expression)
+	}
+
+	for _, expression := range []string{"NOT attribute_exists(tags)", "size(tags) > :value", "contains(tags, :value)", "media_type IN (:value)"} {
+		_, putErr := memory.PutItemWithContext(context.Background(), &dynamodb.PutItemInput{
+			TableName:           aws.String("settings"),
+			Item:                key,
+			ConditionExpression: aws.String(expression),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":value": {S: aws.String("a")},
+			},
+		})
+		assert.ErrorContains(t, putErr, "not supported", expression)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	memory := NewMemoryStorage(config.Defaults())
+	item := map[string]*dynamodb.AttributeValue{
+		"username": {S: aws.String("username")},
+		"job_id":   {S: aws.String("job")},
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String("jobs"),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(job_id)"),
+	}
+	_, putErr := memory.PutItemWithContext(context.Background(), input)
+	assert.NoError(t, putErr)
+
+	_, putErr = memory.PutItemWithContext(context.Background(), input)
+	awsErr, isAWSErr := putErr.(awserr.Error)
+	assert.True(t, isAWSErr)
+	assert.Equal(t, dynamodb.ErrCodeConditionalCheckFailedException, awsErr.Code())
+
+	_, getErr := memory.GetItemWithContext(context.Background(), &dynamodb.GetItemInput{
+		TableName: aws.String("missing"),
+		Key:       item,
+	})
+	assert.Error(t, getErr)
+}
+
+func TestBatchWriteLimit(t *testing.T) {
+	memory := NewMemoryStorage(config.Defaults())
+	writeRequests := []*dynamodb.WriteRequest{}
+	for i := 0; i < 26; i++ {
+		writeRequests = append(writeRequests, &dynamodb.WriteRequest{
+			PutRequest: &dynamodb.PutRequest{Item: map[string]*dynamodb.AttributeValue{
+				"pk": {S: aws.String("vn#username")},
+				"sk": {S: aws.String(string(rune('a' + i)))},
+			}},
+		})
+	}
+
+	_, batchErr := memory.BatchWriteItemWithContext(context.Background(), &dynamodb.BatchWriteItemInput{
+		RequestItems: map[string][]*dynamodb.WriteRequest{"media": writeRequests},
+	})
+	assert.Error(t, batchErr)
+
+	result, batchErr := memory.BatchWriteItemWithContext(context.Background(), &dynamodb.BatchWriteItemInput{
+		RequestItems: map[string][]*dynamodb.WriteRequest{"media": writeRequests[:25]},
+	})
+	assert.NoError(t, batchErr)
+	assert.Empty(t, result.UnprocessedItems)
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The subset of dynamodb the domain packages rely on, always called with a context so work can be cancelled
+// Satisfied by DynamoDB as well as MemoryStorage, so most tests need no container
+type Storage interface {
+	// The tables and tunables everything reached through this storage uses
+	Config() *config.Config
+
+	GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error)
+	PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error)
+	UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error)
+	DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error)
+	QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error)
+	QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, callback func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error
+	BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error)
+	BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error)
+	TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error)
+}
+
+var _ Storage = (*DynamoDB)(nil)
+var _ Storage = (*MemoryStorage)(nil)
+
+// Dynamodb along with the configuration it was reached through
+type DynamoDB struct {
+	*dynamodb.DynamoDB
+	cfg *config.Config
+}
+
+func (svc *DynamoDB) Config() *config.Config {
+	return svc.cfg
+}
+
+// Reaches dynamodb through the configured endpoint and region, falling back on the shared AWS config
+func NewDynamoDB(cfg *config.Config) *DynamoDB {
+	return newDynamoDB(cfg, aws.Config{})
+}
+
+func newDynamoDB(cfg *config.Config, awsConfig aws.Config) *DynamoDB {
+	return &DynamoDB{DynamoDB: dynamodb.New(newSession(cfg, awsConfig)), cfg: cfg}
+}
+
+// Reaches s3 through the same endpoint, addressing buckets by path since local endpoints have no bucket subdomains
+func NewS3(cfg *config.Config) *s3.S3 {
+	return s3.New(newSession(cfg, aws.Config{S3ForcePathStyle: aws.Bool(cfg.Endpoint != "")}))
+}
+
+func newSession(cfg *config.Config, awsConfig aws.Config) *session.Session {
+	if cfg.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(cfg.Endpoint)
+	}
+	if cfg.Region != "" {
+		awsConfig.Region = aws.String(cfg.Region)
+	}
+
+	return session.Must(session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+}
+
+// Creates whichever tables don't exist yet, keys are strings and index sort keys numbers just like the data stack
+func CreateTables(ctx context.Context, svc *dynamodb.DynamoDB, schemas ...TableSchema) error {
+	for _, schema := range schemas {
+		attributes := map[string]string{}
+		input := &dynamodb.CreateTableInput{
+			TableName:   aws.String(schema.Name),
+			KeySchema:   keySchemaElements(schema.KeySchema),
+			BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		}
+		for _, name := range schema.names() {
+			attributes[name] = dynamodb.ScalarAttributeTypeS
+		}
+
+		for indexName, index := range schema.Indexes {
+			input.LocalSecondaryIndexes = append(input.LocalSecondaryIndexes, &dynamodb.LocalSecondaryIndex{
+				IndexName:  aws.String(indexName),
+				KeySchema:  keySchemaElements(index),
+				Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+			})
+			attributes[index.RangeKey] = dynamodb.ScalarAttributeTypeN
+		}
+
+		for name, attributeType := range attributes {
+			input.AttributeDefinitions = append(input.AttributeDefinitions, &dynamodb.AttributeDefinition{
+				AttributeName: aws.String(name),
+				AttributeType: aws.String(attributeType),
+			})
+		}
+
+		_, createErr := svc.CreateTableWithContext(ctx, input)
+		var awsErr awserr.Error
+		if createErr != nil && !(errors.As(createErr, &awsErr) && awsErr.Code() == dynamodb.ErrCodeResourceInUseException) {
+			return createErr
+		}
+	}
+
+	return nil
+}
+
+func keySchemaElements(keySchema KeySchema) []*dynamodb.KeySchemaElement {
+	elements := []*dynamodb.KeySchemaElement{{
+		AttributeName: aws.String(keySchema.HashKey),
+		KeyType:       aws.String(dynamodb.KeyTypeHash),
+	}}
+	if keySchema.RangeKey != "" {
+		elements = append(elements, &dynamodb.KeySchemaElement{
+			AttributeName: aws.String(keySchema.RangeKey),
+			KeyType:       aws.String(dynamodb.KeyTypeRange),
+		})
+	}
+	return elements
+}
+
+// Points at LocalStack when an endpoint is configured, otherwise keeps everything in memory
+// Giving each test run its own TABLE_PREFIX keeps them from sharing LocalStack tables
+func NewLocalStorage() (Storage, error) {
+	cfg, configErr := config.Load()
+	if configErr != nil {
+		return nil, configErr
+	}
+	if cfg.Endpoint == "" {
+		return NewMemoryStorage(cfg), nil
+	}
+
+	svc := newDynamoDB(cfg, aws.Config{
+		Region:      aws.String(endpoints.UsEast1RegionID),
+		Credentials: credentials.NewStaticCredentials("foo", "var", ""),
+	})
+
+	if createErr := CreateTables(context.Background(), svc.DynamoDB, Schemas(cfg)...); createErr != nil {
+		return nil, createErr
+	}
+	return svc, nil
+}
@@ -0,0 +1,62 @@
+package storage
+
+import "github.com/KamWithK/exSTATic-backend/internal/config"
+
+type KeySchema struct {
+	HashKey  string
+	RangeKey string
+}
+
+type TableSchema struct {
+	Name string
+	KeySchema
+	Indexes map[string]KeySchema
+}
+
+// Mirrors the tables created by the data stack, named as configured
+func Schemas(cfg *config.Config) []TableSchema {
+	return []TableSchema{
+		{
+			Name:      cfg.Tables.Settings,
+			KeySchema: KeySchema{HashKey: "username", RangeKey: "media_type"},
+		},
+		{
+			Name:      cfg.Tables.SettingsHistory,
+			KeySchema: KeySchema{HashKey: "username", RangeKey: "sk"},
+		},
+		{
+			Name:      cfg.Tables.Media,
+			KeySchema: KeySchema{HashKey: "pk", RangeKey: "sk"},
+			Indexes: map[string]KeySchema{
+				cfg.Indexes.LastUpdated: {HashKey: "pk", RangeKey: "last_update"},
+			},
+		},
+		{
+			Name:      cfg.Tables.Leaderboard,
+			KeySchema: KeySchema{HashKey: "section", RangeKey: "username"},
+			Indexes: map[string]KeySchema{
+				cfg.Indexes.TimeRead:  {HashKey: "section", RangeKey: "time_read"},
+				cfg.Indexes.CharsRead: {HashKey: "section", RangeKey: "chars_read"},
+			},
+		},
+		{
+			Name:      cfg.Tables.Jobs,
+			KeySchema: KeySchema{HashKey: "username", RangeKey: "job_id"},
+		},
+		{
+			Name:      cfg.Tables.Sync,
+			KeySchema: KeySchema{HashKey: "username", RangeKey: "sk"},
+		},
+		{
+			Name:      cfg.Tables.DeadLetters,
+			KeySchema: KeySchema{HashKey: "table_name", RangeKey: "id"},
+		},
+	}
+}
+
+func (keySchema KeySchema) names() []string {
+	if keySchema.RangeKey == "" {
+		return []string{keySchema.HashKey}
+	}
+	return []string{keySchema.HashKey, keySchema.RangeKey}
+}
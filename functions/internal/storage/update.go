@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Finds the map holding the last element of a path, which must already exist for nested paths
+func parentOf(item map[string]*dynamodb.AttributeValue, path documentPath) (map[string]*dynamodb.AttributeValue, error) {
+	if len(path) == 1 {
+		return item, nil
+	}
+
+	parent := resolvePath(item, path[:len(path)-1])
+	if parent == nil || parent.M == nil {
+		return nil, fmt.Errorf("the document path provided in the update expression is invalid for update")
+	}
+	return parent.M, nil
+}
+
+func setPath(item map[string]*dynamodb.AttributeValue, path documentPath, value *dynamodb.AttributeValue) error {
+	parent, parentErr := parentOf(item, path)
+	if parentErr != nil {
+		return parentErr
+	}
+
+	parent[path[len(path)-1]] = value
+	return nil
+}
+
+func removePath(item map[string]*dynamodb.AttributeValue, path documentPath) {
+	// Removing something which doesn't exist is a no-op
+	if parent, parentErr := parentOf(item, path); parentErr == nil {
+		delete(parent, path[len(path)-1])
+	}
+}
+
+// Only numbers are ever added to, sets are left to dynamodb itself
+func addToPath(item map[string]*dynamodb.AttributeValue, path documentPath, value *dynamodb.AttributeValue) error {
+	if value.N == nil {
+		return unsupported("ADD to anything but numbers")
+	}
+
+	current := resolvePath(item, path)
+	if current == nil {
+		return setPath(item, path, copyAttributeValue(value))
+	}
+	if current.N == nil {
+		return fmt.Errorf("an operand in the update expression has an incorrect data type")
+	}
+
+	sum, addErr := addNumbers(*current.N, *value.N)
+	if addErr != nil {
+		return addErr
+	}
+	return setPath(item, path, numberValue(sum))
+}
+
+// Applies update actions in place
+// Every operand is evaluated against the item as it was before the update, as dynamodb does
+func applyUpdate(item map[string]*dynamodb.AttributeValue, actions []updateAction, keyNames []string) error {
+	original := copyItem(item)
+
+	for _, action := range actions {
+		for _, keyName := range keyNames {
+			if action.path.root() == keyName {
+				return fmt.Errorf("cannot update attribute %s, this attribute is part of the key", keyName)
+			}
+		}
+
+		var value *dynamodb.AttributeValue
+		if action.value != nil {
+			if value = action.value.evaluate(original); value == nil {
+				return fmt.Errorf("the provided expression refers to an attribute that does not exist in the item")
+			}
+			value = copyAttributeValue(value)
+		}
+
+		var actionErr error
+		switch action.clause {
+		case "SET":
+			actionErr = setPath(item, action.path, value)
+		case "REMOVE":
+			removePath(item, action.path)
+		case "ADD":
+			actionErr = addToPath(item, action.path, value)
+		}
+		if actionErr != nil {
+			return actionErr
+		}
+	}
+
+	return nil
+}
@@ -1,5 +1,10 @@
 package user_media
 
-import "errors"
+import (
+	"fmt"
 
-var ErrEmptyItems = errors.New("no items error")
+	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+)
+
+var ErrEmptyItems = fmt.Errorf("stats for the day %w", dynamo_wrapper.ErrNotFound)
+var ErrMediaNotFound = fmt.Errorf("media %w", dynamo_wrapper.ErrNotFound)
@@ -1,10 +1,14 @@
 package user_media
 
 import (
+	"context"
 	"errors"
+	"time"
 
+	"github.com/KamWithK/exSTATic-backend/internal/device_sync"
 	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
-	"github.com/aws/aws-sdk-go/aws"
+	"github.com/KamWithK/exSTATic-backend/internal/leaderboard"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/rs/zerolog/log"
@@ -14,46 +18,160 @@ func MediaInfoSK(key UserMediaKey) string {
 	return key.MediaIdentifier
 }
 
-func GetMediaInfo(svc *dynamodb.DynamoDB, key UserMediaKey) (*UserMediaEntry, error) {
-	tableKey, keyErr := dynamo_wrapper.GetCompositeKey(UserMediaPK(key), MediaInfoSK(key))
-	if keyErr != nil {
-		return nil, keyErr
+// Deleted media are hidden behind their tombstones
+func mediaInfoRepository(ctx context.Context, svc storage.Storage) *dynamo_wrapper.Repository[UserMediaKey, UserMediaEntry] {
+	repository := dynamo_wrapper.NewRepository[UserMediaKey, UserMediaEntry](svc, svc.Config().Tables.Media, func(key UserMediaKey) (map[string]*dynamodb.AttributeValue, error) {
+		return dynamo_wrapper.GetCompositeKey(ctx, UserMediaPK(key), MediaInfoSK(key))
+	})
+	repository.Hidden = IsTombstone
+	return repository
+}
+
+func GetMediaInfo(ctx context.Context, svc storage.Storage, key UserMediaKey) (*UserMediaEntry, error) {
+	userMediaEntry, getErr := mediaInfoRepository(ctx, svc).Get(ctx, key)
+	if errors.Is(getErr, dynamo_wrapper.ErrNotFound) {
+		return nil, ErrMediaNotFound
 	}
 
-	result, getErr := svc.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String("media"),
-		Key:       tableKey,
-	})
+	return userMediaEntry, getErr
+}
+
+// Gets the entries of many media at once, along with the keys which couldn't be found
+// Fails if some keys couldn't be looked up at all
+func GetMediaInfos(ctx context.Context, svc storage.Storage, keys []UserMediaKey) (map[UserMediaKey]UserMediaEntry, []UserMediaKey, error) {
+	tableKeys := []map[string]*dynamodb.AttributeValue{}
+	for _, key := range keys {
+		tableKey, keyErr := dynamo_wrapper.GetCompositeKey(ctx, UserMediaPK(key), MediaInfoSK(key))
+		if keyErr != nil {
+			return nil, nil, keyErr
+		}
+		tableKeys = append(tableKeys, tableKey)
+	}
+
+	tableName := svc.Config().Tables.Media
+	result, getErr := dynamo_wrapper.BatchGetItems(ctx, svc, tableName, tableKeys)
 	if getErr != nil {
-		log.Error().Str("table", "media").Interface("key", key).Msg("Dynamodb failed to get item")
-		return nil, getErr
+		return nil, nil, getErr
 	}
+	if !result.Complete() {
+		return nil, nil, errors.New("could not get every media entry")
+	}
+
+	userMediaEntries := map[UserMediaKey]UserMediaEntry{}
+	for _, item := range result.Items {
+		key, _, splitErr := SplitUserMediaCompositeKey(*item.Key["pk"].S, *item.Key["sk"].S)
+		if splitErr != nil {
+			return nil, nil, splitErr
+		}
 
-	if result.Item == nil {
-		log.Info().Str("table", "media").Interface("key", key).Msg("Item not in table")
-		return nil, errors.New("item not found in table")
+		// Deleted media are treated as missing
+		if IsTombstone(item.Item) {
+			continue
+		}
+
+		userMediaEntry := UserMediaEntry{}
+		if unmarshalErr := dynamodbattribute.UnmarshalMap(item.Item, &userMediaEntry); unmarshalErr != nil {
+			log.Ctx(ctx).Error().Err(unmarshalErr).Str("table", tableName).Interface("key", key).Interface("item", item.Item).Msg("Could not unmarshal dynamodb item")
+			return nil, nil, unmarshalErr
+		}
+		userMediaEntries[*key] = userMediaEntry
 	}
 
-	userMediaEntry := UserMediaEntry{}
-	if unmarshalErr := dynamodbattribute.UnmarshalMap(result.Item, &userMediaEntry); unmarshalErr != nil {
-		log.Error().Err(unmarshalErr).Str("table", "media").Interface("key", key).Interface("item", result.Item).Msg("Could not unmarshal dynamodb item")
-		return nil, unmarshalErr
+	missing := []UserMediaKey{}
+	reported := map[UserMediaKey]bool{}
+	for _, key := range keys {
+		if _, exists := userMediaEntries[key]; !exists && !reported[key] {
+			reported[key] = true
+			missing = append(missing, key)
+		}
 	}
 
-	return &userMediaEntry, nil
+	return userMediaEntries, missing, nil
 }
 
-func PutMediaInfo(svc *dynamodb.DynamoDB, key UserMediaKey, userMediaEntry UserMediaEntry, lastUpdate int64) error {
+func PutMediaInfo(ctx context.Context, svc storage.Storage, key UserMediaKey, userMediaEntry UserMediaEntry, lastUpdate int64) error {
 	userMediaEntry.LastUpdate = lastUpdate
 
-	tableKey, keyErr := dynamo_wrapper.GetCompositeKey(UserMediaPK(key), MediaInfoSK(key))
+	tableKey, keyErr := dynamo_wrapper.GetCompositeKey(ctx, UserMediaPK(key), MediaInfoSK(key))
 	if keyErr != nil {
 		return keyErr
 	}
 
-	_, updateErr := dynamo_wrapper.UpdateItem(svc, "media", tableKey, userMediaEntry)
-	if updateErr != nil {
-		return updateErr
+	tableName := svc.Config().Tables.Media
+	return device_sync.CommitWithChanges(ctx, svc, key.Username, []map[string]*dynamodb.AttributeValue{tableKey}, func(transaction *dynamo_wrapper.Transaction) {
+		transaction.Update(tableName, tableKey, userMediaEntry, TombstoneAttributes...)
+	})
+}
+
+// Days take three writes each to delete, their tombstone, their change and the month they come off the leaderboard
+// Leaving room for the all time leaderboard and the user's sequence
+const maxDaysPerDelete = (dynamo_wrapper.AWSMaxTransactionSize - 2) / 3
+
+// Deletes a media along with every day of stats recorded for it
+func DeleteMediaInfo(ctx context.Context, svc storage.Storage, key UserMediaKey) error {
+	return retryOnConflict(ctx, key, func() error {
+		return deleteMediaInfo(ctx, svc, key)
+	})
+}
+
+// Days changed whilst being deleted are read again on the next attempt, those already deleted being skipped over
+func deleteMediaInfo(ctx context.Context, svc storage.Storage, key UserMediaKey) error {
+	cfg := svc.Config()
+	pk := UserMediaPK(key)
+	tombstone := NewTombstone(time.Now())
+	tableKeys := []map[string]*dynamodb.AttributeValue{}
+	dates := []int64{}
+	dayStats := []UserMediaStat{}
+
+	query := dynamo_wrapper.NewQuery(cfg.Tables.Media).Partition("pk", pk).Project("pk", "sk", "deleted_at", "last_update", "stats")
+	queryErr := query.Each(ctx, svc, func(item map[string]*dynamodb.AttributeValue) error {
+		sk := *item["sk"].S
+		itemKey, date, splitErr := SplitUserMediaCompositeKey(pk, sk)
+
+		if splitErr == nil && date != nil && itemKey.MediaIdentifier == key.MediaIdentifier && !IsTombstone(item) {
+			userMediaStat := UserMediaStat{}
+			if unmarshalErr := dynamodbattribute.UnmarshalMap(item, &userMediaStat); unmarshalErr != nil {
+				return unmarshalErr
+			}
+
+			tableKeys = append(tableKeys, map[string]*dynamodb.AttributeValue{"pk": item["pk"], "sk": item["sk"]})
+			dates = append(dates, *date)
+			dayStats = append(dayStats, userMediaStat)
+		}
+		return nil
+	})
+	if queryErr != nil {
+		log.Ctx(ctx).Error().Err(queryErr).Str("table", cfg.Tables.Media).Interface("key", key).Msg("Dynamodb query failed")
+		return queryErr
+	}
+
+	// Days are deleted a block at a time along with their changes and the reading they take off the leaderboards
+	for start := 0; start < len(tableKeys); start += maxDaysPerDelete {
+		end := start + maxDaysPerDelete
+		if end > len(tableKeys) {
+			end = len(tableKeys)
+		}
+
+		commitErr := device_sync.CommitWithChanges(ctx, svc, key.Username, tableKeys[start:end], func(transaction *dynamo_wrapper.Transaction) {
+			reading := leaderboard.Totals{}
+			for i := start; i < end; i++ {
+				transaction.Put(cfg.Tables.Media, tableKeys[i], &tombstone).
+					When(dayUnchanged(true, dayStats[i].LastUpdate))
+				reading.Add(key.Username, key.MediaType, time.Unix(dates[i], 0).UTC(), readingRemoved(dayStats[i]))
+			}
+			reading.Write(transaction, cfg.Tables.Leaderboard)
+		})
+		if commitErr != nil {
+			log.Ctx(ctx).Error().Err(commitErr).Interface("key", key).Int("deleted", start).Int("remaining", len(tableKeys)-start).Msg("Could not delete every media stat")
+			return commitErr
+		}
+	}
+
+	// The entry goes last so a failed delete can simply be retried
+	deleteErr := putTombstone(ctx, svc, key.Username, pk, MediaInfoSK(key), tombstone)
+	if deleteErr != nil {
+		log.Ctx(ctx).Error().Err(deleteErr).Str("table", cfg.Tables.Media).Interface("key", key).Msg("Dynamodb failed to delete item")
+		return deleteErr
 	}
 
 	return nil
@@ -32,8 +32,10 @@ func RandomMediaEntries(fake faker.Faker, user string, numEntries int) map[UserM
 }
 
 // Create a random stats entry for some number of days in the past
+// Days start at midnight UTC like those written by status updates
 func RandomMediaStats(fake faker.Faker, key UserMediaKey, daysAgo int, probability float32) map[UserMediaDateKey]UserMediaStat {
 	now := time.Now().UTC()
+	now = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
 	startDate := now.AddDate(0, 0, -1*daysAgo)
 
 	stats := map[UserMediaDateKey]UserMediaStat{}
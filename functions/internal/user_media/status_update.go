@@ -1,13 +1,18 @@
 package user_media
 
 import (
+	"context"
 	"errors"
+	"strconv"
 	"time"
 
+	"github.com/KamWithK/exSTATic-backend/internal/device_sync"
 	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/leaderboard"
+	"github.com/KamWithK/exSTATic-backend/internal/settings"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/rs/zerolog/log"
 )
 
@@ -21,59 +26,69 @@ type StatusArgs struct {
 	Key      UserMediaKey   `json:"key" binding:"required"`
 	Stats    MediaStat      `json:"stats" binding:"required"`
 	Progress ProgressPoints `json:"progress" binding:"required"`
-	Timezone string         `json:"timezone" binding:"required"`
+	// Left empty to use the timezone saved in the user's settings
+	Timezone string `json:"timezone"`
 }
 
 func StatusUpdateSK(dateKey UserMediaDateKey) string {
 	return ZeroPadInt64(dateKey.DateTime) + "#" + dateKey.Key.MediaIdentifier
 }
 
-func GetStatusUpdate(svc *dynamodb.DynamoDB, dateArgs UserMediaDateKey) (map[string]*dynamodb.AttributeValue, *UserMediaStat, error) {
-	tableKey, keyErr := dynamo_wrapper.GetCompositeKey(UserMediaPK(dateArgs.Key), StatusUpdateSK(dateArgs))
-	if keyErr != nil {
-		return nil, nil, keyErr
-	}
-
-	result, getErr := svc.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String("media"),
-		Key:       tableKey,
+// Deleted days are hidden behind their tombstones
+func statusUpdateRepository(ctx context.Context, svc storage.Storage) *dynamo_wrapper.Repository[UserMediaDateKey, UserMediaStat] {
+	repository := dynamo_wrapper.NewRepository[UserMediaDateKey, UserMediaStat](svc, svc.Config().Tables.Media, func(dateKey UserMediaDateKey) (map[string]*dynamodb.AttributeValue, error) {
+		return dynamo_wrapper.GetCompositeKey(ctx, UserMediaPK(dateKey.Key), StatusUpdateSK(dateKey))
 	})
-	if getErr != nil {
-		log.Error().Str("table", "media").Interface("key", dateArgs.Key).Msg("Dynamodb failed to get item")
-		return nil, nil, getErr
-	}
-
-	mediaStats := UserMediaStat{}
-	if unmarshalErr := dynamodbattribute.UnmarshalMap(result.Item, &mediaStats); unmarshalErr != nil {
-		log.Error().Err(unmarshalErr).Str("table", "media").Interface("key", dateArgs.Key).Interface("item", result.Item).Msg("Could not unmarshal dynamodb item")
-		return nil, nil, unmarshalErr
-	}
+	repository.Hidden = IsTombstone
+	return repository
+}
 
-	if result.Item == nil || len(result.Item) == 0 {
-		return tableKey, &mediaStats, ErrEmptyItems
+// Days without stats (or whose stats were deleted) start again from scratch, returned alongside ErrEmptyItems
+func GetStatusUpdate(ctx context.Context, svc storage.Storage, dateArgs UserMediaDateKey) (*UserMediaStat, error) {
+	mediaStats, getErr := statusUpdateRepository(ctx, svc).Get(ctx, dateArgs)
+	if errors.Is(getErr, dynamo_wrapper.ErrNotFound) {
+		return &UserMediaStat{}, ErrEmptyItems
 	}
 
-	return tableKey, &mediaStats, nil
+	return mediaStats, getErr
 }
 
-func DeleteStatusUpdate(svc *dynamodb.DynamoDB, dateArgs UserMediaDateKey) error {
-	tableKey, keyErr := dynamo_wrapper.GetCompositeKey(UserMediaPK(dateArgs.Key), StatusUpdateSK(dateArgs))
-	if keyErr != nil {
-		return keyErr
-	}
-
-	_, deleteErr := svc.DeleteItem(&dynamodb.DeleteItemInput{
-		TableName: aws.String("media"),
-		Key:       tableKey,
+func DeleteStatusUpdate(ctx context.Context, svc storage.Storage, dateArgs UserMediaDateKey) error {
+	deleteErr := retryOnConflict(ctx, dateArgs, func() error {
+		return deleteStatusUpdate(ctx, svc, dateArgs)
 	})
 	if deleteErr != nil {
-		log.Error().Err(deleteErr).Str("table", "media").Interface("key", dateArgs).Msg("Dynamodb failed to delete item")
+		log.Ctx(ctx).Error().Err(deleteErr).Str("table", svc.Config().Tables.Media).Interface("key", dateArgs).Msg("Dynamodb failed to delete item")
 		return deleteErr
 	}
 
 	return nil
 }
 
+// The day's reading comes off the leaderboards along with it, so it can't have changed since it was read
+func deleteStatusUpdate(ctx context.Context, svc storage.Storage, dateArgs UserMediaDateKey) error {
+	userMediaStats, findDayErr := GetStatusUpdate(ctx, svc, dateArgs)
+	if findDayErr != nil && !errors.Is(findDayErr, ErrEmptyItems) {
+		return findDayErr
+	}
+
+	dayKey, dayKeyErr := dynamo_wrapper.GetCompositeKey(ctx, UserMediaPK(dateArgs.Key), StatusUpdateSK(dateArgs))
+	if dayKeyErr != nil {
+		return dayKeyErr
+	}
+
+	tables := svc.Config().Tables
+	tombstone := NewTombstone(time.Now())
+	return device_sync.CommitWithChanges(ctx, svc, dateArgs.Key.Username, []map[string]*dynamodb.AttributeValue{dayKey}, func(transaction *dynamo_wrapper.Transaction) {
+		transaction.Put(tables.Media, dayKey, &tombstone).
+			When(dayUnchanged(findDayErr == nil, userMediaStats.LastUpdate))
+
+		reading := leaderboard.Totals{}
+		reading.Add(dateArgs.Key.Username, dateArgs.Key.MediaType, time.Unix(dateArgs.DateTime, 0).UTC(), readingRemoved(*userMediaStats))
+		reading.Write(transaction, tables.Leaderboard)
+	})
+}
+
 func DayRollback(timeNow time.Time) time.Time {
 	// Time markers
 	yesterday := time.Date(timeNow.Year(), timeNow.Month(), timeNow.Day()-1, 0, 0, 0, 0, time.UTC)
@@ -88,6 +103,25 @@ func DayRollback(timeNow time.Time) time.Time {
 	return today
 }
 
+// Moves the start of each day to the user's rollover hour, keeping the original rollback when they haven't set one
+func DayRollover(localTime time.Time, rolloverHour *int16) time.Time {
+	if rolloverHour == nil {
+		return DayRollback(localTime)
+	}
+
+	shifted := localTime.Add(-time.Duration(*rolloverHour) * time.Hour)
+	return time.Date(shifted.Year(), shifted.Month(), shifted.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Media types settings aren't kept for use the user's global settings
+func userSettingsKey(key UserMediaKey) settings.UserSettingsKey {
+	settingsKey := settings.UserSettingsKey{Username: key.Username, MediaType: key.MediaType}
+	if settings.ValidateKey(settingsKey) != nil {
+		settingsKey.MediaType = ""
+	}
+	return settingsKey
+}
+
 func processProgress(previousSats *UserMediaStat, additiveStats MediaStat, progressPoints ProgressPoints, maxAFKTime int16) {
 	// Set stats reference
 	stats := &previousSats.Stats
@@ -113,13 +147,32 @@ func processProgress(previousSats *UserMediaStat, additiveStats MediaStat, progr
 	}
 }
 
-func PutStatusUpdate(svc *dynamodb.DynamoDB, statusArgs StatusArgs, maxAFKTime int16) error {
+// Status updates which keep losing out to others writing the same day give up after this many attempts
+const MaxWriteAttempts = 5
+
+// Reads, changes and writes a day again whenever someone else wrote it in between
+func retryOnConflict(ctx context.Context, key interface{}, attempt func() error) error {
+	var err error
+	for i := 1; i <= MaxWriteAttempts; i++ {
+		err = attempt()
+		if !errors.Is(err, dynamo_wrapper.ErrConditionFailed) && !errors.Is(err, dynamo_wrapper.ErrTransactionConflict) {
+			return err
+		}
+		log.Ctx(ctx).Info().Err(err).Interface("key", key).Int("attempt", i).Msg("Day changed whilst being written")
+	}
+
+	log.Ctx(ctx).Error().Err(err).Interface("key", key).Msg("Gave up writing day")
+	return err
+}
+
+// Gaps between progress longer than the user's max AFK time aren't counted as reading
+func PutStatusUpdate(ctx context.Context, svc storage.Storage, statusArgs StatusArgs) error {
 	// Load times
 	timeNow := time.Now().UTC()
 
 	if len(statusArgs.Progress) == 0 {
 		err := errors.New("no given progress, will be ignored")
-		log.Info().Err(err).Send()
+		log.Ctx(ctx).Info().Err(err).Send()
 		return err
 	}
 	givenTime := time.Unix(statusArgs.Progress[0].DateTime, 0)
@@ -127,34 +180,161 @@ func PutStatusUpdate(svc *dynamodb.DynamoDB, statusArgs StatusArgs, maxAFKTime i
 	// Anti-cheat measure
 	if timeNow.Sub(givenTime) > 24*time.Hour {
 		err := errors.New("first given time is more than 24 hours in the past")
-		log.Info().Err(err).Send()
+		log.Ctx(ctx).Info().Err(err).Send()
 	}
 
-	// Location information
-	location, locationErr := time.LoadLocation(statusArgs.Timezone)
+	// Location information, falling back to the user's settings
+	userSettings, resolveErr := settings.ResolveUserSettings(ctx, svc, userSettingsKey(statusArgs.Key))
+	if resolveErr != nil {
+		return resolveErr
+	}
+	location, locationErr := userSettings.Location(statusArgs.Timezone)
 	if locationErr != nil {
-		log.Debug().Err(locationErr).Str("timezone", statusArgs.Timezone).Msg("Invalid timezone specified")
+		log.Ctx(ctx).Debug().Err(locationErr).Str("timezone", statusArgs.Timezone).Msg("Invalid timezone specified")
 		return locationErr
 	}
 	localTime := givenTime.In(location)
 
 	// Find day
-	tableKey, userMediaStats, findDayErr := GetStatusUpdate(svc, UserMediaDateKey{
+	dateKey := UserMediaDateKey{
 		Key:      statusArgs.Key,
-		DateTime: DayRollback(localTime).Unix(),
+		DateTime: DayRollover(localTime, userSettings.Settings.DayRolloverHour).Unix(),
+	}
+
+	return retryOnConflict(ctx, dateKey, func() error {
+		return putStatusUpdate(ctx, svc, statusArgs, dateKey, *userSettings.Settings.MaxAFKTime)
 	})
+}
+
+// The day, the media's last update and the leaderboards all change together or not at all
+func putStatusUpdate(ctx context.Context, svc storage.Storage, statusArgs StatusArgs, dateKey UserMediaDateKey, maxAFKTime int16) error {
+	userMediaStats, findDayErr := GetStatusUpdate(ctx, svc, dateKey)
 	if findDayErr != nil && !errors.Is(findDayErr, ErrEmptyItems) {
 		return findDayErr
 	}
+	readStats := *userMediaStats
 
 	// Process time data
 	processProgress(userMediaStats, statusArgs.Stats, statusArgs.Progress, maxAFKTime)
 
-	// Put item
-	_, updateErr := dynamo_wrapper.UpdateItem(svc, "media", tableKey, *userMediaStats)
-	if updateErr != nil {
-		return updateErr
+	// Missing and deleted media are left alone, as are those a later day already moved past
+	entry, findEntryErr := GetMediaInfo(ctx, svc, statusArgs.Key)
+	if findEntryErr != nil && !errors.Is(findEntryErr, ErrMediaNotFound) {
+		return findEntryErr
 	}
+	moveEntry := findEntryErr == nil && entry.LastUpdate < userMediaStats.LastUpdate
 
-	return nil
+	dayKey, dayKeyErr := dynamo_wrapper.GetCompositeKey(ctx, UserMediaPK(dateKey.Key), StatusUpdateSK(dateKey))
+	if dayKeyErr != nil {
+		return dayKeyErr
+	}
+	entryKey, entryKeyErr := dynamo_wrapper.GetCompositeKey(ctx, UserMediaPK(statusArgs.Key), MediaInfoSK(statusArgs.Key))
+	if entryKeyErr != nil {
+		return entryKeyErr
+	}
+	changedKeys := []map[string]*dynamodb.AttributeValue{dayKey}
+	if moveEntry {
+		changedKeys = append(changedKeys, entryKey)
+	}
+
+	tables := svc.Config().Tables
+	return device_sync.CommitWithChanges(ctx, svc, statusArgs.Key.Username, changedKeys, func(transaction *dynamo_wrapper.Transaction) {
+		// Days already read have their counters added to, new and deleted days are written from scratch
+		if findDayErr == nil {
+			transaction.Update(tables.Media, dayKey, dayChanges(readStats, *userMediaStats), pauseRemoval(*userMediaStats)...).
+				When(dayUnchanged(true, readStats.LastUpdate))
+		} else {
+			transaction.Put(tables.Media, dayKey, *userMediaStats).
+				When(dayUnchanged(false, readStats.LastUpdate))
+		}
+
+		if moveEntry {
+			transaction.UpdateExpression(tables.Media, entryKey, dynamo_wrapper.Expression{
+				Expression: "SET #last_update = :last_update",
+				Names:      map[string]*string{"#last_update": aws.String("last_update")},
+				Values:     map[string]*dynamodb.AttributeValue{":last_update": {N: aws.String(strconv.FormatInt(userMediaStats.LastUpdate, 10))}},
+			}).When(entryBehind(userMediaStats.LastUpdate))
+		}
+
+		reading := leaderboard.Totals{}
+		reading.Add(statusArgs.Key.Username, statusArgs.Key.MediaType, time.Unix(dateKey.DateTime, 0).UTC(), leaderboard.Reading{
+			TimeRead:  userMediaStats.Stats.TimeRead - readStats.Stats.TimeRead,
+			CharsRead: userMediaStats.Stats.CharsRead - readStats.Stats.CharsRead,
+		})
+		reading.Write(transaction, tables.Leaderboard)
+	})
+}
+
+// Counters are added to what's stored, so concurrent writes never lose reading
+type mediaStatGrowth struct {
+	TimeRead  int64 `json:"time_read" dynamo:"add"`
+	CharsRead int64 `json:"chars_read" dynamo:"add"`
+	LinesRead int64 `json:"lines_read" dynamo:"add"`
+}
+
+// The update written to a day which was already read
+type dayChange struct {
+	Stats      mediaStatGrowth `json:"stats" dynamo:"nested"`
+	LastUpdate int64           `json:"last_update"`
+	Pause      bool            `json:"pause"`
+}
+
+// How much the day's counters grew by along with where it now leaves off
+func dayChanges(before UserMediaStat, after UserMediaStat) dayChange {
+	return dayChange{
+		Stats: mediaStatGrowth{
+			TimeRead:  after.Stats.TimeRead - before.Stats.TimeRead,
+			CharsRead: after.Stats.CharsRead - before.Stats.CharsRead,
+			LinesRead: after.Stats.LinesRead - before.Stats.LinesRead,
+		},
+		LastUpdate: after.LastUpdate,
+		Pause:      after.Pause,
+	}
+}
+
+// What deleting a day takes back off the leaderboards
+func readingRemoved(day UserMediaStat) leaderboard.Reading {
+	return leaderboard.Reading{TimeRead: -day.Stats.TimeRead, CharsRead: -day.Stats.CharsRead}
+}
+
+// Updates leave false fields alone, so a day which is no longer paused has the flag removed
+func pauseRemoval(after UserMediaStat) []string {
+	if after.Pause {
+		return nil
+	}
+	return []string{"pause"}
+}
+
+// Time read depends on where the day left off, so the day can't have moved on since it was read
+// Days which weren't found may have been deleted, their tombstones standing in for them
+func dayUnchanged(found bool, lastUpdate int64) dynamo_wrapper.Expression {
+	names := map[string]*string{
+		"#last_update": aws.String("last_update"),
+		"#deleted_at":  aws.String("deleted_at"),
+	}
+	if !found {
+		return dynamo_wrapper.Expression{
+			Expression: "attribute_not_exists(#last_update) OR attribute_exists(#deleted_at)",
+			Names:      names,
+		}
+	}
+
+	return dynamo_wrapper.Expression{
+		Expression: "attribute_not_exists(#deleted_at) AND (attribute_not_exists(#last_update) OR #last_update = :read_last_update)",
+		Names:      names,
+		Values:     map[string]*dynamodb.AttributeValue{":read_last_update": {N: aws.String(strconv.FormatInt(lastUpdate, 10))}},
+	}
+}
+
+// The media's last update only moves forwards, and only on entries which still exist
+func entryBehind(lastUpdate int64) dynamo_wrapper.Expression {
+	return dynamo_wrapper.Expression{
+		Expression: "attribute_exists(#sk) AND attribute_not_exists(#deleted_at) AND (attribute_not_exists(#last_update) OR #last_update < :newer_last_update)",
+		Names: map[string]*string{
+			"#sk":          aws.String("sk"),
+			"#deleted_at":  aws.String("deleted_at"),
+			"#last_update": aws.String("last_update"),
+		},
+		Values: map[string]*dynamodb.AttributeValue{":newer_last_update": {N: aws.String(strconv.FormatInt(lastUpdate, 10))}},
+	}
 }
@@ -0,0 +1,56 @@
+package user_media
+
+import (
+	"context"
+	"time"
+
+	"github.com/KamWithK/exSTATic-backend/internal/device_sync"
+	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// How long deletions are remembered for before dynamodb's TTL removes them
+const TombstoneRetention = 90 * 24 * time.Hour
+
+// Attributes which mark an item as deleted, cleared whenever the item is written to again
+var TombstoneAttributes = []string{"deleted_at", "expires_at"}
+
+// Deleted items are replaced with a tombstone so other devices learn about the removal
+// The last update is kept so tombstones are found through the lastUpdatedIndex like any other change
+type Tombstone struct {
+	DeletedAt  int64 `json:"deleted_at"`
+	LastUpdate int64 `json:"last_update"`
+	ExpiresAt  int64 `json:"expires_at"`
+}
+
+func NewTombstone(deletedAt time.Time) Tombstone {
+	return Tombstone{
+		DeletedAt:  deletedAt.Unix(),
+		LastUpdate: deletedAt.Unix(),
+		ExpiresAt:  deletedAt.Add(TombstoneRetention).Unix(),
+	}
+}
+
+func IsTombstone(item map[string]*dynamodb.AttributeValue) bool {
+	deletedAt, exists := item["deleted_at"]
+	return exists && deletedAt.N != nil
+}
+
+// Whether an upload last changed at the given time was removed afterwards
+func (tombstone Tombstone) Supersedes(lastUpdate int64) bool {
+	return tombstone.DeletedAt >= lastUpdate
+}
+
+func putTombstone(ctx context.Context, svc storage.Storage, username string, pk string, sk string, tombstone Tombstone) error {
+	tableKey, keyErr := dynamo_wrapper.GetCompositeKey(ctx, pk, sk)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	// Put replaces the whole item, so no stale stats remain behind the tombstone
+	tableName := svc.Config().Tables.Media
+	return device_sync.CommitWithChanges(ctx, svc, username, []map[string]*dynamodb.AttributeValue{tableKey}, func(transaction *dynamo_wrapper.Transaction) {
+		transaction.Put(tableName, tableKey, &tombstone)
+	})
+}
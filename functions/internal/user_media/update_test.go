@@ -1,32 +1,42 @@
 package user_media
 
 import (
+	"context"
+	"fmt"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/leaderboard"
+	"github.com/KamWithK/exSTATic-backend/internal/settings"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/endpoints"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/jaswdr/faker"
 	"github.com/stretchr/testify/assert"
 )
 
-const EndpointURL = "http://localhost:4566/"
+var dynamoSvc storage.Storage
 
-var sess *session.Session
-var dynamoSvc *dynamodb.DynamoDB
+func TestMain(m *testing.M) {
+	var storageErr error
+	if dynamoSvc, storageErr = storage.NewLocalStorage(); storageErr != nil {
+		fmt.Fprintln(os.Stderr, "Local storage unavailable:", storageErr)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
 
-func init() {
-	sess = session.Must(session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Endpoint:    aws.String(EndpointURL),
-			Region:      aws.String(endpoints.UsEast1RegionID),
-			Credentials: credentials.NewStaticCredentials("foo", "var", ""),
-		},
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-	dynamoSvc = dynamodb.New(sess)
+// Storage of its own so racing writes and seeded rows don't leak into other tests
+func localStorage(t *testing.T) storage.Storage {
+	svc, storageErr := storage.NewLocalStorage()
+	if storageErr != nil {
+		t.Fatal(storageErr)
+	}
+	return svc
 }
 
 func TestGetNoDay(t *testing.T) {
@@ -39,10 +49,10 @@ func TestGetNoDay(t *testing.T) {
 		DateTime: 0,
 	}
 
-	deleteErr := DeleteStatusUpdate(dynamoSvc, key)
+	deleteErr := DeleteStatusUpdate(context.Background(), dynamoSvc, key)
 	assert.NoError(t, deleteErr)
 
-	_, userMediaStats, findDayErr := GetStatusUpdate(dynamoSvc, key)
+	userMediaStats, findDayErr := GetStatusUpdate(context.Background(), dynamoSvc, key)
 
 	assert.Error(t, findDayErr, ErrEmptyItems)
 	assert.Empty(t, userMediaStats.Stats)
@@ -55,7 +65,7 @@ func TestPutMediaInfo(t *testing.T) {
 		MediaIdentifier: "identifier",
 	}
 
-	error := PutMediaInfo(dynamoSvc, key, UserMediaEntry{
+	error := PutMediaInfo(context.Background(), dynamoSvc, key, UserMediaEntry{
 		DisplayName: "name",
 	}, 0)
 	assert.NoError(t, error)
@@ -75,24 +85,388 @@ func TestBasicInsert(t *testing.T) {
 		CharsRead: 1000,
 		LinesRead: 1000,
 	}
-	var maxAFKTime int16 = 60
 
-	_, oldUserMediaStats, _ := GetStatusUpdate(dynamoSvc, key)
+	// Progress is given at the epoch, which falls on a different day depending on the timezone
+	timezone := fake.Time().Timezone()
+	location, locationErr := time.LoadLocation(timezone)
+	assert.NoError(t, locationErr)
+	key.DateTime = DayRollback(time.Unix(0, 0).In(location)).Unix()
+
+	oldUserMediaStats, _ := GetStatusUpdate(context.Background(), dynamoSvc, key)
 
-	deleteErr := DeleteStatusUpdate(dynamoSvc, key)
+	deleteErr := DeleteStatusUpdate(context.Background(), dynamoSvc, key)
 	assert.NoError(t, deleteErr)
 
-	putErr := PutStatusUpdate(dynamoSvc, StatusArgs{
+	putErr := PutStatusUpdate(context.Background(), dynamoSvc, StatusArgs{
 		Key:      key.Key,
 		Stats:    additiveStat,
 		Progress: make(ProgressPoints, 1),
-		Timezone: fake.Time().Timezone(),
-	}, maxAFKTime)
+		Timezone: timezone,
+	})
 	assert.NoError(t, putErr)
 
-	_, userMediaStats, findDayErr := GetStatusUpdate(dynamoSvc, key)
+	userMediaStats, findDayErr := GetStatusUpdate(context.Background(), dynamoSvc, key)
 
 	assert.NoError(t, findDayErr)
 	assert.Equal(t, userMediaStats.Stats.CharsRead, oldUserMediaStats.Stats.CharsRead+additiveStat.CharsRead)
 	assert.Equal(t, userMediaStats.Stats.LinesRead, oldUserMediaStats.Stats.LinesRead+additiveStat.LinesRead)
 }
+
+func TestDeleteMediaInfo(t *testing.T) {
+	key := UserMediaKey{
+		Username:        "username",
+		MediaType:       "vn",
+		MediaIdentifier: "deleted",
+	}
+
+	putErr := PutMediaInfo(context.Background(), dynamoSvc, key, UserMediaEntry{
+		DisplayName: "name",
+	}, 0)
+	assert.NoError(t, putErr)
+
+	deleteErr := DeleteMediaInfo(context.Background(), dynamoSvc, key)
+	assert.NoError(t, deleteErr)
+
+	_, getErr := GetMediaInfo(context.Background(), dynamoSvc, key)
+	assert.Error(t, getErr)
+
+	putErr = PutMediaInfo(context.Background(), dynamoSvc, key, UserMediaEntry{
+		DisplayName: "name",
+	}, 0)
+	assert.NoError(t, putErr)
+
+	mediaEntry, getErr := GetMediaInfo(context.Background(), dynamoSvc, key)
+	assert.NoError(t, getErr)
+	assert.Equal(t, "name", mediaEntry.DisplayName)
+}
+
+func TestGetMediaInfos(t *testing.T) {
+	keys := []UserMediaKey{}
+	for _, identifier := range []string{"first", "second", "removed", "absent"} {
+		keys = append(keys, UserMediaKey{
+			Username:        "batch username",
+			MediaType:       "vn",
+			MediaIdentifier: identifier,
+		})
+	}
+
+	for _, key := range keys[:3] {
+		putErr := PutMediaInfo(context.Background(), dynamoSvc, key, UserMediaEntry{
+			DisplayName: key.MediaIdentifier,
+		}, 0)
+		assert.NoError(t, putErr)
+	}
+	assert.NoError(t, DeleteMediaInfo(context.Background(), dynamoSvc, keys[2]))
+
+	mediaEntries, missing, getErr := GetMediaInfos(context.Background(), dynamoSvc, keys)
+	assert.NoError(t, getErr)
+	assert.Len(t, mediaEntries, 2)
+	assert.Equal(t, "second", mediaEntries[keys[1]].DisplayName)
+	assert.Equal(t, keys[2:], missing)
+}
+
+func TestConfiguredTables(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.Tables.Media, cfg.Tables.Sync = "isolated_media", "isolated_sync"
+	ctx := context.Background()
+	isolatedSvc := storage.NewMemoryStorage(cfg)
+	key := UserMediaKey{Username: "username", MediaType: "vn", MediaIdentifier: "isolated"}
+
+	assert.NoError(t, PutMediaInfo(ctx, isolatedSvc, key, UserMediaEntry{DisplayName: "name"}, 0))
+	entry, getErr := GetMediaInfo(ctx, isolatedSvc, key)
+	assert.NoError(t, getErr)
+	assert.Equal(t, "name", entry.DisplayName)
+
+	// Nothing reaches the tables under their default names
+	_, getErr = GetMediaInfo(ctx, dynamoSvc, key)
+	assert.ErrorIs(t, getErr, ErrMediaNotFound)
+}
+
+func TestSavedTimezone(t *testing.T) {
+	ctx := context.Background()
+	key := UserMediaKey{Username: "timezone", MediaType: "vn", MediaIdentifier: "identifier"}
+	progressTime := time.Date(2024, time.March, 2, 1, 30, 0, 0, time.UTC)
+
+	assert.NoError(t, PutStatusUpdate(ctx, dynamoSvc, StatusArgs{
+		Key:      key,
+		Stats:    MediaStat{CharsRead: 10},
+		Progress: ProgressPoints{{DateTime: progressTime.Unix()}},
+	}))
+	_, getErr := GetStatusUpdate(ctx, dynamoSvc, UserMediaDateKey{Key: key, DateTime: time.Date(2024, time.March, 2, 0, 0, 0, 0, time.UTC).Unix()})
+	assert.NoError(t, getErr)
+
+	// 01:30 UTC is 10:30 in Tokyo, before the saved rollover of 11
+	_, putErr := settings.PutUserSettings(ctx, dynamoSvc, settings.UserSettings{
+		Key:             settings.UserSettingsKey{Username: "timezone"},
+		Timezone:        aws.String("Asia/Tokyo"),
+		DayRolloverHour: aws.Int16(11),
+	})
+	assert.NoError(t, putErr)
+
+	assert.NoError(t, PutStatusUpdate(ctx, dynamoSvc, StatusArgs{
+		Key:      key,
+		Stats:    MediaStat{CharsRead: 10},
+		Progress: ProgressPoints{{DateTime: progressTime.Unix()}},
+	}))
+	stats, getErr := GetStatusUpdate(ctx, dynamoSvc, UserMediaDateKey{Key: key, DateTime: time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC).Unix()})
+	assert.NoError(t, getErr)
+	assert.Equal(t, int64(10), stats.Stats.CharsRead)
+
+	// Timezones given with the request still win, 15:30 in Kiritimati being past the rollover
+	assert.NoError(t, PutStatusUpdate(ctx, dynamoSvc, StatusArgs{
+		Key:      key,
+		Stats:    MediaStat{CharsRead: 10},
+		Progress: ProgressPoints{{DateTime: progressTime.Unix()}},
+		Timezone: "Pacific/Kiritimati",
+	}))
+	stats, getErr = GetStatusUpdate(ctx, dynamoSvc, UserMediaDateKey{Key: key, DateTime: time.Date(2024, time.March, 2, 0, 0, 0, 0, time.UTC).Unix()})
+	assert.NoError(t, getErr)
+	assert.Equal(t, int64(20), stats.Stats.CharsRead)
+}
+
+func TestWeeklyStats(t *testing.T) {
+	ctx := context.Background()
+	key := UserMediaKey{Username: "weekly", MediaType: "ttu"}
+	// A saturday, sunday and monday
+	days := []time.Time{
+		time.Date(2024, time.March, 2, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, time.March, 3, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, time.March, 4, 0, 0, 0, 0, time.UTC),
+	}
+	for _, identifier := range []string{"first", "second"} {
+		for _, day := range days {
+			putErr := statusUpdateRepository(ctx, dynamoSvc).Put(ctx, UserMediaDateKey{
+				Key:      UserMediaKey{Username: key.Username, MediaType: key.MediaType, MediaIdentifier: identifier},
+				DateTime: day.Unix(),
+			}, UserMediaStat{Stats: MediaStat{CharsRead: 100, TimeRead: 60}})
+			assert.NoError(t, putErr)
+		}
+	}
+	args := WeeklyStatsArgs{Key: key, From: days[0].Unix(), To: days[2].Unix()}
+
+	// ISO weeks start on monday
+	weeks, weeksErr := GetWeeklyStats(ctx, dynamoSvc, args)
+	assert.NoError(t, weeksErr)
+	assert.Equal(t, []WeekStat{
+		{Week: "2024-W09", Start: time.Date(2024, time.February, 26, 0, 0, 0, 0, time.UTC).Unix(), Stats: MediaStat{CharsRead: 400, TimeRead: 240}, DaysRead: 2},
+		{Week: "2024-W10", Start: days[2].Unix(), Stats: MediaStat{CharsRead: 200, TimeRead: 120}, DaysRead: 1},
+	}, weeks)
+
+	_, putErr := settings.PutUserSettings(ctx, dynamoSvc, settings.UserSettings{
+		Key:       settings.UserSettingsKey{Username: key.Username},
+		WeekStart: aws.String(settings.WeekStartSaturday),
+	})
+	assert.NoError(t, putErr)
+
+	args.Key.MediaIdentifier = "first"
+	weeks, weeksErr = GetWeeklyStats(ctx, dynamoSvc, args)
+	assert.NoError(t, weeksErr)
+	assert.Equal(t, []WeekStat{
+		{Week: "2024-03-02", Start: days[0].Unix(), Stats: MediaStat{CharsRead: 300, TimeRead: 180}, DaysRead: 3},
+	}, weeks)
+
+	_, weeksErr = GetWeeklyStats(ctx, dynamoSvc, WeeklyStatsArgs{Key: key, From: days[2].Unix(), To: days[0].Unix()})
+	assert.Error(t, weeksErr)
+}
+
+// Lets another status update land between reading the day and writing it
+type racingStorage struct {
+	storage.Storage
+	race func()
+}
+
+func (racing *racingStorage) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	if race := racing.race; race != nil {
+		racing.race = nil
+		race()
+	}
+	return racing.Storage.TransactWriteItemsWithContext(ctx, input, opts...)
+}
+
+func leaderboardItem(t *testing.T, svc storage.Storage, key leaderboard.LeaderboardKey) map[string]*dynamodb.AttributeValue {
+	output, getErr := svc.GetItemWithContext(context.Background(), &dynamodb.GetItemInput{
+		TableName: aws.String(config.Defaults().Tables.Leaderboard),
+		Key:       leaderboard.TableKey(key),
+	})
+	assert.NoError(t, getErr)
+	return output.Item
+}
+
+func TestStatusUpdateTransaction(t *testing.T) {
+	ctx := context.Background()
+	svc := localStorage(t)
+	key := UserMediaKey{Username: "transaction", MediaType: "vn", MediaIdentifier: "identifier"}
+	start := time.Date(2024, time.March, 2, 12, 0, 0, 0, time.UTC)
+	dateKey := UserMediaDateKey{Key: key, DateTime: time.Date(2024, time.March, 2, 0, 0, 0, 0, time.UTC).Unix()}
+	monthKey := leaderboard.LeaderboardKey{Username: "transaction", TimePeriod: "2024-03", MediaType: "vn"}
+	allTimeKey := leaderboard.LeaderboardKey{Username: "transaction", TimePeriod: leaderboard.AllTime, MediaType: "vn"}
+
+	assert.NoError(t, PutMediaInfo(ctx, svc, key, UserMediaEntry{DisplayName: "name"}, 1))
+	assert.NoError(t, PutStatusUpdate(ctx, svc, StatusArgs{
+		Key:      key,
+		Stats:    MediaStat{CharsRead: 100},
+		Progress: ProgressPoints{{DateTime: start.Unix()}, {DateTime: start.Add(30 * time.Second).Unix()}},
+	}))
+
+	entry, getErr := GetMediaInfo(ctx, svc, key)
+	assert.NoError(t, getErr)
+	assert.Equal(t, start.Add(30*time.Second).Unix(), entry.LastUpdate)
+	for _, leaderboardKey := range []leaderboard.LeaderboardKey{monthKey, allTimeKey} {
+		item := leaderboardItem(t, svc, leaderboardKey)
+		assert.Equal(t, "30", *item["time_read"].N)
+		assert.Equal(t, "100", *item["chars_read"].N)
+	}
+
+	// Another update moves the day on after it was read, so this one reads the day again and adds to it
+	racing := &racingStorage{Storage: svc, race: func() {
+		assert.NoError(t, PutStatusUpdate(ctx, svc, StatusArgs{
+			Key:      key,
+			Stats:    MediaStat{CharsRead: 10},
+			Progress: ProgressPoints{{DateTime: start.Add(time.Minute).Unix()}},
+		}))
+	}}
+	assert.NoError(t, PutStatusUpdate(ctx, racing, StatusArgs{
+		Key:      key,
+		Stats:    MediaStat{CharsRead: 1000},
+		Progress: ProgressPoints{{DateTime: start.Add(2 * time.Minute).Unix()}},
+	}))
+
+	stats, getErr := GetStatusUpdate(ctx, svc, dateKey)
+	assert.NoError(t, getErr)
+	assert.Equal(t, int64(1110), stats.Stats.CharsRead)
+	assert.Equal(t, int64(120), stats.Stats.TimeRead)
+	entry, getErr = GetMediaInfo(ctx, svc, key)
+	assert.NoError(t, getErr)
+	assert.Equal(t, start.Add(2*time.Minute).Unix(), entry.LastUpdate)
+	for _, leaderboardKey := range []leaderboard.LeaderboardKey{monthKey, allTimeKey} {
+		item := leaderboardItem(t, svc, leaderboardKey)
+		assert.Equal(t, "120", *item["time_read"].N)
+		assert.Equal(t, "1110", *item["chars_read"].N)
+	}
+
+	// A late update for an earlier day never moves the media's last update backwards
+	assert.NoError(t, PutStatusUpdate(ctx, svc, StatusArgs{
+		Key:      key,
+		Stats:    MediaStat{CharsRead: 1},
+		Progress: ProgressPoints{{DateTime: start.Add(-24 * time.Hour).Unix()}},
+	}))
+	entry, getErr = GetMediaInfo(ctx, svc, key)
+	assert.NoError(t, getErr)
+	assert.Equal(t, start.Add(2*time.Minute).Unix(), entry.LastUpdate)
+
+	// Nor are deleted media brought back
+	assert.NoError(t, DeleteMediaInfo(ctx, svc, key))
+	assert.NoError(t, PutStatusUpdate(ctx, svc, StatusArgs{
+		Key:      key,
+		Stats:    MediaStat{CharsRead: 1},
+		Progress: ProgressPoints{{DateTime: start.Add(3 * time.Minute).Unix()}},
+	}))
+	_, getErr = GetMediaInfo(ctx, svc, key)
+	assert.ErrorIs(t, getErr, ErrMediaNotFound)
+}
+
+func TestDeletesLeaveLeaderboards(t *testing.T) {
+	ctx := context.Background()
+	svc := localStorage(t)
+	key := UserMediaKey{Username: "deletes", MediaType: "vn", MediaIdentifier: "identifier"}
+	march := time.Date(2024, time.March, 31, 12, 0, 0, 0, time.UTC)
+	april := time.Date(2024, time.April, 1, 12, 0, 0, 0, time.UTC)
+	allTimeKey := leaderboard.LeaderboardKey{Username: "deletes", TimePeriod: leaderboard.AllTime, MediaType: "vn"}
+	marchKey := leaderboard.LeaderboardKey{Username: "deletes", TimePeriod: "2024-03", MediaType: "vn"}
+	aprilKey := leaderboard.LeaderboardKey{Username: "deletes", TimePeriod: "2024-04", MediaType: "vn"}
+
+	assert.NoError(t, PutMediaInfo(ctx, svc, key, UserMediaEntry{DisplayName: "name"}, 1))
+	for _, day := range []time.Time{march, april} {
+		assert.NoError(t, PutStatusUpdate(ctx, svc, StatusArgs{
+			Key:      key,
+			Stats:    MediaStat{CharsRead: 100},
+			Progress: ProgressPoints{{DateTime: day.Unix()}, {DateTime: day.Add(30 * time.Second).Unix()}},
+		}))
+	}
+	assert.Equal(t, "200", *leaderboardItem(t, svc, allTimeKey)["chars_read"].N)
+
+	// Reading added whilst the day is being deleted comes off along with it
+	racing := &racingStorage{Storage: svc, race: func() {
+		assert.NoError(t, PutStatusUpdate(ctx, svc, StatusArgs{
+			Key:      key,
+			Stats:    MediaStat{CharsRead: 10},
+			Progress: ProgressPoints{{DateTime: march.Add(time.Minute).Unix()}},
+		}))
+	}}
+	assert.NoError(t, DeleteStatusUpdate(ctx, racing, UserMediaDateKey{Key: key, DateTime: time.Date(2024, time.March, 31, 0, 0, 0, 0, time.UTC).Unix()}))
+	assert.Equal(t, "0", *leaderboardItem(t, svc, marchKey)["chars_read"].N)
+	assert.Equal(t, "0", *leaderboardItem(t, svc, marchKey)["time_read"].N)
+	assert.Equal(t, "100", *leaderboardItem(t, svc, allTimeKey)["chars_read"].N)
+	assert.Equal(t, "30", *leaderboardItem(t, svc, allTimeKey)["time_read"].N)
+
+	assert.NoError(t, DeleteMediaInfo(ctx, svc, key))
+	for _, leaderboardKey := range []leaderboard.LeaderboardKey{allTimeKey, marchKey, aprilKey} {
+		item := leaderboardItem(t, svc, leaderboardKey)
+		assert.Equal(t, "0", *item["time_read"].N, leaderboardKey)
+		assert.Equal(t, "0", *item["chars_read"].N, leaderboardKey)
+	}
+}
+
+func TestStatusUpdateAddsCounters(t *testing.T) {
+	ctx := context.Background()
+	svc := localStorage(t)
+	key := UserMediaKey{Username: "counters", MediaType: "vn", MediaIdentifier: "identifier"}
+	start := time.Date(2024, time.March, 2, 12, 0, 0, 0, time.UTC)
+	dateKey := UserMediaDateKey{Key: key, DateTime: time.Date(2024, time.March, 2, 0, 0, 0, 0, time.UTC).Unix()}
+
+	assert.NoError(t, PutStatusUpdate(ctx, svc, StatusArgs{
+		Key:      key,
+		Stats:    MediaStat{CharsRead: 100},
+		Progress: ProgressPoints{{DateTime: start.Unix(), Pause: true}},
+	}))
+	stats, getErr := GetStatusUpdate(ctx, svc, dateKey)
+	assert.NoError(t, getErr)
+	assert.True(t, stats.Pause)
+
+	// Counters added elsewhere in the meantime are kept rather than overwritten
+	racing := &racingStorage{Storage: svc, race: func() {
+		dayKey, keyErr := dynamo_wrapper.GetCompositeKey(ctx, UserMediaPK(key), StatusUpdateSK(dateKey))
+		assert.NoError(t, keyErr)
+		_, updateErr := dynamo_wrapper.UpdateItem(ctx, svc, svc.Config().Tables.Media, dayKey, dayChange{Stats: mediaStatGrowth{CharsRead: 5, LinesRead: 1}})
+		assert.NoError(t, updateErr)
+	}}
+	assert.NoError(t, PutStatusUpdate(ctx, racing, StatusArgs{
+		Key:      key,
+		Stats:    MediaStat{CharsRead: 10, LinesRead: 2},
+		Progress: ProgressPoints{{DateTime: start.Add(time.Minute).Unix()}},
+	}))
+
+	stats, getErr = GetStatusUpdate(ctx, svc, dateKey)
+	assert.NoError(t, getErr)
+	assert.Equal(t, MediaStat{CharsRead: 115, LinesRead: 3}, stats.Stats)
+	assert.Equal(t, start.Add(time.Minute).Unix(), stats.LastUpdate)
+	assert.False(t, stats.Pause)
+}
+
+func TestSavedMaxAFKTime(t *testing.T) {
+	ctx := context.Background()
+	svc := localStorage(t)
+	key := UserMediaKey{Username: "afk", MediaType: "vn", MediaIdentifier: "identifier"}
+	start := time.Date(2024, time.March, 2, 12, 0, 0, 0, time.UTC)
+	dateKey := UserMediaDateKey{Key: key, DateTime: time.Date(2024, time.March, 2, 0, 0, 0, 0, time.UTC).Unix()}
+
+	_, putErr := settings.PutUserSettings(ctx, svc, settings.UserSettings{
+		Key:         settings.UserSettingsKey{Username: "afk", MediaType: "vn"},
+		MaxAFKTime:  aws.Int16(20),
+		MaxBlurTime: aws.Int16(10),
+	})
+	assert.NoError(t, putErr)
+
+	// Only the gap shorter than the saved AFK time counts
+	assert.NoError(t, PutStatusUpdate(ctx, svc, StatusArgs{
+		Key: key,
+		Progress: ProgressPoints{
+			{DateTime: start.Unix()},
+			{DateTime: start.Add(15 * time.Second).Unix()},
+			{DateTime: start.Add(45 * time.Second).Unix()},
+		},
+	}))
+	stats, getErr := GetStatusUpdate(ctx, svc, dateKey)
+	assert.NoError(t, getErr)
+	assert.Equal(t, int64(15), stats.Stats.TimeRead)
+}
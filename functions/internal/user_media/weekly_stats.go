@@ -0,0 +1,101 @@
+package user_media
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/settings"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/rs/zerolog/log"
+)
+
+// Days are given as in day keys, leaving out the media identifier sums every media of the type
+type WeeklyStatsArgs struct {
+	Key  UserMediaKey `json:"key" binding:"required"`
+	From int64        `json:"from" binding:"required"`
+	To   int64        `json:"to" binding:"required"`
+}
+
+// Stats summed over one of the user's weeks, starting on whichever day they chose
+type WeekStat struct {
+	Week     string    `json:"week"`
+	Start    int64     `json:"start"`
+	Stats    MediaStat `json:"stats"`
+	DaysRead int       `json:"days_read"`
+}
+
+// Groups the days between from and to into weeks, weeks at either end only counting the days within range
+func GetWeeklyStats(ctx context.Context, svc storage.Storage, args WeeklyStatsArgs) ([]WeekStat, error) {
+	if args.From > args.To {
+		err := errors.New("weeks must be from a day before they're to")
+		log.Ctx(ctx).Info().Err(err).Int64("from", args.From).Int64("to", args.To).Send()
+		return nil, err
+	}
+
+	userSettings, resolveErr := settings.ResolveUserSettings(ctx, svc, userSettingsKey(args.Key))
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	weekStart := userSettings.WeekStart()
+
+	// Day keys sort before any media identifier sharing their prefix, since # comes before $
+	query := dynamo_wrapper.NewQuery(svc.Config().Tables.Media).
+		Partition("pk", UserMediaPK(args.Key)).
+		SortBetween("sk", ZeroPadInt64(args.From), ZeroPadInt64(args.To)+"$")
+
+	weeks := map[int64]*WeekStat{}
+	// Several media can be read on the same day, which only counts once
+	daysRead := map[int64]map[int64]bool{}
+	queryErr := query.Each(ctx, svc, func(item map[string]*dynamodb.AttributeValue) error {
+		if IsTombstone(item) {
+			return nil
+		}
+		itemKey, date, splitErr := SplitUserMediaCompositeKey(*item["pk"].S, *item["sk"].S)
+		if splitErr != nil || date == nil || (args.Key.MediaIdentifier != "" && itemKey.MediaIdentifier != args.Key.MediaIdentifier) {
+			return nil
+		}
+
+		dayStats := UserMediaStat{}
+		if unmarshalErr := dynamodbattribute.UnmarshalMap(item, &dayStats); unmarshalErr != nil {
+			log.Ctx(ctx).Error().Err(unmarshalErr).Interface("item", item).Msg("Could not unmarshal dynamodb item")
+			return unmarshalErr
+		}
+
+		day := time.Unix(*date, 0).UTC()
+		start := settings.WeekOf(day, weekStart)
+		week, exists := weeks[start.Unix()]
+		if !exists {
+			week = &WeekStat{Week: settings.WeekLabel(day, weekStart), Start: start.Unix()}
+			weeks[start.Unix()] = week
+			daysRead[start.Unix()] = map[int64]bool{}
+		}
+		daysRead[start.Unix()][*date] = true
+		week.DaysRead = len(daysRead[start.Unix()])
+
+		week.Stats.TimeRead += dayStats.Stats.TimeRead
+		week.Stats.CharsRead += dayStats.Stats.CharsRead
+		week.Stats.LinesRead += dayStats.Stats.LinesRead
+		return nil
+	})
+	if queryErr != nil {
+		return nil, queryErr
+	}
+
+	return sortedWeeks(weeks), nil
+}
+
+func sortedWeeks(weeks map[int64]*WeekStat) []WeekStat {
+	sorted := []WeekStat{}
+	for _, week := range weeks {
+		sorted = append(sorted, *week)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+	return sorted
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+
+	"github.com/KamWithK/exSTATic-backend/internal/backfill"
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/logging"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rs/zerolog/log"
+)
+
+var svc *storage.DynamoDB
+var s3Svc *s3.S3
+
+func init() {
+	cfg, loadErr := config.Load()
+	if loadErr != nil {
+		log.Fatal().Err(loadErr).Msg("Invalid configuration in environment")
+	}
+	svc = storage.NewDynamoDB(cfg)
+	s3Svc = storage.NewS3(cfg)
+}
+
+// Responds with a link to the export rather than the export itself, which could be larger than a response can hold
+func HandleRequest(ctx context.Context, args backfill.ExportArgs) (*backfill.ExportLink, error) {
+	ctx = logging.WithRequest(ctx, args.Username)
+	return backfill.UploadExport(ctx, svc, s3Svc, svc.Config().ExportBucket, args)
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
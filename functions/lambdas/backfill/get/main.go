@@ -4,24 +4,26 @@ import (
 	"context"
 
 	"github.com/KamWithK/exSTATic-backend/internal/backfill"
-	"github.com/KamWithK/exSTATic-backend/internal/user_media"
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/logging"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
 )
 
-var sess *session.Session
-var svc *dynamodb.DynamoDB
+var svc *storage.DynamoDB
 
 func init() {
-	sess = session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-	svc = dynamodb.New(sess)
+	cfg, loadErr := config.Load()
+	if loadErr != nil {
+		log.Fatal().Err(loadErr).Msg("Invalid configuration in environment")
+	}
+	svc = storage.NewDynamoDB(cfg)
 }
 
-func HandleRequest(ctx context.Context, userMediaDateKey user_media.UserMediaDateKey) (*backfill.BackfillArgs, error) {
-	return backfill.GetBackfill(svc, userMediaDateKey)
+func HandleRequest(ctx context.Context, args backfill.BackfillQueryArgs) (*backfill.BackfillArgs, error) {
+	ctx = logging.WithRequest(ctx, args.Key.Username)
+	return backfill.QueryBackfill(ctx, svc, args)
 }
 
 func main() {
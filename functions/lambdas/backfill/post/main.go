@@ -4,13 +4,33 @@ import (
 	"context"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/rs/zerolog/log"
 
 	"github.com/KamWithK/exSTATic-backend/internal/backfill"
-	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/logging"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
 )
 
-func HandleRequest(ctx context.Context, history backfill.BackfillArgs) (*dynamo_wrapper.BatchwriteArgs, error) {
-	return backfill.PutBackfill(history)
+// The state machine passes its execution name along as the job ID
+type backfillPostArgs struct {
+	JobID   string                `json:"job_id"`
+	History backfill.BackfillArgs `json:"history"`
+}
+
+var svc *storage.DynamoDB
+
+func init() {
+	cfg, loadErr := config.Load()
+	if loadErr != nil {
+		log.Fatal().Err(loadErr).Msg("Invalid configuration in environment")
+	}
+	svc = storage.NewDynamoDB(cfg)
+}
+
+func HandleRequest(ctx context.Context, args backfillPostArgs) (*backfill.BackfillJobArgs, error) {
+	ctx = logging.WithRequest(ctx, args.History.Username)
+	return backfill.StartBackfillJob(ctx, svc, args.JobID, args.History)
 }
 
 func main() {
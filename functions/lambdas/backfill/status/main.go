@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/rs/zerolog/log"
+
+	"github.com/KamWithK/exSTATic-backend/internal/backfill"
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/logging"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+)
+
+var svc *storage.DynamoDB
+
+func init() {
+	cfg, loadErr := config.Load()
+	if loadErr != nil {
+		log.Fatal().Err(loadErr).Msg("Invalid configuration in environment")
+	}
+	svc = storage.NewDynamoDB(cfg)
+}
+
+func HandleRequest(ctx context.Context, key backfill.BackfillJobKey) (*backfill.BackfillJob, error) {
+	ctx = logging.WithRequest(ctx, key.Username)
+	return backfill.GetJob(ctx, svc, key)
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
@@ -7,34 +7,49 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
 
+	"github.com/KamWithK/exSTATic-backend/internal/config"
 	"github.com/KamWithK/exSTATic-backend/internal/dynamo_wrapper"
+	"github.com/KamWithK/exSTATic-backend/internal/logging"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
 )
 
-var sess *session.Session
-var svc *dynamodb.DynamoDB
+var svc *storage.DynamoDB
 
 func init() {
-	sess = session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-	svc = dynamodb.New(sess)
+	cfg, loadErr := config.Load()
+	if loadErr != nil {
+		log.Fatal().Err(loadErr).Msg("Invalid configuration in environment")
+	}
+	svc = storage.NewDynamoDB(cfg)
 }
 
 func HandleRequest(ctx context.Context, args *dynamo_wrapper.BatchwriteArgs) (*dynamo_wrapper.BatchwriteArgs, error) {
-	nextArgs := dynamo_wrapper.DistributedBatchWrites(svc, args)
+	ctx = logging.WithRequest(ctx, "")
+	result, writeErr := dynamo_wrapper.DistributedBatchWrites(ctx, svc, args)
+	if writeErr != nil {
+		return args, writeErr
+	}
 
-	if len(nextArgs.WriteRequests) == 0 {
-		log.Info().Msg("Dynamodb batch operations finished")
+	// Poison items are set aside so they aren't retried forever
+	if deadLetterErr := dynamo_wrapper.PutDeadLetters(ctx, svc, result); deadLetterErr != nil {
+		return args, deadLetterErr
+	}
+
+	if len(result.Unprocessed) == 0 {
+		log.Ctx(ctx).Info().Msg("Dynamodb batch operations finished")
 		return nil, nil
 	}
 
 	err := errors.New("unprocessed items error")
-	log.Error().Err(err).Msg("")
-
-	return nextArgs, err
+	log.Ctx(ctx).Error().Err(err).Msg("")
+
+	return &dynamo_wrapper.BatchwriteArgs{
+		TableName:     args.TableName,
+		WriteRequests: result.UnprocessedWrites(),
+		MaxBatchSize:  args.MaxBatchSize,
+		Concurrency:   args.Concurrency,
+	}, err
 }
 
 func main() {
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/logging"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+	"github.com/KamWithK/exSTATic-backend/internal/user_media"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/rs/zerolog/log"
+)
+
+var svc *storage.DynamoDB
+
+func init() {
+	cfg, loadErr := config.Load()
+	if loadErr != nil {
+		log.Fatal().Err(loadErr).Msg("Invalid configuration in environment")
+	}
+	svc = storage.NewDynamoDB(cfg)
+}
+
+func HandleRequest(ctx context.Context, key user_media.UserMediaKey) error {
+	ctx = logging.WithRequest(ctx, key.Username)
+	return user_media.DeleteMediaInfo(ctx, svc, key)
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
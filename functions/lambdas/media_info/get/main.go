@@ -3,24 +3,27 @@ package main
 import (
 	"context"
 
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/logging"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
 	"github.com/KamWithK/exSTATic-backend/internal/user_media"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
 )
 
-var sess *session.Session
-var svc *dynamodb.DynamoDB
+var svc *storage.DynamoDB
 
 func init() {
-	sess = session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-	svc = dynamodb.New(sess)
+	cfg, loadErr := config.Load()
+	if loadErr != nil {
+		log.Fatal().Err(loadErr).Msg("Invalid configuration in environment")
+	}
+	svc = storage.NewDynamoDB(cfg)
 }
 
 func HandleRequest(ctx context.Context, key user_media.UserMediaKey) (*user_media.UserMediaEntry, error) {
-	return user_media.GetMediaInfo(svc, key)
+	ctx = logging.WithRequest(ctx, key.Username)
+	return user_media.GetMediaInfo(ctx, svc, key)
 }
 
 func main() {
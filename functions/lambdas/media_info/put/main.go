@@ -4,10 +4,12 @@ import (
 	"context"
 	"time"
 
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/logging"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
 	"github.com/KamWithK/exSTATic-backend/internal/user_media"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
 )
 
 type userMediaEntryArgs struct {
@@ -15,18 +17,19 @@ type userMediaEntryArgs struct {
 	user_media.UserMediaEntry
 }
 
-var sess *session.Session
-var svc *dynamodb.DynamoDB
+var svc *storage.DynamoDB
 
 func init() {
-	sess = session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-	svc = dynamodb.New(sess)
+	cfg, loadErr := config.Load()
+	if loadErr != nil {
+		log.Fatal().Err(loadErr).Msg("Invalid configuration in environment")
+	}
+	svc = storage.NewDynamoDB(cfg)
 }
 
 func HandleRequest(ctx context.Context, userMediaEntry userMediaEntryArgs) error {
-	return user_media.PutMediaInfo(svc, userMediaEntry.UserMediaKey, userMediaEntry.UserMediaEntry, time.Now().Unix())
+	ctx = logging.WithRequest(ctx, userMediaEntry.UserMediaKey.Username)
+	return user_media.PutMediaInfo(ctx, svc, userMediaEntry.UserMediaKey, userMediaEntry.UserMediaEntry, time.Now().Unix())
 }
 
 func main() {
@@ -3,25 +3,28 @@ package main
 import (
 	"context"
 
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/logging"
 	"github.com/KamWithK/exSTATic-backend/internal/settings"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
 
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
 )
 
-var sess *session.Session
-var svc *dynamodb.DynamoDB
+var svc *storage.DynamoDB
 
 func init() {
-	sess = session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-	svc = dynamodb.New(sess)
+	cfg, loadErr := config.Load()
+	if loadErr != nil {
+		log.Fatal().Err(loadErr).Msg("Invalid configuration in environment")
+	}
+	svc = storage.NewDynamoDB(cfg)
 }
 
-func HandleRequest(ctx context.Context, key settings.UserSettingsKey) (*settings.UserSettings, error) {
-	return settings.GetUserSettings(svc, key)
+func HandleRequest(ctx context.Context, key settings.UserSettingsKey) (*settings.ResolvedSettings, error) {
+	ctx = logging.WithRequest(ctx, key.Username)
+	return settings.ResolveUserSettings(ctx, svc, key)
 }
 
 func main() {
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/logging"
+	"github.com/KamWithK/exSTATic-backend/internal/settings"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/rs/zerolog/log"
+)
+
+// Leaving the limit out gives the most records allowed
+type settingsHistoryArgs struct {
+	Key   settings.UserSettingsKey `json:"key" binding:"required"`
+	Limit int                      `json:"limit"`
+}
+
+var svc *storage.DynamoDB
+
+func init() {
+	cfg, loadErr := config.Load()
+	if loadErr != nil {
+		log.Fatal().Err(loadErr).Msg("Invalid configuration in environment")
+	}
+	svc = storage.NewDynamoDB(cfg)
+}
+
+func HandleRequest(ctx context.Context, args settingsHistoryArgs) ([]settings.HistoryRecord, error) {
+	ctx = logging.WithRequest(ctx, args.Key.Username)
+	return settings.ListSettingsHistory(ctx, svc, args.Key, args.Limit)
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
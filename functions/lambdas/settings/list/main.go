@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/logging"
+	"github.com/KamWithK/exSTATic-backend/internal/settings"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/rs/zerolog/log"
+)
+
+type settingsListArgs struct {
+	Username string `json:"username" binding:"required"`
+}
+
+var svc *storage.DynamoDB
+
+func init() {
+	cfg, loadErr := config.Load()
+	if loadErr != nil {
+		log.Fatal().Err(loadErr).Msg("Invalid configuration in environment")
+	}
+	svc = storage.NewDynamoDB(cfg)
+}
+
+func HandleRequest(ctx context.Context, args settingsListArgs) ([]settings.UserSettings, error) {
+	ctx = logging.WithRequest(ctx, args.Username)
+	return settings.ListUserSettings(ctx, svc, args.Username)
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
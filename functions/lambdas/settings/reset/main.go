@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/logging"
+	"github.com/KamWithK/exSTATic-backend/internal/settings"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/rs/zerolog/log"
+)
+
+// Either resets the settings under the key, or every one of the user's settings when all is set
+type settingsResetArgs struct {
+	Key settings.UserSettingsKey `json:"key" binding:"required"`
+	All bool                     `json:"all"`
+}
+
+var svc *storage.DynamoDB
+
+func init() {
+	cfg, loadErr := config.Load()
+	if loadErr != nil {
+		log.Fatal().Err(loadErr).Msg("Invalid configuration in environment")
+	}
+	svc = storage.NewDynamoDB(cfg)
+}
+
+func HandleRequest(ctx context.Context, args settingsResetArgs) error {
+	ctx = logging.WithRequest(ctx, args.Key.Username)
+
+	if args.All {
+		return settings.ResetAllUserSettings(ctx, svc, args.Key.Username)
+	}
+	return settings.ResetUserSettings(ctx, svc, args.Key)
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/logging"
+	"github.com/KamWithK/exSTATic-backend/internal/settings"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/rs/zerolog/log"
+)
+
+// At is the unix time to restore the settings to
+type settingsRestoreArgs struct {
+	Key      settings.UserSettingsKey `json:"key" binding:"required"`
+	DeviceID string                   `json:"device_id"`
+	At       int64                    `json:"at" binding:"required"`
+}
+
+var svc *storage.DynamoDB
+
+func init() {
+	cfg, loadErr := config.Load()
+	if loadErr != nil {
+		log.Fatal().Err(loadErr).Msg("Invalid configuration in environment")
+	}
+	svc = storage.NewDynamoDB(cfg)
+}
+
+func HandleRequest(ctx context.Context, args settingsRestoreArgs) (*settings.UserSettings, error) {
+	ctx = logging.WithRequest(ctx, args.Key.Username)
+	return settings.RestoreUserSettings(ctx, svc, args.Key, args.DeviceID, args.At)
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
@@ -3,25 +3,27 @@ package main
 import (
 	"context"
 
+	"github.com/KamWithK/exSTATic-backend/internal/config"
+	"github.com/KamWithK/exSTATic-backend/internal/logging"
+	"github.com/KamWithK/exSTATic-backend/internal/storage"
 	"github.com/KamWithK/exSTATic-backend/internal/user_media"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
 )
 
-var sess *session.Session
-var svc *dynamodb.DynamoDB
+var svc *storage.DynamoDB
 
 func init() {
-	sess = session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-	svc = dynamodb.New(sess)
+	cfg, loadErr := config.Load()
+	if loadErr != nil {
+		log.Fatal().Err(loadErr).Msg("Invalid configuration in environment")
+	}
+	svc = storage.NewDynamoDB(cfg)
 }
 
 func HandleRequest(ctx context.Context, dateArgs user_media.UserMediaDateKey) (*user_media.UserMediaStat, error) {
-	_, userMediaStat, err := user_media.GetStatusUpdate(svc, dateArgs)
-	return userMediaStat, err
+	ctx = logging.WithRequest(ctx, dateArgs.Key.Username)
+	return user_media.GetStatusUpdate(ctx, svc, dateArgs)
 }
 
 func main() {
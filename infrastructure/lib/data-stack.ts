@@ -1,7 +1,8 @@
 import { Construct } from 'constructs';
 
 import { AttributeType, BillingMode, ProjectionType, Table, TableClass, TableEncryption } from 'aws-cdk-lib/aws-dynamodb';
-import { RemovalPolicy, Stack, StackProps } from 'aws-cdk-lib';
+import { Duration, RemovalPolicy, Stack, StackProps } from 'aws-cdk-lib';
+import { BlockPublicAccess, Bucket, BucketEncryption } from 'aws-cdk-lib/aws-s3';
 
 export interface DataStackProps extends StackProps {
     environmentType: string
@@ -9,8 +10,16 @@ export interface DataStackProps extends StackProps {
 
 export class DataStack extends Stack {
     settingsTable: Table;
+    settingsHistoryTable: Table;
     mediaTable: Table;
     leaderboardTable: Table;
+    jobsTable: Table;
+    syncTable: Table;
+    deadLettersTable: Table;
+    // Exports are only kept long enough to be downloaded through the links handed out
+    exportsBucket: Bucket;
+    // Lets functions find the tables, whatever they end up being called
+    tableEnvironment: { [key: string]: string };
 
     constructor(scope: Construct, id: string, props: DataStackProps) {
         super(scope, id, props);
@@ -34,6 +43,26 @@ export class DataStack extends Stack {
             pointInTimeRecovery: props.environmentType === "prod"
         });
         
+        this.settingsHistoryTable = new Table(this, 'settingsHistoryTable', {
+            tableName: 'settings_history',
+            
+            partitionKey: {
+                name: 'username',
+                type: AttributeType.STRING
+            },
+            sortKey: {
+                name: 'sk',
+                type: AttributeType.STRING
+            },
+            
+            timeToLiveAttribute: 'expires_at',
+            billingMode: BillingMode.PAY_PER_REQUEST,
+            tableClass: TableClass.STANDARD,
+            encryption: TableEncryption.DEFAULT,
+            removalPolicy: RemovalPolicy.RETAIN,
+            pointInTimeRecovery: props.environmentType === "prod"
+        });
+        
         this.mediaTable = new Table(this, 'mediaTable', {
             tableName: 'media',
             
@@ -46,6 +75,7 @@ export class DataStack extends Stack {
                 type: AttributeType.STRING
             },
             
+            timeToLiveAttribute: 'expires_at',
             billingMode: BillingMode.PAY_PER_REQUEST,
             tableClass: TableClass.STANDARD,
             encryption: TableEncryption.DEFAULT,
@@ -97,5 +127,82 @@ export class DataStack extends Stack {
             },
             projectionType: ProjectionType.ALL
         });
+
+        this.jobsTable = new Table(this, 'jobsTable', {
+            tableName: 'jobs',
+            
+            partitionKey: {
+                name: 'username',
+                type: AttributeType.STRING
+            },
+            sortKey: {
+                name: 'job_id',
+                type: AttributeType.STRING
+            },
+            
+            timeToLiveAttribute: 'expires_at',
+            billingMode: BillingMode.PAY_PER_REQUEST,
+            tableClass: TableClass.STANDARD,
+            encryption: TableEncryption.DEFAULT,
+            removalPolicy: RemovalPolicy.DESTROY
+        });
+
+        this.syncTable = new Table(this, 'syncTable', {
+            tableName: 'sync',
+            
+            partitionKey: {
+                name: 'username',
+                type: AttributeType.STRING
+            },
+            sortKey: {
+                name: 'sk',
+                type: AttributeType.STRING
+            },
+            
+            timeToLiveAttribute: 'expires_at',
+            billingMode: BillingMode.PAY_PER_REQUEST,
+            tableClass: TableClass.STANDARD,
+            encryption: TableEncryption.DEFAULT,
+            removalPolicy: RemovalPolicy.RETAIN,
+            pointInTimeRecovery: props.environmentType === "prod"
+        });
+
+        this.deadLettersTable = new Table(this, 'deadLettersTable', {
+            tableName: 'dead_letters',
+            
+            partitionKey: {
+                name: 'table_name',
+                type: AttributeType.STRING
+            },
+            sortKey: {
+                name: 'id',
+                type: AttributeType.STRING
+            },
+            
+            timeToLiveAttribute: 'expires_at',
+            billingMode: BillingMode.PAY_PER_REQUEST,
+            tableClass: TableClass.STANDARD,
+            encryption: TableEncryption.DEFAULT,
+            removalPolicy: RemovalPolicy.DESTROY
+        });
+
+        this.exportsBucket = new Bucket(this, 'exportsBucket', {
+            lifecycleRules: [{ expiration: Duration.days(1) }],
+            blockPublicAccess: BlockPublicAccess.BLOCK_ALL,
+            encryption: BucketEncryption.S3_MANAGED,
+            enforceSSL: true,
+            removalPolicy: RemovalPolicy.DESTROY,
+            autoDeleteObjects: true
+        });
+
+        this.tableEnvironment = {
+            SETTINGS_TABLE: this.settingsTable.tableName,
+            SETTINGS_HISTORY_TABLE: this.settingsHistoryTable.tableName,
+            MEDIA_TABLE: this.mediaTable.tableName,
+            LEADERBOARD_TABLE: this.leaderboardTable.tableName,
+            JOBS_TABLE: this.jobsTable.tableName,
+            SYNC_TABLE: this.syncTable.tableName,
+            DEAD_LETTERS_TABLE: this.deadLettersTable.tableName
+        };
     }
 }
@@ -21,14 +21,23 @@ export class EnvironmentStage extends Stage {
 
 
         const settingsStack = new SettingsStack(this, 'settingsStack', {
-            settingsTable: dataStack.settingsTable
+            settingsTable: dataStack.settingsTable,
+            settingsHistoryTable: dataStack.settingsHistoryTable,
+            tableEnvironment: dataStack.tableEnvironment
         });
         const mediaStack = new MediaStack(this, 'mediaStack', {
+            settingsTable: dataStack.settingsTable,
             mediaTable: dataStack.mediaTable,
-            leaderboardTable: dataStack.leaderboardTable
+            leaderboardTable: dataStack.leaderboardTable,
+            jobsTable: dataStack.jobsTable,
+            syncTable: dataStack.syncTable,
+            deadLettersTable: dataStack.deadLettersTable,
+            exportsBucket: dataStack.exportsBucket,
+            tableEnvironment: dataStack.tableEnvironment
         });
         const leaderboardStack = new LeaderboardStack(this, 'leaderboardStack', {
-            leaderboardTable: dataStack.leaderboardTable
+            leaderboardTable: dataStack.leaderboardTable,
+            tableEnvironment: dataStack.tableEnvironment
         });
 
         if (props.environmentType !== 'local') {
@@ -7,7 +7,8 @@ import { HttpLambdaIntegration } from '@aws-cdk/aws-apigatewayv2-integrations-al
 import { FUNCTIONS_FOLDER } from '../config';
 
 export interface SettingsStackProps extends StackProps {
-    leaderboardTable: Table
+    leaderboardTable: Table,
+    tableEnvironment: { [key: string]: string }
 }
 
 export class LeaderboardStack extends Stack {
@@ -17,7 +18,8 @@ export class LeaderboardStack extends Stack {
         super(scope, id, props);
 
         const leaderboardFunction = new GoFunction(this, 'leaderboardFunction', {
-            entry: FUNCTIONS_FOLDER + 'leaderboard'
+            entry: FUNCTIONS_FOLDER + 'leaderboard',
+            environment: props.tableEnvironment
         });
 
         props.leaderboardTable.grantReadWriteData(leaderboardFunction);
@@ -1,17 +1,24 @@
 import { GoFunction } from '@aws-cdk/aws-lambda-go-alpha';
-import { Stack, StackProps } from 'aws-cdk-lib';
+import { Duration, Stack, StackProps } from 'aws-cdk-lib';
 import { Construct } from 'constructs';
 import { Table } from 'aws-cdk-lib/aws-dynamodb';
+import { Bucket } from 'aws-cdk-lib/aws-s3';
 import { HttpLambdaIntegration } from '@aws-cdk/aws-apigatewayv2-integrations-alpha';
 import { AddRoutesOptions, HttpMethod } from '@aws-cdk/aws-apigatewayv2-alpha';
 import { LambdaInvoke } from 'aws-cdk-lib/aws-stepfunctions-tasks';
-import { DefinitionBody, StateMachine } from 'aws-cdk-lib/aws-stepfunctions';
+import { Choice, Condition, DefinitionBody, JsonPath, StateMachine, Succeed, TaskInput, Wait, WaitTime } from 'aws-cdk-lib/aws-stepfunctions';
 import { FUNCTIONS_FOLDER } from '../config';
 import { HttpStepFunctionsIntegration } from './http-state-machine-integration';
 
 export interface MediaStackProps extends StackProps {
+    settingsTable: Table,
     mediaTable: Table,
-    leaderboardTable: Table
+    leaderboardTable: Table,
+    jobsTable: Table,
+    syncTable: Table,
+    deadLettersTable: Table,
+    exportsBucket: Bucket,
+    tableEnvironment: { [key: string]: string }
 }
 
 export class MediaStack extends Stack {
@@ -22,53 +29,137 @@ export class MediaStack extends Stack {
         super(scope, id, props);
 
         const mediaInfoGetFunction = new GoFunction(this, 'mediaInfoGetFunction', {
-            entry: FUNCTIONS_FOLDER + 'media_info/get'
+            entry: FUNCTIONS_FOLDER + 'media_info/get',
+            environment: props.tableEnvironment
         });
         const mediaInfoPutFunction = new GoFunction(this, 'mediaInfoPutFunction', {
-            entry: FUNCTIONS_FOLDER + 'media_info/put'
+            entry: FUNCTIONS_FOLDER + 'media_info/put',
+            environment: props.tableEnvironment
+        });
+        const mediaInfoDeleteFunction = new GoFunction(this, 'mediaInfoDeleteFunction', {
+            entry: FUNCTIONS_FOLDER + 'media_info/delete',
+            environment: props.tableEnvironment
         });
         const backfillGetFunction = new GoFunction(this, 'backfillGetFunction', {
-            entry: FUNCTIONS_FOLDER + 'backfill/get'
+            entry: FUNCTIONS_FOLDER + 'backfill/get',
+            environment: props.tableEnvironment
         });
         const backfillPostFunction = new GoFunction(this, 'backfillPostFunction', {
-            entry: FUNCTIONS_FOLDER + 'backfill/post'
+            entry: FUNCTIONS_FOLDER + 'backfill/post',
+            environment: props.tableEnvironment
+        });
+        const backfillWriteFunction = new GoFunction(this, 'backfillWriteFunction', {
+            entry: FUNCTIONS_FOLDER + 'backfill/write',
+            environment: props.tableEnvironment
+        });
+        const backfillStatusFunction = new GoFunction(this, 'backfillStatusFunction', {
+            entry: FUNCTIONS_FOLDER + 'backfill/status',
+            environment: props.tableEnvironment
+        });
+        const syncRegisterFunction = new GoFunction(this, 'syncRegisterFunction', {
+            entry: FUNCTIONS_FOLDER + 'sync/register',
+            environment: props.tableEnvironment
+        });
+        const syncGetFunction = new GoFunction(this, 'syncGetFunction', {
+            entry: FUNCTIONS_FOLDER + 'sync/get',
+            environment: props.tableEnvironment
+        });
+        const backfillExportFunction = new GoFunction(this, 'backfillExportFunction', {
+            entry: FUNCTIONS_FOLDER + 'backfill/export',
+            environment: { ...props.tableEnvironment, EXPORT_BUCKET: props.exportsBucket.bucketName },
+            // As long as the HTTP API waits for a response
+            timeout: Duration.seconds(29)
         });
         const statusUpdateGetFunction = new GoFunction(this, 'statusUpdateGetFunction', {
-            entry: FUNCTIONS_FOLDER + 'status_update/get'
+            entry: FUNCTIONS_FOLDER + 'status_update/get',
+            environment: props.tableEnvironment
         });
         const statusUpdatePutFunction = new GoFunction(this, 'statusUpdatePutFunction', {
-            entry: FUNCTIONS_FOLDER + 'status_update/put'
+            entry: FUNCTIONS_FOLDER + 'status_update/put',
+            environment: props.tableEnvironment
         });
         const statusUpdateDeleteFunction = new GoFunction(this, 'statusUpdateDeleteFunction', {
-            entry: FUNCTIONS_FOLDER + 'status_update/delete'
+            entry: FUNCTIONS_FOLDER + 'status_update/delete',
+            environment: props.tableEnvironment
+        });
+        const statusUpdateWeeklyFunction = new GoFunction(this, 'statusUpdateWeeklyFunction', {
+            entry: FUNCTIONS_FOLDER + 'status_update/weekly',
+            environment: props.tableEnvironment
         });
 
+        // Status updates fall back to the timezone and rollover saved in the user's settings, weeks start where they choose
+        props.settingsTable.grantReadData(statusUpdatePutFunction);
+        props.settingsTable.grantReadData(statusUpdateWeeklyFunction);
+
         props.mediaTable.grantReadWriteData(mediaInfoGetFunction);
         props.mediaTable.grantReadWriteData(mediaInfoPutFunction);
+        props.mediaTable.grantReadWriteData(mediaInfoDeleteFunction);
         props.mediaTable.grantReadWriteData(backfillGetFunction);
         props.mediaTable.grantReadWriteData(backfillPostFunction);
+        props.mediaTable.grantReadWriteData(backfillWriteFunction);
+        props.mediaTable.grantReadData(backfillExportFunction);
+        // Exports are uploaded then read back through presigned links, which sign as the function
+        props.exportsBucket.grantReadWrite(backfillExportFunction);
         props.mediaTable.grantReadWriteData(statusUpdateGetFunction);
         props.mediaTable.grantReadWriteData(statusUpdatePutFunction);
         props.mediaTable.grantReadWriteData(statusUpdateDeleteFunction);
+        props.mediaTable.grantReadData(statusUpdateWeeklyFunction);
+        props.mediaTable.grantReadData(syncGetFunction);
 
         props.leaderboardTable.grantReadWriteData(backfillPostFunction);
         props.leaderboardTable.grantReadWriteData(statusUpdatePutFunction);
 
+        props.syncTable.grantReadWriteData(mediaInfoPutFunction);
+        props.syncTable.grantReadWriteData(mediaInfoDeleteFunction);
+        props.syncTable.grantReadWriteData(backfillWriteFunction);
+        props.syncTable.grantReadWriteData(statusUpdatePutFunction);
+        props.syncTable.grantReadWriteData(statusUpdateDeleteFunction);
+        props.syncTable.grantReadWriteData(syncRegisterFunction);
+        props.syncTable.grantReadWriteData(syncGetFunction);
+
+        props.jobsTable.grantReadWriteData(backfillPostFunction);
+        props.jobsTable.grantReadWriteData(backfillWriteFunction);
+        props.jobsTable.grantReadData(backfillStatusFunction);
+
+        props.deadLettersTable.grantWriteData(backfillWriteFunction);
+
+        // The execution name doubles as the job ID clients poll with
         const backfillPostTask = new LambdaInvoke(this, 'backfillPostInvoke', {
             lambdaFunction: backfillPostFunction,
+            payload: TaskInput.fromObject({
+                job_id: JsonPath.stringAt('$$.Execution.Name'),
+                history: JsonPath.entirePayload
+            }),
             outputPath: '$.Payload'
         });
         backfillPostTask.addRetry();
+        const backfillWriteTask = new LambdaInvoke(this, 'backfillWriteInvoke', {
+            lambdaFunction: backfillWriteFunction,
+            outputPath: '$.Payload'
+        });
+        backfillWriteTask.addRetry();
+        const backfillWriteWait = new Wait(this, 'backfillWriteWait', {
+            time: WaitTime.duration(Duration.seconds(5))
+        });
+        const backfillWriteChoice = new Choice(this, 'backfillWriteChoice')
+            .when(Condition.booleanEquals('$.done', true), new Succeed(this, 'backfillFinished'))
+            .otherwise(backfillWriteWait.next(backfillWriteTask));
         const backfillPostStateMachine = new StateMachine(this, 'backfillPostStateMachine', {
-            definitionBody: DefinitionBody.fromChainable(backfillPostTask)
+            definitionBody: DefinitionBody.fromChainable(backfillPostTask.next(backfillWriteTask).next(backfillWriteChoice))
         });
 
         const mediaInfoGetIntegration = new HttpLambdaIntegration('mediaInfoGetIntegration', mediaInfoGetFunction);
         const mediaInfoPutIntegration = new HttpLambdaIntegration('mediaInfoPutIntegration', mediaInfoPutFunction);
+        const mediaInfoDeleteIntegration = new HttpLambdaIntegration('mediaInfoDeleteIntegration', mediaInfoDeleteFunction);
         const backfillGetIntegration = new HttpLambdaIntegration('backfillGetIntegration', backfillGetFunction);
+        const backfillStatusIntegration = new HttpLambdaIntegration('backfillStatusIntegration', backfillStatusFunction);
+        const syncRegisterIntegration = new HttpLambdaIntegration('syncRegisterIntegration', syncRegisterFunction);
+        const syncGetIntegration = new HttpLambdaIntegration('syncGetIntegration', syncGetFunction);
+        const backfillExportIntegration = new HttpLambdaIntegration('backfillExportIntegration', backfillExportFunction);
         const statusUpdateGetIntegration = new HttpLambdaIntegration('statusUpdateGetIntegration', statusUpdateGetFunction);
         const statusUpdatePutIntegration = new HttpLambdaIntegration('statusUpdatePutIntegration', statusUpdatePutFunction);
         const statusUpdateDeleteIntegration = new HttpLambdaIntegration('statusUpdateDeleteIntegration', statusUpdateDeleteFunction);
+        const statusUpdateWeeklyIntegration = new HttpLambdaIntegration('statusUpdateWeeklyIntegration', statusUpdateWeeklyFunction);
 
         const backfillPostIntegration = new HttpStepFunctionsIntegration('backfillPostIntegration', {
             stateMachine: backfillPostStateMachine
@@ -84,6 +175,11 @@ export class MediaStack extends Stack {
             methods: [HttpMethod.PUT],
             integration: mediaInfoPutIntegration
         };
+        const mediaInfoDeleteRouteOptions: AddRoutesOptions = {
+            path: '/mediaInfo/delete',
+            methods: [HttpMethod.DELETE],
+            integration: mediaInfoDeleteIntegration
+        };
         const backfillGetRouteOptions: AddRoutesOptions = {
             path: '/backfill/get',
             methods: [HttpMethod.GET],
@@ -94,6 +190,26 @@ export class MediaStack extends Stack {
             methods: [HttpMethod.POST],
             integration: backfillPostIntegration
         };
+        const backfillStatusRouteOptions: AddRoutesOptions = {
+            path: '/backfill/status',
+            methods: [HttpMethod.GET],
+            integration: backfillStatusIntegration
+        };
+        const backfillExportRouteOptions: AddRoutesOptions = {
+            path: '/backfill/export',
+            methods: [HttpMethod.GET],
+            integration: backfillExportIntegration
+        };
+        const syncRegisterRouteOptions: AddRoutesOptions = {
+            path: '/sync/register',
+            methods: [HttpMethod.POST],
+            integration: syncRegisterIntegration
+        };
+        const syncGetRouteOptions: AddRoutesOptions = {
+            path: '/sync/get',
+            methods: [HttpMethod.GET],
+            integration: syncGetIntegration
+        };
         const statusUpdateGetRouteOptions: AddRoutesOptions = {
             path: '/statusUpdate/get',
             methods: [HttpMethod.GET],
@@ -109,15 +225,26 @@ export class MediaStack extends Stack {
             methods: [HttpMethod.DELETE],
             integration: statusUpdateDeleteIntegration
         };
+        const statusUpdateWeeklyRouteOptions: AddRoutesOptions = {
+            path: '/statusUpdate/weekly',
+            methods: [HttpMethod.GET],
+            integration: statusUpdateWeeklyIntegration
+        };
 
         this.routeOptions = [
             mediaInfoGetRouteOptions,
             mediaInfoPutRouteOptions,
+            mediaInfoDeleteRouteOptions,
             backfillGetRouteOptions,
             backfillPostRouteOptions,
+            backfillStatusRouteOptions,
+            backfillExportRouteOptions,
+            syncRegisterRouteOptions,
+            syncGetRouteOptions,
             statusUpdateGetRouteOptions,
             statusUpdatePutRouteOptions,
-            statusUpdateDeleteRouteOptions
+            statusUpdateDeleteRouteOptions,
+            statusUpdateWeeklyRouteOptions
         ];
     }
 }
@@ -7,7 +7,9 @@ import { AddRoutesOptions, HttpMethod } from '@aws-cdk/aws-apigatewayv2-alpha';
 import { FUNCTIONS_FOLDER } from '../config';
 
 export interface SettingsStackProps extends StackProps {
-    settingsTable: Table
+    settingsTable: Table,
+    settingsHistoryTable: Table,
+    tableEnvironment: { [key: string]: string }
 }
 
 export class SettingsStack extends Stack {
@@ -17,18 +19,51 @@ export class SettingsStack extends Stack {
         super(scope, id, props);
         
         const settingsGetFunction = new GoFunction(this, 'settingsGetFunction', {
-            entry: FUNCTIONS_FOLDER + 'settings/get'
+            entry: FUNCTIONS_FOLDER + 'settings/get',
+            environment: props.tableEnvironment
         });
 
         const settingsPutFunction = new GoFunction(this, 'settingsPutFunction', {
-            entry: FUNCTIONS_FOLDER + 'settings/put'
+            entry: FUNCTIONS_FOLDER + 'settings/put',
+            environment: props.tableEnvironment
+        });
+
+        const settingsListFunction = new GoFunction(this, 'settingsListFunction', {
+            entry: FUNCTIONS_FOLDER + 'settings/list',
+            environment: props.tableEnvironment
+        });
+
+        const settingsResetFunction = new GoFunction(this, 'settingsResetFunction', {
+            entry: FUNCTIONS_FOLDER + 'settings/reset',
+            environment: props.tableEnvironment
+        });
+
+        const settingsHistoryFunction = new GoFunction(this, 'settingsHistoryFunction', {
+            entry: FUNCTIONS_FOLDER + 'settings/history',
+            environment: props.tableEnvironment
+        });
+
+        const settingsRestoreFunction = new GoFunction(this, 'settingsRestoreFunction', {
+            entry: FUNCTIONS_FOLDER + 'settings/restore',
+            environment: props.tableEnvironment
         });
 
         props.settingsTable.grantReadWriteData(settingsGetFunction);
         props.settingsTable.grantReadWriteData(settingsPutFunction);
+        props.settingsTable.grantReadData(settingsListFunction);
+        props.settingsTable.grantReadWriteData(settingsResetFunction);
+        props.settingsTable.grantReadWriteData(settingsRestoreFunction);
+        props.settingsHistoryTable.grantReadWriteData(settingsPutFunction);
+        props.settingsHistoryTable.grantReadWriteData(settingsResetFunction);
+        props.settingsHistoryTable.grantReadData(settingsHistoryFunction);
+        props.settingsHistoryTable.grantReadWriteData(settingsRestoreFunction);
 
         const settingsGetIntegration = new HttpLambdaIntegration('settingsGetIntegration', settingsGetFunction);
         const settingsPutIntegration = new HttpLambdaIntegration('settingsPutIntegration', settingsPutFunction);
+        const settingsListIntegration = new HttpLambdaIntegration('settingsListIntegration', settingsListFunction);
+        const settingsResetIntegration = new HttpLambdaIntegration('settingsResetIntegration', settingsResetFunction);
+        const settingsHistoryIntegration = new HttpLambdaIntegration('settingsHistoryIntegration', settingsHistoryFunction);
+        const settingsRestoreIntegration = new HttpLambdaIntegration('settingsRestoreIntegration', settingsRestoreFunction);
 
         const settingsGetRouteOptions = {
             path: '/settings/get',
@@ -42,6 +77,30 @@ export class SettingsStack extends Stack {
             integration: settingsPutIntegration
         };
 
-        this.routeOptions = [settingsGetRouteOptions, settingsPutRouteOptions];
+        const settingsListRouteOptions = {
+            path: '/settings/list',
+            methods: [HttpMethod.GET],
+            integration: settingsListIntegration
+        };
+
+        const settingsResetRouteOptions = {
+            path: '/settings/reset',
+            methods: [HttpMethod.DELETE],
+            integration: settingsResetIntegration
+        };
+
+        const settingsHistoryRouteOptions = {
+            path: '/settings/history',
+            methods: [HttpMethod.GET],
+            integration: settingsHistoryIntegration
+        };
+
+        const settingsRestoreRouteOptions = {
+            path: '/settings/restore',
+            methods: [HttpMethod.POST],
+            integration: settingsRestoreIntegration
+        };
+
+        this.routeOptions = [settingsGetRouteOptions, settingsPutRouteOptions, settingsListRouteOptions, settingsResetRouteOptions, settingsHistoryRouteOptions, settingsRestoreRouteOptions];
     }
 }